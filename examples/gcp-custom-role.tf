@@ -7,5 +7,10 @@ resource "google_project_iam_custom_role" "k8s-pvc-tagger" {
     "compute.disks.get",
     "compute.disks.list",
     "compute.disks.setLabels",
+    "compute.zoneOperations.get",
+    "compute.regionOperations.get",
+    "file.instances.get",
+    "file.instances.update",
+    "file.operations.get",
   ]
 }
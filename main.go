@@ -20,80 +20,40 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/mtougeron/k8s-pvc-tagger/pkg/tagger"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 var (
-	buildVersion            string = ""
-	buildTime               string = ""
-	debugEnv                string = os.Getenv("DEBUG")
-	logFormatEnv            string = os.Getenv("LOG_FORMAT")
-	debug                   bool
-	defaultTags             map[string]string
-	defaultAnnotationPrefix string = "k8s-pvc-tagger"
-	annotationPrefix        string = "k8s-pvc-tagger"
-	legacyAnnotationPrefix  string = "aws-ebs-tagger"
-	watchNamespace          string
-	tagFormat               string = "json"
-	allowAllTags            bool
-	cloud                   string
-	copyLabels              []string
-	copyAnnotations         []string
-
-	promActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "k8s_pvc_tagger_actions_total",
-		Help: "The total number of PVCs tagged",
-	}, []string{"status", "storageclass"})
-
-	promIgnoredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "k8s_pvc_tagger_pvc_ignored_total",
-		Help: "The total number of PVCs ignored",
-	}, []string{"storageclass"})
-
-	promInvalidTagsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "k8s_pvc_tagger_invalid_tags_total",
-		Help: "The total number of invalid tags found",
-	}, []string{"storageclass"})
-
-	promActionsLegacyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "k8s_aws_ebs_tagger_actions_total",
-		Help: "The total number of PVCs tagged",
-	}, []string{"status"})
-
-	promIgnoredLegacyTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "k8s_aws_ebs_tagger_pvc_ignored_total",
-		Help: "The total number of PVCs ignored",
-	})
-
-	promInvalidTagsLegacyTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "k8s_aws_ebs_tagger_invalid_tags_total",
-		Help: "The total number of invalid tags found",
-	})
-)
-
-const (
-	AWS   = "aws"
-	AZURE = "azure"
-	GCP   = "gcp"
+	buildVersion string = ""
+	buildTime    string = ""
+	debugEnv     string = os.Getenv("DEBUG")
+	logFormatEnv string = os.Getenv("LOG_FORMAT")
+	debug        bool
+
+	// DefaultKubeConfigFile local kubeconfig if not running in cluster
+	DefaultKubeConfigFile = filepath.Join(os.Getenv("HOME"), ".kube", "config")
 )
 
 func init() {
@@ -122,104 +82,203 @@ func main() {
 	var err error
 	var kubeconfig string
 	var kubeContext string
-	var region string
 	var leaseLockName string
 	var leaseLockNamespace string
 	var leaseID string
 	var defaultTagsString string
+	var tagFormat string
+	var annotationPrefix string
+	var watchNamespace string
+	var allowAllTags bool
+	var cloud string
+	var awsRegion string
+	var efsTagMode string
 	var statusPort string
 	var metricsPort string
 	var copyLabelsString string
 	var copyAnnotationsString string
+	var copyNamespaceLabelsString string
+	var maxAttempts int
+	var resyncPeriod time.Duration
+	var enableTaggingPolicies bool
+	var enableSnapshots bool
+	var dryRun bool
+	var webhookPort string
+	var webhookCertFile string
+	var webhookKeyFile string
+	var webhookMutate bool
+	var configFile string
+	var configReloadPeriod time.Duration
+
+	// `k8s-pvc-tagger backfill [flags]` tags the volumes of the existing PVCs once and exits
+	var backfill *tagger.BackfillOptions
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		os.Args = slices.Delete(os.Args, 1, 2)
+		backfill = newBackfillOptions(flag.CommandLine)
+	}
 
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	flag.StringVar(&kubeContext, "context", "", "the context to use")
-	flag.StringVar(&region, "region", os.Getenv("AWS_REGION"), "the region")
+	flag.StringVar(&awsRegion, "region", os.Getenv("AWS_REGION"), "the region")
+	flag.StringVar(&efsTagMode, "efs-tag-mode", tagger.EFSTagAccessPoint, "The resources of the EFS volumes to tag: access-point, file-system or both")
 	flag.StringVar(&leaseID, "lease-id", uuid.New().String(), "the holder identity name")
 	flag.StringVar(&leaseLockName, "lease-lock-name", "k8s-pvc-tagger", "the lease lock resource name")
 	flag.StringVar(&leaseLockNamespace, "lease-lock-namespace", os.Getenv("NAMESPACE"), "the lease lock resource namespace")
 	flag.StringVar(&defaultTagsString, "default-tags", "", "Default tags to add to EBS/EFS volume")
 	flag.StringVar(&tagFormat, "tag-format", "json", "Whether the tags are in json or csv format. Default: json")
-	flag.StringVar(&annotationPrefix, "annotation-prefix", "k8s-pvc-tagger", "Annotation prefix to check")
+	flag.StringVar(&annotationPrefix, "annotation-prefix", tagger.DefaultAnnotationPrefix, "Annotation prefix to check")
 	flag.StringVar(&watchNamespace, "watch-namespace", os.Getenv("WATCH_NAMESPACE"), "A specific namespace to watch (default is all namespaces)")
 	flag.StringVar(&statusPort, "status-port", "8000", "The healthz port")
 	flag.StringVar(&metricsPort, "metrics-port", "8001", "The prometheus metrics port")
 	flag.BoolVar(&allowAllTags, "allow-all-tags", false, "Whether or not to allow any tag, even Kubernetes assigned ones, to be set")
-	flag.StringVar(&cloud, "cloud", AWS, "The cloud provider (aws, gcp or azure)")
+	flag.StringVar(&cloud, "cloud", tagger.AWS, "The cloud providers, a comma-separated list of aws, gcp and azure, or auto for all of them")
 	flag.StringVar(&copyLabelsString, "copy-labels", "", "Comma-separated list of PVC labels to copy to volumes. Use '*' to copy all labels. (default \"\")")
 	flag.StringVar(&copyAnnotationsString, "copy-annotations", "", "Comma-separated list of PVC annotations to copy to volumes. (default \"\")")
+	flag.StringVar(&copyNamespaceLabelsString, "copy-namespace-labels", "", "Comma-separated list of Namespace labels to copy to the volumes of its PVCs. Use '*' to copy all labels. (default \"\")")
+	flag.IntVar(&maxAttempts, "max-attempts", 5, "Maximum number of attempts for a failed tag operation before giving up on it")
+	flag.BoolVar(&enableTaggingPolicies, "enable-tagging-policies", false, "Whether or not to merge the tags of the TaggingPolicy custom resources. Requires the TaggingPolicy CRD to be installed")
+	flag.BoolVar(&enableSnapshots, "enable-snapshots", false, "Whether or not to tag the cloud snapshots of VolumeSnapshots with the tags of their PVC. Requires the snapshot.storage.k8s.io CRDs to be installed")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log and count the tags that would be added or removed without changing any volume")
+	flag.StringVar(&webhookPort, "webhook-port", "", "The port of the validating admission webhook (default \"\" disables the webhook)")
+	flag.StringVar(&webhookCertFile, "webhook-cert-file", "", "The TLS certificate file of the admission webhook")
+	flag.StringVar(&webhookKeyFile, "webhook-key-file", "", "The TLS key file of the admission webhook")
+	flag.BoolVar(&webhookMutate, "webhook-mutate", false, "Whether or not the admission webhook writes the effective tags of new PVCs into their tags annotation")
+	flag.StringVar(&configFile, "config-file", "", "The YAML config file overriding the tag settings of the flags, reloaded at runtime when it changes")
+	flag.DurationVar(&configReloadPeriod, "config-reload-period", 10*time.Second, "How often the config file is checked for changes")
+	flag.DurationVar(&resyncPeriod, "resync-period", 0, "How often to reconcile the tags of every bound PVC against its cloud volume, e.g. 1h. 0 disables the periodic resync")
 	flag.Parse()
 
-	if leaseLockName == "" {
-		log.Fatalln("unable to get lease lock resource name (missing lease-lock-name flag).")
-	}
-	if leaseLockNamespace == "" {
-		leaseLockNamespace = getCurrentNamespace()
+	// backfill doesn't take part in the leader election
+	if backfill == nil {
+		if leaseLockName == "" {
+			log.Fatalln("unable to get lease lock resource name (missing lease-lock-name flag).")
+		}
 		if leaseLockNamespace == "" {
-			log.Fatalln("unable to get lease lock resource namespace (missing lease-lock-namespace flag).")
+			leaseLockNamespace = getCurrentNamespace()
+			if leaseLockNamespace == "" {
+				log.Fatalln("unable to get lease lock resource namespace (missing lease-lock-namespace flag).")
+			}
 		}
 	}
 
-	switch cloud {
-	case AWS:
-		log.Infoln("Running in AWS mode")
-		// Parse AWS_REGION environment variable.
-		if len(region) == 0 {
-			region, _ = getMetadataRegion()
-			log.WithFields(log.Fields{"region": region}).Debugln("ec2Metadata region")
+	clouds, err := tagger.ParseClouds(cloud)
+	if err != nil {
+		log.Fatalln("Invalid cloud:", err)
+	}
+	for _, c := range clouds {
+		switch c {
+		case tagger.AWS:
+			log.Infoln("Running in AWS mode")
+		case tagger.GCP:
+			log.Infoln("Running in GCP mode")
+		case tagger.AZURE:
+			log.Infoln("Running in Azure mode")
 		}
-		ok, err := regexp.Match(regexpAWSRegion, []byte(region))
+	}
+
+	// The config file overrides the tag settings of the flags
+	log.Debugln("defaultTagsString:", defaultTagsString)
+	flagDefaultTags, err := tagger.ParseDefaultTags(defaultTagsString, tagFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	flagSettings := tagger.Settings{
+		DefaultTags:         flagDefaultTags,
+		TagFormat:           tagFormat,
+		AllowAllTags:        allowAllTags,
+		AnnotationPrefix:    annotationPrefix,
+		CopyLabels:          parseCopyLabels(copyLabelsString),
+		CopyAnnotations:     parseCopyAnnotations(copyAnnotationsString),
+		CopyNamespaceLabels: parseCopyLabels(copyNamespaceLabelsString),
+	}
+	settings := flagSettings
+	var configData []byte
+	if configFile != "" {
+		configData, err = os.ReadFile(configFile)
 		if err != nil {
-			log.Fatalln("Failed to parse AWS_REGION:", err.Error())
-		}
-		if !ok {
-			log.Fatalln("Given AWS_REGION does not match AWS Region format.")
-		}
-		awsSession = createAWSSession(region)
-		if awsSession == nil {
-			err = fmt.Errorf("nil AWS session: %v", awsSession)
-			if err != nil {
-				log.Println(err.Error())
-			}
-			os.Exit(1)
+			log.Fatalln("Cannot read config file:", err)
 		}
-	case GCP:
-		log.Infoln("Running in GCP mode")
-	case AZURE:
-		log.Infoln("Running in Azure mode")
-	default:
-		log.Fatalln("Cloud provider must be either aws or gcp")
-	}
-
-	defaultTags = make(map[string]string)
-	if defaultTagsString != "" {
-		log.Debugln("defaultTagsString:", defaultTagsString)
-		if tagFormat == "csv" {
-			defaultTags = parseCsv(defaultTagsString)
-		} else {
-			err := json.Unmarshal([]byte(defaultTagsString), &defaultTags)
-			if err != nil {
-				log.Fatalln("default-tags are not valid json key/value pairs:", err)
-			}
+		settings, err = tagger.LoadConfigFile(flagSettings, configData)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		log.WithFields(log.Fields{"path": configFile}).Infoln("Loaded config file")
+	}
+
+	if dryRun {
+		log.Infoln("Running in dry-run mode, no volume will be tagged")
+	}
+	if resyncPeriod > 0 {
+		log.WithFields(log.Fields{"period": resyncPeriod}).Infoln("Periodic resync enabled")
 	}
-	log.WithFields(log.Fields{"tags": defaultTags}).Infoln("Default Tags")
 
-	if copyLabelsString != "" {
-		copyLabels = parseCopyLabels(copyLabelsString)
-		log.Infof("Copying PVC labels to tags: %v", copyLabels)
+	if webhookPort != "" && (webhookCertFile == "" || webhookKeyFile == "") {
+		log.Fatalln("webhook-cert-file and webhook-key-file are required by the admission webhook")
+	}
+	if configFile != "" && configReloadPeriod <= 0 {
+		log.Fatalln("config-reload-period must be positive")
 	}
 
-	if copyAnnotationsString != "" {
-		copyAnnotations = parseCopyAnnotations(copyAnnotationsString)
-		log.Infof("Copying PVC annotations to tags: %v", copyAnnotations)
+	if webhookMutate && webhookPort == "" {
+		log.Fatalln("webhook-mutate requires the admission webhook, see webhook-port")
 	}
 
-	k8sClient, err = BuildClient(kubeconfig, kubeContext)
+	k8sClient, err := BuildClient(kubeconfig, kubeContext)
 	if err != nil {
 		log.Fatalln("Unable to create kubernetes client", err)
 		os.Exit(1)
 	}
+	var dynamicClient dynamic.Interface
+	// the Azure NetApp Files volumes are found with their TridentVolume
+	if enableTaggingPolicies || enableSnapshots || slices.Contains(clouds, tagger.AZURE) {
+		dynamicClient, err = BuildDynamicClient(kubeconfig, kubeContext)
+		if err != nil {
+			log.Fatalln("Unable to create kubernetes dynamic client", err)
+		}
+	}
+	if enableTaggingPolicies {
+		log.Infoln("TaggingPolicies enabled")
+	}
+	if enableSnapshots {
+		log.Infoln("VolumeSnapshots enabled")
+	}
+
+	var namespaces []string
+	if watchNamespace != "" {
+		namespaces = strings.Split(watchNamespace, ",")
+	}
+	t, err := tagger.New(tagger.Config{
+		Settings:              settings,
+		Namespaces:            namespaces,
+		Clouds:                clouds,
+		AWSRegion:             awsRegion,
+		EFSTagMode:            efsTagMode,
+		ResyncPeriod:          resyncPeriod,
+		MaxAttempts:           maxAttempts,
+		EnableTaggingPolicies: enableTaggingPolicies,
+		EnableSnapshots:       enableSnapshots,
+		DryRun:                dryRun,
+	}, k8sClient, dynamicClient)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// In auto mode the AWS config is only loaded once an AWS volume needs it
+	if cloud != tagger.AUTO && slices.Contains(clouds, tagger.AWS) {
+		if err := t.InitAWSConfig(context.Background()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if backfill != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := t.Backfill(ctx, *backfill, os.Stdout)
+		stop()
+		if err != nil {
+			log.Fatalln("Backfill failed:", err)
+		}
+		return
+	}
 
 	go func() {
 		mux := http.NewServeMux()
@@ -250,18 +309,6 @@ func main() {
 		}
 	}()
 
-	run := func(ctx context.Context) {
-		var namespaces []string
-		if watchNamespace != "" {
-			namespaces = strings.Split(watchNamespace, ",")
-		} else {
-			namespaces = append(namespaces, "")
-		}
-		for _, ns := range namespaces {
-			go runWatchNamespaceTask(ctx, ns)
-		}
-	}
-
 	// use a Go context so we can tell the leaderelection code when we
 	// want to step down
 	ctx, cancel := context.WithCancel(context.Background())
@@ -278,6 +325,21 @@ func main() {
 		cancel()
 	}()
 
+	// every replica reloads the config file, the webhook needs it too
+	if configFile != "" {
+		go t.WatchConfigFile(ctx, configFile, configReloadPeriod, flagSettings, configData)
+	}
+
+	// every replica serves the webhook, not only the leader. The mutating webhook builds
+	// the tags of the new PVCs so the replicas also run the cluster informers.
+	if webhookPort != "" {
+		go func() {
+			if err := t.RunWebhookServer(ctx, webhookPort, webhookCertFile, webhookKeyFile, webhookMutate); err != nil {
+				log.Errorln(err)
+			}
+		}()
+	}
+
 	// we use the Lease lock type since edits to Leases are less common
 	// and fewer objects in the cluster watch "all Leases".
 	lock := &resourcelock.LeaseLock{
@@ -306,7 +368,9 @@ func main() {
 		RetryPeriod:     5 * time.Second,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(ctx context.Context) {
-				run(ctx)
+				if err := t.Run(ctx); err != nil {
+					log.Fatalln(err)
+				}
 			},
 			OnStoppedLeading: func() {
 				log.Infoln("leader lost:", leaseID)
@@ -338,37 +402,74 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func runWatchNamespaceTask(ctx context.Context, namespace string) {
-	// Make the informer's channel here so we can close it when the
-	// context is Done()
-	ch := make(chan struct{})
-	go watchForPersistentVolumeClaims(ctx, ch, namespace)
+func buildRestConfig(kubeconfig string, kubeContext string) (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		if kubeconfig == "" {
+			kubeconfig = DefaultKubeConfigFile
+		}
+		config, err = buildConfigFromFlags(kubeconfig, kubeContext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
 
-	<-ctx.Done()
-	close(ch)
+func BuildClient(kubeconfig string, kubeContext string) (*kubernetes.Clientset, error) {
+	config, err := buildRestConfig(kubeconfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return clientset, nil
 }
 
-func parseCsv(value string) map[string]string {
-	tags := make(map[string]string)
-	for _, s := range strings.Split(value, ",") {
-		if len(s) == 0 {
-			continue
-		}
-		pairs := strings.SplitN(s, "=", 2)
-		if len(pairs) != 2 {
-			log.Errorln("invalid csv key/value pair. Skipping...")
-			continue
-		}
-		k := strings.TrimSpace(pairs[0])
-		v := strings.TrimSpace(pairs[1])
-		if k == "" || v == "" {
-			log.Errorln("invalid csv key/value pair. Skipping...")
-			continue
+func BuildDynamicClient(kubeconfig string, kubeContext string) (dynamic.Interface, error) {
+	config, err := buildRestConfig(kubeconfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func buildConfigFromFlags(kubeconfig string, context string) (*rest.Config, error) {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{
+			CurrentContext: context,
+		}).ClientConfig()
+}
+
+func getCurrentNamespace() string {
+	// Fall back to the namespace associated with the service account token, if available
+	if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
+			return ns
 		}
-		tags[k] = v
 	}
 
-	return tags
+	return ""
+}
+
+// newBackfillOptions adds the flags of the backfill subcommand to fs
+func newBackfillOptions(fs *flag.FlagSet) *tagger.BackfillOptions {
+	opts := &tagger.BackfillOptions{}
+	fs.Func("namespace", "Comma-separated list of namespaces to backfill (default all namespaces)", func(value string) error {
+		opts.Namespaces = parseCopyAnnotations(value)
+		return nil
+	})
+	fs.Func("storage-class", "Comma-separated list of storage classes to backfill (default all storage classes)", func(value string) error {
+		opts.StorageClasses = parseCopyAnnotations(value)
+		return nil
+	})
+	fs.StringVar(&opts.Selector, "selector", "", "Label selector of the PVCs to backfill, e.g. app=db")
+	fs.IntVar(&opts.Concurrency, "concurrency", 10, "How many volumes are tagged at the same time")
+	return opts
 }
 
 func parseCopyLabels(copyLabelsString string) []string {
@@ -23,57 +23,6 @@ import (
 	"testing"
 )
 
-func Test_parseCsv(t *testing.T) {
-	tests := []struct {
-		name string
-		csv  string
-		want map[string]string
-	}{
-		{
-			name: "empty string",
-			csv:  "",
-			want: map[string]string{},
-		},
-		{
-			name: "single key/value string",
-			csv:  "touge=me",
-			want: map[string]string{"touge": "me"},
-		},
-		{
-			name: "multiple key/value string",
-			csv:  "touge=me,foo=bar",
-			want: map[string]string{"touge": "me", "foo": "bar"},
-		},
-		{
-			name: "invalid string",
-			csv:  "foo",
-			want: map[string]string{},
-		},
-		{
-			name: "invalid key string",
-			csv:  "=foo",
-			want: map[string]string{},
-		},
-		{
-			name: "invalid value string",
-			csv:  "foo=",
-			want: map[string]string{},
-		},
-		{
-			name: "double delim",
-			csv:  "foo=bar,,touge=me",
-			want: map[string]string{"touge": "me", "foo": "bar"},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := parseCsv(tt.csv); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("parseCsv() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func Test_parseCopyLabels(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -0,0 +1,773 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/efs"
+	efstypes "github.com/aws/aws-sdk-go-v2/service/efs/types"
+	"github.com/aws/aws-sdk-go-v2/service/fsx"
+	fsxtypes "github.com/aws/aws-sdk-go-v2/service/fsx/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+const (
+	// Matching strings for region
+	regexpAWSRegion = `^[\w]{2}[-][\w]{4,9}[-][\d]$|^[\w]{2}[-][\w]{3}[-][\w]{4,9}[-][\d]$`
+	// Matching strings for the IAM role ARNs assumed to tag the volumes
+	regexpAWSRoleARN = `^arn:aws[\w-]*:iam::\d{12}:role/.+$`
+
+	// awsRoleSessionName is the session name of the assumed IAM roles, shown in CloudTrail
+	awsRoleSessionName = "k8s-pvc-tagger"
+
+	// EFSTagAccessPoint tags the access point of an EFS volume, or its file system when
+	// the volume handle has no access point
+	EFSTagAccessPoint = "access-point"
+	// EFSTagFileSystem tags the file system of an EFS volume. The tags of the file system
+	// of a volume with an access point, shared with the other volumes of its storage class,
+	// are set but never removed.
+	EFSTagFileSystem = "file-system"
+	// EFSTagBoth tags the access point and the file system of an EFS volume, with the same
+	// limitation as EFSTagFileSystem
+	EFSTagBoth = "both"
+)
+
+func init() {
+	// the AWS volumes of the PVCs with an AWSRoles role are tagged by assuming it
+	newEC2Tagger := func(ctx context.Context, t *Tagger) (VolumeTagger, error) {
+		return newAWSRoleVolumeTagger(func(roleARN string) (VolumeTagger, error) {
+			return t.newEC2Client(ctx, roleARN)
+		}), nil
+	}
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:     AWS,
+		Drivers:   []string{AWS_EBS_CSI, AWS_EBS_LEGACY, AWS_EBS_CSI_AUTO},
+		VolumeID:  ebsVolumeID,
+		NewTagger: newEC2Tagger,
+		// EBS snapshots are tagged like the volumes, by their EC2 resource ID
+		NewSnapshotTagger: newEC2Tagger,
+	})
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:    AWS,
+		Drivers:  []string{AWS_EFS_CSI},
+		VolumeID: efsBackendVolumeID,
+		NewTagger: func(ctx context.Context, t *Tagger) (VolumeTagger, error) {
+			return newAWSRoleVolumeTagger(func(roleARN string) (VolumeTagger, error) {
+				return t.newEFSClient(ctx, roleARN)
+			}), nil
+		},
+	})
+	newFSxTagger := func(ctx context.Context, t *Tagger) (VolumeTagger, error) {
+		return newAWSRoleVolumeTagger(func(roleARN string) (VolumeTagger, error) {
+			return t.newFSxClient(ctx, roleARN)
+		}), nil
+	}
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:     AWS,
+		Drivers:   []string{AWS_FSX_CSI, AWS_FSX_OPENZFS_CSI},
+		VolumeID:  fsxVolumeID,
+		NewTagger: newFSxTagger,
+	})
+	// the Trident volumes are Azure NetApp Files volumes too, told apart by their backendType
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:     AWS,
+		Drivers:   []string{AWS_FSX_ONTAP_TRIDENT},
+		VolumeID:  fsxONTAPTridentVolumeID,
+		NewTagger: newFSxTagger,
+	})
+}
+
+// ebsVolumeID returns the EC2 volume ID of an EBS PV, CSI or in-tree
+func ebsVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	var volumeID string
+	switch {
+	case pv.Spec.CSI != nil:
+		volumeID = pv.Spec.CSI.VolumeHandle
+	case pv.Spec.AWSElasticBlockStore != nil:
+		volumeID = parseAWSEBSVolumeID(pv.Spec.AWSElasticBlockStore.VolumeID)
+	}
+	if volumeID == "" {
+		return "", errors.New("the PV has no EBS volume ID")
+	}
+	return volumeID, nil
+}
+
+// efsBackendVolumeID returns the file system and access point of an EFS PV, see efsVolumeID
+func efsBackendVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	handle, err := csiVolumeHandle(pv)
+	if err != nil {
+		return "", err
+	}
+	fileSystemID, accessPointID, err := parseAWSEFSVolumeID(handle)
+	if err != nil {
+		return "", err
+	}
+	return efsVolumeID(fileSystemID, accessPointID), nil
+}
+
+// fsxVolumeID returns the file system or volume ID of an FSx PV
+func fsxVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	return csiVolumeHandle(pv)
+}
+
+// fsxONTAPTridentVolumeID returns the name of the FSx for ONTAP volume of a Trident PV. The
+// Trident volumes of the other backendTypes aren't FSx volumes.
+func fsxONTAPTridentVolumeID(pv *corev1.PersistentVolume, storageClass *storagev1.StorageClass) (string, error) {
+	if _, err := csiVolumeHandle(pv); err != nil {
+		return "", err
+	}
+	switch tridentBackendType(storageClass) {
+	case tridentBackendONTAPNAS, tridentBackendONTAPSAN:
+		// the handle of a Trident volume is the PV name, the FSx volume is
+		// found by the name Trident created it with
+		if internalName := pv.Spec.CSI.VolumeAttributes["internalName"]; internalName != "" {
+			return internalName, nil
+		}
+		return "", errors.New("the Trident PV has no internalName volume attribute")
+	default:
+		return "", nil
+	}
+}
+
+// EC2API is the part of the EC2 API used to tag the EBS volumes and snapshots
+type EC2API interface {
+	CreateTags(context.Context, *ec2.CreateTagsInput, ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DeleteTags(context.Context, *ec2.DeleteTagsInput, ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+	DescribeTags(context.Context, *ec2.DescribeTagsInput, ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error)
+}
+
+// EFSAPI is the part of the EFS API used to tag the EFS access points and file systems
+type EFSAPI interface {
+	TagResource(context.Context, *efs.TagResourceInput, ...func(*efs.Options)) (*efs.TagResourceOutput, error)
+	UntagResource(context.Context, *efs.UntagResourceInput, ...func(*efs.Options)) (*efs.UntagResourceOutput, error)
+	ListTagsForResource(context.Context, *efs.ListTagsForResourceInput, ...func(*efs.Options)) (*efs.ListTagsForResourceOutput, error)
+}
+
+// FSxAPI is the part of the FSx API used to find and tag the FSx file systems and volumes
+type FSxAPI interface {
+	DescribeFileSystems(context.Context, *fsx.DescribeFileSystemsInput, ...func(*fsx.Options)) (*fsx.DescribeFileSystemsOutput, error)
+	DescribeVolumes(context.Context, *fsx.DescribeVolumesInput, ...func(*fsx.Options)) (*fsx.DescribeVolumesOutput, error)
+	TagResource(context.Context, *fsx.TagResourceInput, ...func(*fsx.Options)) (*fsx.TagResourceOutput, error)
+	UntagResource(context.Context, *fsx.UntagResourceInput, ...func(*fsx.Options)) (*fsx.UntagResourceOutput, error)
+	ListTagsForResource(context.Context, *fsx.ListTagsForResourceInput, ...func(*fsx.Options)) (*fsx.ListTagsForResourceOutput, error)
+}
+
+// Client efs interface
+type EFSClient struct {
+	EFSAPI
+	// tagMode selects the resources of an EFS volume that are tagged, see EFSTagAccessPoint
+	tagMode string
+}
+
+// Client EC2 client interface
+type EBSClient struct {
+	EC2API
+}
+
+// FSx client
+type FSxClient struct {
+	FSxAPI
+
+	// arns caches the ARN of each FSx file system or volume ID
+	arnsMu sync.Mutex
+	arns   map[string]string
+}
+
+// newAWSRetryer returns the retryer of the AWS clients, retrying the throttled and
+// failed calls up to 5 times with a backoff of at most 10s
+func newAWSRetryer() aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = 6
+		o.MaxBackoff = 10 * time.Second
+	})
+}
+
+// InitAWSConfig loads the AWS credentials and region now instead of when the first AWS
+// volume is tagged, so an invalid region is reported at once.
+func (t *Tagger) InitAWSConfig(ctx context.Context) error {
+	_, err := t.getAWSConfig(ctx, "")
+	return err
+}
+
+// loadAWSConfig returns the AWS config, loading it the first time it's called. The
+// credentials come from the default chain of the SDK: the environment, the EKS Pod
+// Identity agent, the IRSA web identity token or the EC2 instance profile. The region
+// is the AWSRegion, the region of the environment or the EC2 metadata region.
+// The caller holds the awsMu.
+func (t *Tagger) loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	if t.awsConfig != nil {
+		return *t.awsConfig, nil
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRetryer(newAWSRetryer)}
+	if t.awsRegion != "" {
+		opts = append(opts, awsconfig.WithRegion(t.awsRegion))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region, _ = getMetadataRegion(ctx, cfg)
+		log.WithFields(log.Fields{"region": cfg.Region}).Debugln("ec2Metadata region")
+	}
+	ok, err := regexp.Match(regexpAWSRegion, []byte(cfg.Region))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to parse AWS_REGION: %w", err)
+	}
+	if !ok {
+		return aws.Config{}, errors.New("given AWS_REGION does not match AWS Region format")
+	}
+	t.awsConfig = &cfg
+	return cfg, nil
+}
+
+// getAWSConfig returns the AWS config of the roleARN, or of the pod credentials when
+// roleARN is empty, building it the first time it's called. The config of a role
+// assumes it with the pod credentials and renews its credentials before they expire.
+func (t *Tagger) getAWSConfig(ctx context.Context, roleARN string) (aws.Config, error) {
+	t.awsMu.Lock()
+	defer t.awsMu.Unlock()
+	if cfg, ok := t.awsRoleConfigs[roleARN]; ok {
+		return cfg, nil
+	}
+
+	cfg, err := t.loadAWSConfig(ctx)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if roleARN != "" {
+		log.WithFields(log.Fields{"role": roleARN}).Debugln("Assuming AWS role")
+		cfg = cfg.Copy()
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = awsRoleSessionName
+		}))
+	}
+	if t.awsRoleConfigs == nil {
+		t.awsRoleConfigs = map[string]aws.Config{}
+	}
+	t.awsRoleConfigs[roleARN] = cfg
+	return cfg, nil
+}
+
+// newEFSClient initializes an EFS client of the roleARN
+func (t *Tagger) newEFSClient(ctx context.Context, roleARN string) (*EFSClient, error) {
+	cfg, err := t.getAWSConfig(ctx, roleARN)
+	if err != nil {
+		return nil, err
+	}
+	return &EFSClient{EFSAPI: efs.NewFromConfig(cfg), tagMode: t.efsTagMode}, nil
+}
+
+// newEC2Client initializes an EC2 client of the roleARN
+func (t *Tagger) newEC2Client(ctx context.Context, roleARN string) (*EBSClient, error) {
+	cfg, err := t.getAWSConfig(ctx, roleARN)
+	if err != nil {
+		return nil, err
+	}
+	return &EBSClient{ec2.NewFromConfig(cfg)}, nil
+}
+
+// newFSxClient initializes an FSx client of the roleARN
+func (t *Tagger) newFSxClient(ctx context.Context, roleARN string) (*FSxClient, error) {
+	cfg, err := t.getAWSConfig(ctx, roleARN)
+	if err != nil {
+		return nil, err
+	}
+	return &FSxClient{FSxAPI: fsx.NewFromConfig(cfg)}, nil
+}
+
+func getMetadataRegion(ctx context.Context, cfg aws.Config) (string, error) {
+	output, err := imds.NewFromConfig(cfg).GetRegion(ctx, &imds.GetRegionInput{})
+	if err != nil {
+		return "", fmt.Errorf("could not get EC2 instance identity metadata")
+	}
+	if len(output.Region) == 0 {
+		return "", fmt.Errorf("could not get valid EC2 region")
+	}
+	return output.Region, nil
+}
+
+// awsRoleARN returns the IAM role assumed to tag the volume of the PVC: the role of its
+// StorageClass, else the role of its namespace, else none.
+func (t *Tagger) awsRoleARN(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName != nil {
+		if roleARN, ok := t.settings.AWSRoles.StorageClasses[*pvc.Spec.StorageClassName]; ok {
+			return roleARN
+		}
+	}
+	return t.settings.AWSRoles.Namespaces[pvc.GetNamespace()]
+}
+
+type awsRoleContextKey struct{}
+
+// withAWSRole returns the ctx of the tag calls of a volume tagged with the roleARN
+func withAWSRole(ctx context.Context, roleARN string) context.Context {
+	return context.WithValue(ctx, awsRoleContextKey{}, roleARN)
+}
+
+// awsRoleFromContext returns the roleARN of withAWSRole, empty when the ctx has none
+func awsRoleFromContext(ctx context.Context) string {
+	roleARN, _ := ctx.Value(awsRoleContextKey{}).(string)
+	return roleARN
+}
+
+// awsRoleVolumeTagger tags each volume with a tagger of the IAM role of its ctx, see
+// withAWSRole. The tagger of a role is created lazily.
+type awsRoleVolumeTagger struct {
+	mu        sync.Mutex
+	newTagger func(roleARN string) (VolumeTagger, error)
+	taggers   map[string]*lazyVolumeTagger
+}
+
+func newAWSRoleVolumeTagger(newTagger func(roleARN string) (VolumeTagger, error)) *awsRoleVolumeTagger {
+	return &awsRoleVolumeTagger{newTagger: newTagger, taggers: map[string]*lazyVolumeTagger{}}
+}
+
+func (r *awsRoleVolumeTagger) tagger(ctx context.Context) *lazyVolumeTagger {
+	roleARN := awsRoleFromContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tagger, ok := r.taggers[roleARN]
+	if !ok {
+		tagger = newLazyVolumeTagger(func() (VolumeTagger, error) {
+			return r.newTagger(roleARN)
+		}, nil)
+		r.taggers[roleARN] = tagger
+	}
+	return tagger
+}
+
+func (r *awsRoleVolumeTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	return r.tagger(ctx).GetTags(ctx, volumeID)
+}
+
+func (r *awsRoleVolumeTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	return r.tagger(ctx).SetTags(ctx, volumeID, tags, storageclass)
+}
+
+func (r *awsRoleVolumeTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	return r.tagger(ctx).RemoveTags(ctx, volumeID, keys, storageclass)
+}
+
+func (r *awsRoleVolumeTagger) RemovableTags(ctx context.Context, volumeID string, keys []string) ([]string, error) {
+	return r.tagger(ctx).RemovableTags(ctx, volumeID, keys)
+}
+
+func (client *EBSClient) addEBSVolumeTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	var ec2Tags []ec2types.Tag
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags, ec2types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	// Add tags to the volume
+	_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volumeID},
+		Tags:      ec2Tags,
+	})
+	if err != nil {
+		log.Errorln("Could not create tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+func (client *EBSClient) deleteEBSVolumeTags(ctx context.Context, volumeID string, tags []string, storageclass string) error {
+	var ec2Tags []ec2types.Tag
+	for _, k := range tags {
+		ec2Tags = append(ec2Tags, ec2types.Tag{Key: aws.String(k)})
+	}
+
+	// Add tags to the volume
+	_, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{volumeID},
+		Tags:      ec2Tags,
+	})
+	if err != nil {
+		log.Errorln("Could not EBS delete tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+func (client *EFSClient) addEFSVolumeTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	var efsTags []efstypes.Tag
+	for k, v := range tags {
+		efsTags = append(efsTags, efstypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	// Add tags to the volume
+	_, err := client.TagResource(ctx, &efs.TagResourceInput{
+		ResourceId: aws.String(volumeID),
+		Tags:       efsTags,
+	})
+	if err != nil {
+		log.Errorln("Could not EFS create tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+func (client *EFSClient) deleteEFSVolumeTags(ctx context.Context, volumeID string, tags []string, storageclass string) error {
+	// Add tags to the volume
+	_, err := client.UntagResource(ctx, &efs.UntagResourceInput{
+		ResourceId: aws.String(volumeID),
+		TagKeys:    tags,
+	})
+	if err != nil {
+		log.Errorln("Could not EFS delete tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+// resourceARN returns the ARN of an FSx volume ID: a file system ID (fs-) of any
+// FSx type, an OpenZFS or ONTAP volume ID (fsvol-), or the name of an ONTAP volume.
+func (client *FSxClient) resourceARN(ctx context.Context, volumeID string) (string, error) {
+	client.arnsMu.Lock()
+	arn, ok := client.arns[volumeID]
+	client.arnsMu.Unlock()
+	if ok {
+		return arn, nil
+	}
+
+	var resourceARN *string
+	switch {
+	case strings.HasPrefix(volumeID, "fs-"):
+		output, err := client.DescribeFileSystems(ctx, &fsx.DescribeFileSystemsInput{
+			FileSystemIds: []string{volumeID},
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not describe FSx file system %s: %w", volumeID, err)
+		}
+		if len(output.FileSystems) == 0 {
+			return "", fmt.Errorf("FSx file system %s not found", volumeID)
+		}
+		resourceARN = output.FileSystems[0].ResourceARN
+	case strings.HasPrefix(volumeID, "fsvol-"):
+		output, err := client.DescribeVolumes(ctx, &fsx.DescribeVolumesInput{
+			VolumeIds: []string{volumeID},
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not describe FSx volume %s: %w", volumeID, err)
+		}
+		if len(output.Volumes) == 0 {
+			return "", fmt.Errorf("FSx volume %s not found", volumeID)
+		}
+		resourceARN = output.Volumes[0].ResourceARN
+	default:
+		// FSx can't filter the volumes by name
+		paginator := fsx.NewDescribeVolumesPaginator(client, &fsx.DescribeVolumesInput{})
+		for resourceARN == nil && paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return "", fmt.Errorf("could not describe FSx volumes: %w", err)
+			}
+			for _, volume := range page.Volumes {
+				if volume.VolumeType == fsxtypes.VolumeTypeOntap && aws.ToString(volume.Name) == volumeID {
+					resourceARN = volume.ResourceARN
+					break
+				}
+			}
+		}
+		if resourceARN == nil {
+			return "", fmt.Errorf("FSx for ONTAP volume %s not found", volumeID)
+		}
+	}
+	if aws.ToString(resourceARN) == "" {
+		return "", fmt.Errorf("FSx resource %s has no ARN", volumeID)
+	}
+
+	client.arnsMu.Lock()
+	if client.arns == nil {
+		client.arns = map[string]string{}
+	}
+	client.arns[volumeID] = *resourceARN
+	client.arnsMu.Unlock()
+	return *resourceARN, nil
+}
+
+func (client *FSxClient) addFSxVolumeTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	resourceARN, err := client.resourceARN(ctx, volumeID)
+	if err != nil {
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+	_, err = client.TagResource(ctx, &fsx.TagResourceInput{
+		ResourceARN: aws.String(resourceARN),
+		Tags:        convertTagsToFSxTags(tags),
+	})
+	if err != nil {
+		log.Errorln("Could not FSx create tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return fmt.Errorf("could not create FSx tags for volumeID %s: %w", volumeID, err)
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+func (client *FSxClient) deleteFSxVolumeTags(ctx context.Context, volumeID string, tags []string, storageclass string) error {
+	resourceARN, err := client.resourceARN(ctx, volumeID)
+	if err != nil {
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return err
+	}
+	_, err = client.UntagResource(ctx, &fsx.UntagResourceInput{
+		ResourceARN: aws.String(resourceARN),
+		TagKeys:     tags,
+	})
+	if err != nil {
+		log.Errorln("Could not FSx delete tags for volumeID:", volumeID, err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		promActionsLegacyTotal.With(prometheus.Labels{"status": "error"}).Inc()
+		return fmt.Errorf("could not delete FSx tags for volumeID %s: %w", volumeID, err)
+	}
+
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	promActionsLegacyTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	return nil
+}
+
+func (client *EBSClient) getEBSVolumeTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	tags := map[string]string{}
+	paginator := ec2.NewDescribeTagsPaginator(client, &ec2.DescribeTagsInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("resource-id"), Values: []string{volumeID}},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not describe EBS tags for volumeID %s: %w", volumeID, err)
+		}
+		for _, tag := range page.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+func (client *EFSClient) getEFSVolumeTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	tags := map[string]string{}
+	paginator := efs.NewListTagsForResourcePaginator(client, &efs.ListTagsForResourceInput{
+		ResourceId: aws.String(volumeID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list EFS tags for volumeID %s: %w", volumeID, err)
+		}
+		for _, tag := range page.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+func (client *FSxClient) getFSxVolumeTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	resourceARN, err := client.resourceARN(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	paginator := fsx.NewListTagsForResourcePaginator(client, &fsx.ListTagsForResourceInput{
+		ResourceARN: aws.String(resourceARN),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list FSx tags for volumeID %s: %w", volumeID, err)
+		}
+		for _, tag := range page.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+func (client *EBSClient) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	return client.getEBSVolumeTags(ctx, volumeID)
+}
+
+func (client *EBSClient) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	return client.addEBSVolumeTags(ctx, volumeID, tags, storageclass)
+}
+
+func (client *EBSClient) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	return client.deleteEBSVolumeTags(ctx, volumeID, keys, storageclass)
+}
+
+// resourceIDs returns the IDs of the EFS resources of the volume that are tagged
+func (client *EFSClient) resourceIDs(volumeID string) ([]string, error) {
+	fileSystemID, accessPointID, err := parseAWSEFSVolumeID(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case accessPointID == "" || client.tagMode == EFSTagFileSystem:
+		return []string{fileSystemID}, nil
+	case client.tagMode == EFSTagBoth:
+		return []string{accessPointID, fileSystemID}, nil
+	default:
+		return []string{accessPointID}, nil
+	}
+}
+
+// GetTags returns the tags set with the same value on every tagged resource of the
+// volume, so a tag missing from any of them is set again.
+func (client *EFSClient) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	resourceIDs, err := client.resourceIDs(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	var tags map[string]string
+	for _, resourceID := range resourceIDs {
+		resourceTags, err := client.getEFSVolumeTags(ctx, resourceID)
+		if err != nil {
+			return nil, err
+		}
+		if tags == nil {
+			tags = resourceTags
+			continue
+		}
+		maps.DeleteFunc(tags, func(k, v string) bool {
+			resourceValue, ok := resourceTags[k]
+			return !ok || resourceValue != v
+		})
+	}
+	return tags, nil
+}
+
+func (client *EFSClient) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	resourceIDs, err := client.resourceIDs(volumeID)
+	if err != nil {
+		return err
+	}
+	for _, resourceID := range resourceIDs {
+		if err := client.addEFSVolumeTags(ctx, resourceID, tags, storageclass); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveTags removes the tags from the tagged access point of the volume, never from its
+// file system: a file system is shared by the volumes dynamically provisioned by its storage
+// class, and often by several static volumes of its subpaths, which may still set the tags.
+func (client *EFSClient) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	resourceIDs, err := client.resourceIDs(volumeID)
+	if err != nil {
+		return err
+	}
+	fileSystemID, _, _ := parseAWSEFSVolumeID(volumeID)
+	for _, resourceID := range resourceIDs {
+		if resourceID == fileSystemID {
+			log.WithFields(log.Fields{"volumeID": volumeID, "fileSystemID": fileSystemID}).Debug("Not removing tags from the shared EFS file system")
+			continue
+		}
+		if err := client.deleteEFSVolumeTags(ctx, resourceID, keys, storageclass); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovableTags returns the keys set on the tagged access point of the volume, the
+// resource RemoveTags removes them from.
+func (client *EFSClient) RemovableTags(ctx context.Context, volumeID string, keys []string) ([]string, error) {
+	resourceIDs, err := client.resourceIDs(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	fileSystemID, _, _ := parseAWSEFSVolumeID(volumeID)
+	removableKeys := map[string]bool{}
+	for _, resourceID := range resourceIDs {
+		if resourceID == fileSystemID {
+			continue
+		}
+		resourceTags, err := client.getEFSVolumeTags(ctx, resourceID)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if _, ok := resourceTags[k]; ok {
+				removableKeys[k] = true
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(removableKeys)), nil
+}
+
+func (client *FSxClient) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	return client.getFSxVolumeTags(ctx, volumeID)
+}
+
+func (client *FSxClient) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	return client.addFSxVolumeTags(ctx, volumeID, tags, storageclass)
+}
+
+func (client *FSxClient) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	return client.deleteFSxVolumeTags(ctx, volumeID, keys, storageclass)
+}
@@ -0,0 +1,375 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/efs"
+	efstypes "github.com/aws/aws-sdk-go-v2/service/efs/types"
+	"github.com/aws/aws-sdk-go-v2/service/fsx"
+	fsxtypes "github.com/aws/aws-sdk-go-v2/service/fsx/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeEFS holds the tags of each EFS resource ID
+type fakeEFS struct {
+	tags map[string]map[string]string
+}
+
+func (f *fakeEFS) ListTagsForResource(_ context.Context, input *efs.ListTagsForResourceInput, _ ...func(*efs.Options)) (*efs.ListTagsForResourceOutput, error) {
+	var tags []efstypes.Tag
+	for k, v := range f.tags[aws.ToString(input.ResourceId)] {
+		tags = append(tags, efstypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return &efs.ListTagsForResourceOutput{Tags: tags}, nil
+}
+
+func (f *fakeEFS) TagResource(_ context.Context, input *efs.TagResourceInput, _ ...func(*efs.Options)) (*efs.TagResourceOutput, error) {
+	resourceID := aws.ToString(input.ResourceId)
+	if f.tags[resourceID] == nil {
+		f.tags[resourceID] = map[string]string{}
+	}
+	for _, tag := range input.Tags {
+		f.tags[resourceID][aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return &efs.TagResourceOutput{}, nil
+}
+
+func (f *fakeEFS) UntagResource(_ context.Context, input *efs.UntagResourceInput, _ ...func(*efs.Options)) (*efs.UntagResourceOutput, error) {
+	for _, k := range input.TagKeys {
+		delete(f.tags[aws.ToString(input.ResourceId)], k)
+	}
+	return &efs.UntagResourceOutput{}, nil
+}
+
+func Test_EFSClient_resourceIDs(t *testing.T) {
+	tests := []struct {
+		name     string
+		tagMode  string
+		volumeID string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "default mode", tagMode: "", volumeID: "fs-1234::fsap-5678", want: []string{"fsap-5678"}},
+		{name: "access point mode", tagMode: EFSTagAccessPoint, volumeID: "fs-1234::fsap-5678", want: []string{"fsap-5678"}},
+		{name: "access point mode without access point", tagMode: EFSTagAccessPoint, volumeID: "fs-1234", want: []string{"fs-1234"}},
+		{name: "file system mode", tagMode: EFSTagFileSystem, volumeID: "fs-1234::fsap-5678", want: []string{"fs-1234"}},
+		{name: "both mode", tagMode: EFSTagBoth, volumeID: "fs-1234::fsap-5678", want: []string{"fsap-5678", "fs-1234"}},
+		{name: "both mode without access point", tagMode: EFSTagBoth, volumeID: "fs-1234", want: []string{"fs-1234"}},
+		{name: "invalid volume ID", tagMode: EFSTagBoth, volumeID: "fsap-5678", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &EFSClient{tagMode: tt.tagMode}
+			got, err := client.resourceIDs(tt.volumeID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resourceIDs() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("resourceIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_EFSClient_bothMode(t *testing.T) {
+	fake := &fakeEFS{tags: map[string]map[string]string{
+		"fsap-5678": {"team": "storage", "env": "prod"},
+		"fs-1234":   {"team": "storage", "env": "dev"},
+	}}
+	client := &EFSClient{EFSAPI: fake, tagMode: EFSTagBoth}
+	ctx := context.Background()
+
+	got, err := client.GetTags(ctx, "fs-1234::fsap-5678")
+	if err != nil {
+		t.Fatalf("GetTags() err = %v", err)
+	}
+	if want := map[string]string{"team": "storage"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTags() = %v, want the tags common to both resources %v", got, want)
+	}
+
+	if err := client.SetTags(ctx, "fs-1234::fsap-5678", map[string]string{"env": "qa"}, "efs"); err != nil {
+		t.Fatalf("SetTags() err = %v", err)
+	}
+	if err := client.RemoveTags(ctx, "fs-1234::fsap-5678", []string{"team"}, "efs"); err != nil {
+		t.Fatalf("RemoveTags() err = %v", err)
+	}
+	// the file system is shared with the other volumes of the storage class
+	want := map[string]map[string]string{
+		"fsap-5678": {"env": "qa"},
+		"fs-1234":   {"team": "storage", "env": "qa"},
+	}
+	if !reflect.DeepEqual(fake.tags, want) {
+		t.Errorf("EFS tags = %v, want %v", fake.tags, want)
+	}
+}
+
+func Test_EFSClient_RemoveTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tagMode  string
+		volumeID string
+		want     map[string]map[string]string
+	}{
+		{
+			name:     "static file system",
+			tagMode:  EFSTagFileSystem,
+			volumeID: "fs-1234",
+			want:     map[string]map[string]string{"fs-1234": {"team": "storage", "env": "dev"}, "fsap-5678": {"team": "storage", "env": "dev"}},
+		},
+		{
+			name:     "static file system with path",
+			tagMode:  EFSTagBoth,
+			volumeID: "fs-1234:/data",
+			want:     map[string]map[string]string{"fs-1234": {"team": "storage", "env": "dev"}, "fsap-5678": {"team": "storage", "env": "dev"}},
+		},
+		{
+			name:     "shared file system",
+			tagMode:  EFSTagFileSystem,
+			volumeID: "fs-1234::fsap-5678",
+			want:     map[string]map[string]string{"fs-1234": {"team": "storage", "env": "dev"}, "fsap-5678": {"team": "storage", "env": "dev"}},
+		},
+		{
+			name:     "access point",
+			tagMode:  EFSTagAccessPoint,
+			volumeID: "fs-1234::fsap-5678",
+			want:     map[string]map[string]string{"fs-1234": {"team": "storage", "env": "dev"}, "fsap-5678": {"env": "dev"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeEFS{tags: map[string]map[string]string{
+				"fs-1234":   {"team": "storage", "env": "dev"},
+				"fsap-5678": {"team": "storage", "env": "dev"},
+			}}
+			client := &EFSClient{EFSAPI: fake, tagMode: tt.tagMode}
+			if err := client.RemoveTags(context.Background(), tt.volumeID, []string{"team"}, "efs"); err != nil {
+				t.Fatalf("RemoveTags() err = %v", err)
+			}
+			if !reflect.DeepEqual(fake.tags, tt.want) {
+				t.Errorf("EFS tags = %v, want %v", fake.tags, tt.want)
+			}
+		})
+	}
+}
+
+// fakeFSx has a Lustre file system, an OpenZFS volume and an ONTAP volume
+type fakeFSx struct {
+	describeCalls int
+	taggedARNs    []string
+}
+
+func (f *fakeFSx) DescribeFileSystems(_ context.Context, input *fsx.DescribeFileSystemsInput, _ ...func(*fsx.Options)) (*fsx.DescribeFileSystemsOutput, error) {
+	f.describeCalls++
+	output := &fsx.DescribeFileSystemsOutput{}
+	if input.FileSystemIds[0] == "fs-1234" {
+		output.FileSystems = []fsxtypes.FileSystem{{ResourceARN: aws.String("arn:aws:fsx:us-east-1:111122223333:file-system/fs-1234")}}
+	}
+	return output, nil
+}
+
+// DescribeVolumes returns the OpenZFS and the ONTAP volumes in two pages when
+// no volume ID is given
+func (f *fakeFSx) DescribeVolumes(_ context.Context, input *fsx.DescribeVolumesInput, _ ...func(*fsx.Options)) (*fsx.DescribeVolumesOutput, error) {
+	if len(input.VolumeIds) == 0 {
+		if input.NextToken == nil {
+			f.describeCalls++
+			return &fsx.DescribeVolumesOutput{NextToken: aws.String("page-2"), Volumes: []fsxtypes.Volume{
+				{Name: aws.String("trident_pvc_1234"), VolumeType: fsxtypes.VolumeTypeOpenzfs, ResourceARN: aws.String("arn:aws:fsx:us-east-1:111122223333:volume/fs-1234/fsvol-1111")},
+			}}, nil
+		}
+		return &fsx.DescribeVolumesOutput{Volumes: []fsxtypes.Volume{
+			{Name: aws.String("trident_pvc_1234"), VolumeType: fsxtypes.VolumeTypeOntap, ResourceARN: aws.String("arn:aws:fsx:us-east-1:111122223333:volume/fs-5678/fsvol-5678")},
+		}}, nil
+	}
+
+	f.describeCalls++
+	output := &fsx.DescribeVolumesOutput{}
+	if input.VolumeIds[0] == "fsvol-1234" {
+		output.Volumes = []fsxtypes.Volume{{ResourceARN: aws.String("arn:aws:fsx:us-east-1:111122223333:volume/fs-1234/fsvol-1234")}}
+	}
+	return output, nil
+}
+
+func (f *fakeFSx) TagResource(_ context.Context, input *fsx.TagResourceInput, _ ...func(*fsx.Options)) (*fsx.TagResourceOutput, error) {
+	f.taggedARNs = append(f.taggedARNs, aws.ToString(input.ResourceARN))
+	return &fsx.TagResourceOutput{}, nil
+}
+
+func (f *fakeFSx) UntagResource(_ context.Context, input *fsx.UntagResourceInput, _ ...func(*fsx.Options)) (*fsx.UntagResourceOutput, error) {
+	return &fsx.UntagResourceOutput{}, nil
+}
+
+func (f *fakeFSx) ListTagsForResource(_ context.Context, input *fsx.ListTagsForResourceInput, _ ...func(*fsx.Options)) (*fsx.ListTagsForResourceOutput, error) {
+	return &fsx.ListTagsForResourceOutput{}, nil
+}
+
+func Test_FSxClient_resourceARN(t *testing.T) {
+	tests := []struct {
+		name     string
+		volumeID string
+		want     string
+		wantErr  bool
+	}{
+		{name: "file system", volumeID: "fs-1234", want: "arn:aws:fsx:us-east-1:111122223333:file-system/fs-1234"},
+		{name: "volume", volumeID: "fsvol-1234", want: "arn:aws:fsx:us-east-1:111122223333:volume/fs-1234/fsvol-1234"},
+		{name: "ontap volume name", volumeID: "trident_pvc_1234", want: "arn:aws:fsx:us-east-1:111122223333:volume/fs-5678/fsvol-5678"},
+		{name: "missing file system", volumeID: "fs-5678", wantErr: true},
+		{name: "missing volume", volumeID: "fsvol-5678", wantErr: true},
+		{name: "missing ontap volume", volumeID: "trident_pvc_5678", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeFSx{}
+			client := &FSxClient{FSxAPI: fake}
+			for range 2 {
+				got, err := client.resourceARN(context.Background(), tt.volumeID)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("resourceARN() err = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got != tt.want {
+					t.Errorf("resourceARN() = %v, want %v", got, tt.want)
+				}
+			}
+			wantCalls := 1
+			if tt.wantErr {
+				wantCalls = 2
+			}
+			if fake.describeCalls != wantCalls {
+				t.Errorf("describe calls = %v, want %v", fake.describeCalls, wantCalls)
+			}
+		})
+	}
+}
+
+func Test_FSxClient_SetTags(t *testing.T) {
+	fake := &fakeFSx{}
+	client := &FSxClient{FSxAPI: fake}
+	if err := client.SetTags(context.Background(), "fsvol-1234", map[string]string{"team": "storage"}, "fsx"); err != nil {
+		t.Fatalf("SetTags() err = %v", err)
+	}
+	if want := []string{"arn:aws:fsx:us-east-1:111122223333:volume/fs-1234/fsvol-1234"}; !slices.Equal(fake.taggedARNs, want) {
+		t.Errorf("tagged ARNs = %v, want %v", fake.taggedARNs, want)
+	}
+	if err := client.SetTags(context.Background(), "fs-5678", map[string]string{"team": "storage"}, "fsx"); err == nil {
+		t.Errorf("SetTags() expected an error for a missing file system")
+	}
+}
+
+func Test_getAWSConfig(t *testing.T) {
+	tg := newTestTagger()
+	tg.awsConfig = &aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}
+	ctx := context.Background()
+
+	podConfig, err := tg.getAWSConfig(ctx, "")
+	if err != nil {
+		t.Fatalf("getAWSConfig() err = %v", err)
+	}
+	if _, ok := podConfig.Credentials.(aws.AnonymousCredentials); !ok {
+		t.Errorf("getAWSConfig() credentials = %T, want the pod credentials", podConfig.Credentials)
+	}
+
+	roleARN := "arn:aws:iam::111122223333:role/pvc-tagger"
+	roleConfig, err := tg.getAWSConfig(ctx, roleARN)
+	if err != nil {
+		t.Fatalf("getAWSConfig() err = %v", err)
+	}
+	roleCredentials, ok := roleConfig.Credentials.(*aws.CredentialsCache)
+	if !ok {
+		t.Fatalf("getAWSConfig() credentials = %T, want the cached assumed role credentials", roleConfig.Credentials)
+	}
+	if roleConfig.Region != "us-east-1" {
+		t.Errorf("getAWSConfig() region = %v, want us-east-1", roleConfig.Region)
+	}
+	if _, ok := tg.awsConfig.Credentials.(aws.AnonymousCredentials); !ok {
+		t.Errorf("getAWSConfig() changed the pod credentials to %T", tg.awsConfig.Credentials)
+	}
+
+	again, err := tg.getAWSConfig(ctx, roleARN)
+	if err != nil {
+		t.Fatalf("getAWSConfig() err = %v", err)
+	}
+	if again.Credentials != roleCredentials {
+		t.Errorf("getAWSConfig() did not reuse the credentials of the role")
+	}
+}
+
+func Test_awsRoleARN(t *testing.T) {
+	tg := newTestTagger()
+	tg.settings.AWSRoles = AWSRoles{
+		Namespaces:     map[string]string{"shared": "arn:aws:iam::111122223333:role/namespace"},
+		StorageClasses: map[string]string{"shared-gp3": "arn:aws:iam::111122223333:role/storageclass"},
+	}
+	tests := []struct {
+		name         string
+		namespace    string
+		storageClass *string
+		want         string
+	}{
+		{name: "no role", namespace: "default", storageClass: stringPtr("gp3"), want: ""},
+		{name: "namespace role", namespace: "shared", storageClass: stringPtr("gp3"), want: "arn:aws:iam::111122223333:role/namespace"},
+		{name: "storage class role", namespace: "default", storageClass: stringPtr("shared-gp3"), want: "arn:aws:iam::111122223333:role/storageclass"},
+		{name: "storage class role wins", namespace: "shared", storageClass: stringPtr("shared-gp3"), want: "arn:aws:iam::111122223333:role/storageclass"},
+		{name: "no storage class", namespace: "shared", want: "arn:aws:iam::111122223333:role/namespace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: tt.namespace},
+				Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: tt.storageClass},
+			}
+			if got := tg.awsRoleARN(pvc); got != tt.want {
+				t.Errorf("awsRoleARN() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_awsRoleVolumeTagger(t *testing.T) {
+	var created []string
+	taggers := map[string]*fakeVolumeTagger{}
+	roleTagger := newAWSRoleVolumeTagger(func(roleARN string) (VolumeTagger, error) {
+		created = append(created, roleARN)
+		taggers[roleARN] = &fakeVolumeTagger{}
+		return taggers[roleARN], nil
+	})
+
+	ctx := context.Background()
+	roleCtx := withAWSRole(ctx, "arn:aws:iam::111122223333:role/pvc-tagger")
+	for _, ctx := range []context.Context{ctx, roleCtx, roleCtx} {
+		if err := roleTagger.SetTags(ctx, "vol-1234", map[string]string{"team": "storage"}, "gp3"); err != nil {
+			t.Fatalf("SetTags() err = %v", err)
+		}
+	}
+	if want := []string{"", "arn:aws:iam::111122223333:role/pvc-tagger"}; !slices.Equal(created, want) {
+		t.Errorf("created taggers = %v, want %v", created, want)
+	}
+	if got := taggers[""].setCalls; got != 1 {
+		t.Errorf("SetTags() calls without role = %v, want 1", got)
+	}
+	if got := taggers["arn:aws:iam::111122223333:role/pvc-tagger"].setCalls; got != 2 {
+		t.Errorf("SetTags() calls with role = %v, want 2", got)
+	}
+}
@@ -0,0 +1,733 @@
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrAzureTooManyTags    error = errors.New("Only up to 50 tags can be set on an azure resource")
+	ErrAzureValueToLong    error = errors.New("A value can only contain 256 characters")
+	ErrAzureDuplicatedTags error = errors.New("There are duplicated keys after sanitization")
+)
+
+type DiskTags = map[string]*string
+type AzureSubscription = string
+
+// tridentVolumeGVR are the TridentVolumes, holding the resource ID of the Azure NetApp Files volumes
+var tridentVolumeGVR = schema.GroupVersionResource{
+	Group:    "trident.netapp.io",
+	Version:  "v1",
+	Resource: "tridentvolumes",
+}
+
+func init() {
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:    AZURE,
+		Drivers:  []string{AZURE_DISK_CSI},
+		VolumeID: azureDiskVolumeID,
+		NewTagger: func(context.Context, *Tagger) (VolumeTagger, error) {
+			// see how to get the credentials with a service account and the subscription
+			azureClient, err := NewAzureClient()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Azure client: %w", err)
+			}
+			return &azureDiskTagger{client: azureClient}, nil
+		},
+		NewSnapshotTagger: func(context.Context, *Tagger) (VolumeTagger, error) {
+			azureClient, err := newAzureSnapshotClient()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Azure client: %w", err)
+			}
+			return &azureSnapshotTagger{client: azureClient}, nil
+		},
+		SanitizeTags: sanitizeTagsForAzure,
+	})
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:    AZURE,
+		Drivers:  []string{AZURE_FILE_CSI},
+		VolumeID: azureFileBackendVolumeID,
+		NewTagger: func(context.Context, *Tagger) (VolumeTagger, error) {
+			azureClient, err := NewAzureClient()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Azure client: %w", err)
+			}
+			files := &azureFileVolumes{subscription: os.Getenv("AZURE_SUBSCRIPTION_ID")}
+			return &azureScopeTagger{client: azureClient, resourceID: files.resourceID, shared: true}, nil
+		},
+		SanitizeTags: sanitizeTagsForAzure,
+	})
+	// the Trident volumes are FSx for ONTAP volumes too, told apart by their backendType:
+	// they are registered under AZURE_NETAPP_TRIDENT
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:    AZURE,
+		Drivers:  []string{AWS_FSX_ONTAP_TRIDENT},
+		Name:     AZURE_NETAPP_TRIDENT,
+		VolumeID: azureNetAppVolumeID,
+		NewTagger: func(_ context.Context, t *Tagger) (VolumeTagger, error) {
+			if t.dynamicClient == nil {
+				return nil, errors.New("the Azure NetApp Files volumes require a dynamic client")
+			}
+			azureClient, err := NewAzureClient()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Azure client: %w", err)
+			}
+			volumes := &azureNetAppVolumes{dynamicClient: t.dynamicClient}
+			return &azureScopeTagger{client: azureClient, resourceID: volumes.resourceID}, nil
+		},
+		SanitizeTags: sanitizeTagsForAzure,
+	})
+}
+
+// azureDiskVolumeID returns the resource ID of the managed disk of an Azure Disk PV
+func azureDiskVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	return csiVolumeHandle(pv)
+}
+
+// azureFileBackendVolumeID returns the volume handle of an Azure Files PV, see azureFileVolumeID
+func azureFileBackendVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	volumeID := azureFileVolumeID(pv)
+	if volumeID == "" {
+		return "", errors.New("the PV has no Azure Files volume handle")
+	}
+	return volumeID, nil
+}
+
+// azureNetAppVolumeID returns the handle of the Trident volumes of the StorageClasses with the
+// azure-netapp-files backendType, the NetApp volume is found by the TridentVolume named after it
+func azureNetAppVolumeID(pv *corev1.PersistentVolume, storageClass *storagev1.StorageClass) (string, error) {
+	if pv.Spec.CSI == nil || tridentBackendType(storageClass) != tridentBackendAzureNetApp {
+		return "", nil
+	}
+	return pv.Spec.CSI.VolumeHandle, nil
+}
+
+type AzureClient interface {
+	GetDiskTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, diskName string) (DiskTags, error)
+	// SetDiskTags merges the tags into the tags of the disk
+	SetDiskTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, diskName string, tags DiskTags) error
+	// DeleteDiskTags deletes the tags from the tags of the disk
+	DeleteDiskTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, diskName string, tags DiskTags) error
+	// GetScopeTags returns the tags of the resource whose ID is the scope
+	GetScopeTags(ctx context.Context, scope string) (DiskTags, error)
+	// SetScopeTags merges the tags into the tags of the resource whose ID is the scope
+	SetScopeTags(ctx context.Context, scope string, tags DiskTags) error
+	// DeleteScopeTags deletes the tags from the tags of the resource whose ID is the scope
+	DeleteScopeTags(ctx context.Context, scope string, tags DiskTags) error
+}
+
+// AzureSnapshotClient reads and sets the tags of Azure managed disk snapshots
+type AzureSnapshotClient interface {
+	GetSnapshotTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, snapshotName string) (DiskTags, error)
+	SetSnapshotTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, snapshotName string, tags DiskTags) error
+	DeleteSnapshotTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, snapshotName string, tags DiskTags) error
+}
+
+type azureClient struct {
+	client *armresources.TagsClient
+}
+
+func NewAzureClient() (AzureClient, error) {
+	return newAzureTagsClient()
+}
+
+func newAzureSnapshotClient() (AzureSnapshotClient, error) {
+	return newAzureTagsClient()
+}
+
+func newAzureTagsClient() (azureClient, error) {
+	creds, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return azureClient{}, err
+	}
+	client, err := armresources.NewTagsClient("", creds, &arm.ClientOptions{})
+	if err != nil {
+		return azureClient{}, err
+	}
+
+	return azureClient{client: client}, err
+}
+
+func diskScope(subscription string, resourceGroupName string, diskName string) string {
+	return fmt.Sprintf("subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/disks/%s", subscription, resourceGroupName, diskName)
+}
+
+func snapshotScope(subscription string, resourceGroupName string, snapshotName string) string {
+	return fmt.Sprintf("subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/snapshots/%s", subscription, resourceGroupName, snapshotName)
+}
+
+func (self azureClient) GetDiskTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, diskName string) (DiskTags, error) {
+
+	tags, err := self.client.GetAtScope(ctx, diskScope(subscription, resourceGroupName, diskName), &armresources.TagsClientGetAtScopeOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get the tags for: %w", err)
+	}
+
+	return tags.Properties.Tags, nil
+}
+
+func (self azureClient) SetDiskTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, diskName string, tags DiskTags) error {
+	updatedTags, err := self.patchTags(ctx, diskScope(subscription, resourceGroupName, diskName), armresources.TagsPatchOperationMerge, tags)
+	if err != nil {
+		return fmt.Errorf("could not set the tags for: %w", err)
+	}
+	log.WithFields(log.Fields{"disk": diskName, "resource-group": resourceGroupName}).Debugf("updated disk tags to tags=%v", updatedTags)
+	return nil
+}
+
+func (self azureClient) DeleteDiskTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, diskName string, tags DiskTags) error {
+	updatedTags, err := self.patchTags(ctx, diskScope(subscription, resourceGroupName, diskName), armresources.TagsPatchOperationDelete, tags)
+	if err != nil {
+		return fmt.Errorf("could not delete the tags for: %w", err)
+	}
+	log.WithFields(log.Fields{"disk": diskName, "resource-group": resourceGroupName}).Debugf("updated disk tags to tags=%v", updatedTags)
+	return nil
+}
+
+func (self azureClient) GetScopeTags(ctx context.Context, scope string) (DiskTags, error) {
+	tags, err := self.client.GetAtScope(ctx, scope, &armresources.TagsClientGetAtScopeOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get the tags for: %w", err)
+	}
+
+	return tags.Properties.Tags, nil
+}
+
+func (self azureClient) SetScopeTags(ctx context.Context, scope string, tags DiskTags) error {
+	updatedTags, err := self.patchTags(ctx, scope, armresources.TagsPatchOperationMerge, tags)
+	if err != nil {
+		return fmt.Errorf("could not set the tags for: %w", err)
+	}
+	log.WithFields(log.Fields{"scope": scope}).Debugf("updated tags to tags=%v", updatedTags)
+	return nil
+}
+
+func (self azureClient) DeleteScopeTags(ctx context.Context, scope string, tags DiskTags) error {
+	updatedTags, err := self.patchTags(ctx, scope, armresources.TagsPatchOperationDelete, tags)
+	if err != nil {
+		return fmt.Errorf("could not delete the tags for: %w", err)
+	}
+	log.WithFields(log.Fields{"scope": scope}).Debugf("updated tags to tags=%v", updatedTags)
+	return nil
+}
+
+// patchTags merges the tags into, or deletes them from, the tags of the scope. Unlike a
+// replace, it leaves the other tags alone, which may have been set after we read them.
+func (self azureClient) patchTags(ctx context.Context, scope string, operation armresources.TagsPatchOperation, tags DiskTags) (DiskTags, error) {
+	response, err := self.client.UpdateAtScope(
+		ctx,
+		scope,
+		armresources.TagsPatchResource{
+			Operation:  to.Ptr(operation),
+			Properties: &armresources.Tags{Tags: tags},
+		}, &armresources.TagsClientUpdateAtScopeOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return response.Properties.Tags, nil
+}
+
+func (self azureClient) GetSnapshotTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, snapshotName string) (DiskTags, error) {
+	tags, err := self.client.GetAtScope(ctx, snapshotScope(subscription, resourceGroupName, snapshotName), &armresources.TagsClientGetAtScopeOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get the tags for: %w", err)
+	}
+
+	return tags.Properties.Tags, nil
+}
+
+func (self azureClient) SetSnapshotTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, snapshotName string, tags DiskTags) error {
+	updatedTags, err := self.patchTags(ctx, snapshotScope(subscription, resourceGroupName, snapshotName), armresources.TagsPatchOperationMerge, tags)
+	if err != nil {
+		return fmt.Errorf("could not set the tags for: %w", err)
+	}
+	log.WithFields(log.Fields{"snapshot": snapshotName, "resource-group": resourceGroupName}).Debugf("updated snapshot tags to tags=%v", updatedTags)
+	return nil
+}
+
+func (self azureClient) DeleteSnapshotTags(ctx context.Context, subscription AzureSubscription, resourceGroupName string, snapshotName string, tags DiskTags) error {
+	updatedTags, err := self.patchTags(ctx, snapshotScope(subscription, resourceGroupName, snapshotName), armresources.TagsPatchOperationDelete, tags)
+	if err != nil {
+		return fmt.Errorf("could not delete the tags for: %w", err)
+	}
+	log.WithFields(log.Fields{"snapshot": snapshotName, "resource-group": resourceGroupName}).Debugf("updated snapshot tags to tags=%v", updatedTags)
+	return nil
+}
+
+// azureDiskTagger tags Azure managed disks
+type azureDiskTagger struct {
+	client AzureClient
+}
+
+func (t *azureDiskTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	return getAzureVolumeTags(ctx, t.client, volumeID)
+}
+
+func (t *azureDiskTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	return UpdateAzureVolumeTags(ctx, t.client, volumeID, tags, nil, storageclass)
+}
+
+func (t *azureDiskTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	return UpdateAzureVolumeTags(ctx, t.client, volumeID, nil, keys, storageclass)
+}
+
+func (t *azureDiskTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return sanitizeTagsForAzure(tags)
+}
+
+// azureSnapshotTagger tags Azure managed disk snapshots
+type azureSnapshotTagger struct {
+	client AzureSnapshotClient
+}
+
+func (t *azureSnapshotTagger) GetTags(ctx context.Context, snapshotID string) (map[string]string, error) {
+	subscription, resourceGroup, snapshotName, err := parseAzureSnapshotID(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	existingTags, err := t.client.GetSnapshotTags(ctx, subscription, resourceGroup, snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	return diskTagsToMap(existingTags), nil
+}
+
+func (t *azureSnapshotTagger) SetTags(ctx context.Context, snapshotID string, tags map[string]string, storageclass string) error {
+	return t.updateTags(ctx, snapshotID, tags, nil, storageclass)
+}
+
+func (t *azureSnapshotTagger) RemoveTags(ctx context.Context, snapshotID string, keys []string, storageclass string) error {
+	return t.updateTags(ctx, snapshotID, nil, keys, storageclass)
+}
+
+func (t *azureSnapshotTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return sanitizeTagsForAzure(tags)
+}
+
+func (t *azureSnapshotTagger) updateTags(ctx context.Context, snapshotID string, tags map[string]string, removedTags []string, storageclass string) error {
+	sanitizedLabels, err := sanitizeLabelsForAzure(tags)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("labels to add to snapshot: %s: %v", snapshotID, sanitizedLabels)
+	subscription, resourceGroup, snapshotName, err := parseAzureSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	existingTags, err := t.client.GetSnapshotTags(ctx, subscription, resourceGroup, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	mergedTags, deletedTags := azureTagsPatch(existingTags, sanitizedLabels, removedTags)
+	if len(mergedTags) == 0 && len(deletedTags) == 0 {
+		log.Debug("labels already set on snapshot")
+		return nil
+	}
+
+	if len(mergedTags) > 0 {
+		err = t.client.SetSnapshotTags(ctx, subscription, resourceGroup, snapshotName, mergedTags)
+		if err != nil {
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return err
+		}
+	}
+	if len(deletedTags) > 0 {
+		err = t.client.DeleteSnapshotTags(ctx, subscription, resourceGroup, snapshotName, deletedTags)
+		if err != nil {
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return err
+		}
+	}
+
+	log.Debug("successfully set labels on snapshot")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// azureScopeTagger tags the Azure resource of each volume through the tags at the scope of
+// its resource ID, returned by resourceID
+type azureScopeTagger struct {
+	client     AzureClient
+	resourceID func(ctx context.Context, volumeID string) (string, error)
+	// shared is set when the resources are tagged by several volumes, which may still
+	// set the tags one of them removes: tags are never removed from them
+	shared bool
+}
+
+func (t *azureScopeTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	scope, err := t.resourceID(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	existingTags, err := t.client.GetScopeTags(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	return diskTagsToMap(existingTags), nil
+}
+
+func (t *azureScopeTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	return t.updateTags(ctx, volumeID, tags, nil, storageclass)
+}
+
+func (t *azureScopeTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	if t.shared {
+		log.WithFields(log.Fields{"volumeID": volumeID, "tags": keys}).Infoln("Not removing tags from the shared Azure resource of the volume")
+		return nil
+	}
+	return t.updateTags(ctx, volumeID, nil, keys, storageclass)
+}
+
+// RemovableTags returns no key for the shared resources, RemoveTags never changes them
+func (t *azureScopeTagger) RemovableTags(ctx context.Context, volumeID string, keys []string) ([]string, error) {
+	if t.shared {
+		return nil, nil
+	}
+	return setTagKeys(ctx, t, volumeID, keys)
+}
+
+func (t *azureScopeTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return sanitizeTagsForAzure(tags)
+}
+
+func (t *azureScopeTagger) updateTags(ctx context.Context, volumeID string, tags map[string]string, removedTags []string, storageclass string) error {
+	sanitizedLabels, err := sanitizeLabelsForAzure(tags)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("labels to add to volume: %s: %v", volumeID, sanitizedLabels)
+	scope, err := t.resourceID(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+
+	existingTags, err := t.client.GetScopeTags(ctx, scope)
+	if err != nil {
+		return err
+	}
+
+	mergedTags, deletedTags := azureTagsPatch(existingTags, sanitizedLabels, removedTags)
+	if len(mergedTags) == 0 && len(deletedTags) == 0 {
+		log.Debug("labels already set on volume")
+		return nil
+	}
+
+	if len(mergedTags) > 0 {
+		err = t.client.SetScopeTags(ctx, scope, mergedTags)
+		if err != nil {
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return err
+		}
+	}
+	if len(deletedTags) > 0 {
+		err = t.client.DeleteScopeTags(ctx, scope, deletedTags)
+		if err != nil {
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return err
+		}
+	}
+
+	log.Debug("successfully set labels on volume")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// azureFileVolumes returns the resource IDs of the Azure Files volumes. The file shares
+// don't support ARM tags, so their storage account is tagged: it can hold the shares of
+// other volumes, the tagger of the storage accounts is shared.
+type azureFileVolumes struct {
+	// subscription is used for the volume handles without a subscription
+	subscription AzureSubscription
+}
+
+// resourceID returns the ID of the storage account of the volume
+func (f *azureFileVolumes) resourceID(_ context.Context, volumeID string) (string, error) {
+	subscription, resourceGroup, account, _, err := parseAzureFileVolumeID(volumeID)
+	if err != nil {
+		return "", err
+	}
+	if subscription == "" {
+		subscription = f.subscription
+	}
+	if subscription == "" {
+		return "", fmt.Errorf("no subscription for Azure Files volume %s, set AZURE_SUBSCRIPTION_ID", volumeID)
+	}
+	return fmt.Sprintf("subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", subscription, resourceGroup, account), nil
+}
+
+// azureNetAppVolumes returns the resource IDs of the Azure NetApp Files volumes of Trident,
+// read from the internal ID of the TridentVolume named after the volume handle
+type azureNetAppVolumes struct {
+	dynamicClient dynamic.Interface
+
+	// ids caches the resource ID of each volume name
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func (n *azureNetAppVolumes) resourceID(ctx context.Context, volumeID string) (string, error) {
+	n.mu.Lock()
+	id, ok := n.ids[volumeID]
+	n.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	// the TridentVolumes are in the namespace Trident is installed in
+	list, err := n.dynamicClient.Resource(tridentVolumeGVR).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", volumeID).String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not get the TridentVolume of Azure NetApp Files volume %s: %w", volumeID, err)
+	}
+	for _, item := range list.Items {
+		if item.GetName() != volumeID {
+			continue
+		}
+		// /subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.NetApp/netAppAccounts/{account}/capacityPools/{pool}/volumes/{name}
+		internalID, _, _ := unstructured.NestedString(item.Object, "config", "internalID")
+		if !strings.Contains(strings.ToLower(internalID), "/providers/microsoft.netapp/netappaccounts/") {
+			return "", fmt.Errorf("TridentVolume %s has no Azure NetApp Files internal ID: %q", volumeID, internalID)
+		}
+		id = strings.TrimPrefix(internalID, "/")
+		break
+	}
+	if id == "" {
+		return "", fmt.Errorf("TridentVolume of Azure NetApp Files volume %s not found", volumeID)
+	}
+
+	n.mu.Lock()
+	if n.ids == nil {
+		n.ids = map[string]string{}
+	}
+	n.ids[volumeID] = id
+	n.mu.Unlock()
+	return id, nil
+}
+
+// azureFileVolumeID returns the volume handle of an Azure Files PV. A static PV whose handle is
+// only a unique ID gets a handle built from its volume attributes.
+func azureFileVolumeID(pv *corev1.PersistentVolume) string {
+	if pv.Spec.CSI == nil {
+		return ""
+	}
+	handle := pv.Spec.CSI.VolumeHandle
+	if strings.Count(handle, "#") >= 2 {
+		return handle
+	}
+	// the driver reads the attributes case-insensitively
+	attributes := map[string]string{}
+	for k, v := range pv.Spec.CSI.VolumeAttributes {
+		attributes[strings.ToLower(k)] = v
+	}
+	if attributes["storageaccount"] == "" || attributes["sharename"] == "" {
+		return handle
+	}
+	return strings.Join([]string{attributes["resourcegroup"], attributes["storageaccount"], attributes["sharename"], "", "", "", attributes["subscriptionid"]}, "#")
+}
+
+// parseAzureFileVolumeID returns the subscription, resource group, storage account and share
+// of an Azure Files volume handle:
+// {resourceGroup}#{account}#{share}#{diskName}#{uuid}#{secretNamespace}#{subscription}. The
+// fields after the share are optional.
+func parseAzureFileVolumeID(volumeID string) (subscription string, resourceGroup string, account string, share string, err error) {
+	fields := strings.Split(volumeID, "#")
+	if len(fields) < 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+		return "", "", "", "", errors.New("invalid Azure Files volume id")
+	}
+	if len(fields) > 6 {
+		subscription = fields[6]
+	}
+	return subscription, fields[0], fields[1], fields[2], nil
+}
+
+// parseAzureSnapshotID returns the subscription, resource group and name of the resource ID
+// of a snapshot: /subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/snapshots/{name}
+func parseAzureSnapshotID(snapshotID string) (subscription string, resourceGroup string, snapshotName string, err error) {
+	fields := strings.Split(snapshotID, "/")
+	if len(fields) != 9 || !strings.EqualFold(fields[7], "snapshots") {
+		return "", "", "", errors.New("invalid snapshot id")
+	}
+	return fields[2], fields[4], fields[8], nil
+}
+
+func parseAzureVolumeID(volumeID string) (subscription string, resourceGroup string, diskName string, err error) {
+	// '/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/disks/{diskname}"'
+	fields := strings.Split(volumeID, "/")
+	if len(fields) != 9 {
+		return "", "", "", errors.New("invalid volume id")
+	}
+	subscription = fields[2]
+	resourceGroup = fields[4]
+	diskName = fields[8]
+	return subscription, resourceGroup, diskName, nil
+}
+
+// sanitizeTagsForAzure returns the tags the way the Azure taggers write them
+func sanitizeTagsForAzure(tags map[string]string) (map[string]string, error) {
+	sanitizedTags, err := sanitizeLabelsForAzure(tags)
+	if err != nil {
+		return nil, err
+	}
+	return diskTagsToMap(sanitizedTags), nil
+}
+
+func sanitizeLabelsForAzure(tags map[string]string) (DiskTags, error) {
+	diskTags := make(DiskTags)
+	if len(tags) > 50 {
+		return nil, ErrAzureTooManyTags
+	}
+	for k, v := range tags {
+		sanitizedKey := sanitizeKeyForAzure(k)
+		value, err := sanitizeValueForAzure(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := diskTags[sanitizedKey]; ok {
+			return nil, fmt.Errorf("tag is duplicated after sanitization colliding tags key=%s sanitized-key=%s: %w", k, sanitizedKey, ErrAzureDuplicatedTags)
+		}
+		diskTags[sanitizedKey] = &value
+	}
+
+	return diskTags, nil
+}
+
+func sanitizeKeyForAzure(s string) string {
+	// remove forbidden characters
+	if strings.ContainsAny(s, `<>%&\?/`) {
+		for _, c := range `<>%&\?/` {
+			s = strings.ReplaceAll(s, string(c), "_")
+		}
+	}
+
+	// truncate the key the max length for azure
+	if len(s) > 512 {
+		s = s[:512]
+	}
+
+	return s
+}
+
+func sanitizeValueForAzure(s string) (string, error) {
+	// the value can contain at most 256 characters
+	if len(s) > 256 {
+		return "", fmt.Errorf("%s value is invalid: %w", s, ErrAzureValueToLong)
+	}
+	return s, nil
+}
+
+func getAzureVolumeTags(ctx context.Context, client AzureClient, volumeID string) (map[string]string, error) {
+	subscription, resourceGroup, diskName, err := parseAzureVolumeID(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	existingTags, err := client.GetDiskTags(ctx, subscription, resourceGroup, diskName)
+	if err != nil {
+		return nil, err
+	}
+
+	return diskTagsToMap(existingTags), nil
+}
+
+func diskTagsToMap(diskTags DiskTags) map[string]string {
+	tags := make(map[string]string, len(diskTags))
+	for k, v := range diskTags {
+		if v != nil {
+			tags[k] = *v
+		}
+	}
+	return tags
+}
+
+func UpdateAzureVolumeTags(ctx context.Context, client AzureClient, volumeID string, tags map[string]string, removedTags []string, storageclass string) error {
+	sanitizedLabels, err := sanitizeLabelsForAzure(tags)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("labels to add to PD volume: %s: %v", volumeID, sanitizedLabels)
+	subscription, resourceGroup, diskName, err := parseAzureVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+
+	existingTags, err := client.GetDiskTags(ctx, subscription, resourceGroup, diskName)
+	if err != nil {
+		return err
+	}
+
+	mergedTags, deletedTags := azureTagsPatch(existingTags, sanitizedLabels, removedTags)
+	if len(mergedTags) == 0 && len(deletedTags) == 0 {
+		log.Debug("labels already set on PD")
+		return nil
+	}
+
+	if len(mergedTags) > 0 {
+		err = client.SetDiskTags(ctx, subscription, resourceGroup, diskName, mergedTags)
+		if err != nil {
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return err
+		}
+	}
+	if len(deletedTags) > 0 {
+		err = client.DeleteDiskTags(ctx, subscription, resourceGroup, diskName, deletedTags)
+		if err != nil {
+			promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+			return err
+		}
+	}
+
+	log.Debug("successfully set labels on PD")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// azureTagsPatch returns the tags to merge, the new tags missing from or with another value in
+// the existing tags, and the tags to delete, the removed tags found in the existing tags. The
+// removed tags are looked up by their sanitized key, the one they were set with, and are
+// kept when a new tag has the same key. The merge and delete patches leave the tags set by
+// other writers alone.
+func azureTagsPatch(existingTags DiskTags, tags DiskTags, removedTags []string) (mergedTags DiskTags, deletedTags DiskTags) {
+	mergedTags = make(DiskTags)
+	for k, v := range tags {
+		if existing, ok := existingTags[k]; !ok || existing == nil || v == nil || *existing != *v {
+			mergedTags[k] = v
+		}
+	}
+
+	deletedTags = make(DiskTags)
+	for _, tag := range removedTags {
+		key := sanitizeKeyForAzure(tag)
+		if _, ok := tags[key]; ok {
+			continue
+		}
+		if existing, ok := existingTags[key]; ok {
+			deletedTags[key] = existing
+		}
+	}
+	return mergedTags, deletedTags
+}
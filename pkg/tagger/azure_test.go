@@ -0,0 +1,523 @@
+package tagger
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func Test_parseAzureVolumeID(t *testing.T) {
+	type args struct {
+		volumeID string
+	}
+	tests := []struct {
+		name              string
+		args              args
+		wantSubscription  string
+		wantResourceGroup string
+		wantDiskName      string
+		wantErr           bool
+	}{
+		{
+			name:              "test using a correct volume ID",
+			args:              args{volumeID: "/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/disks/{diskname}"},
+			wantSubscription:  "{subscription}",
+			wantResourceGroup: "{resourceGroup}",
+			wantDiskName:      "{diskname}",
+			wantErr:           false,
+		},
+		{
+			name:              "test using a correct volume ID",
+			args:              args{volumeID: "/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/disks"},
+			wantSubscription:  "",
+			wantResourceGroup: "",
+			wantDiskName:      "",
+			wantErr:           true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			gotSubscription, gotResourceGroup, gotDiskName, err := parseAzureVolumeID(tt.args.volumeID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAzureVolumeID() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotSubscription != tt.wantSubscription {
+				t.Errorf("parseAzureVolumeID() gotSubscription = %v, want %v", gotSubscription, tt.wantSubscription)
+			}
+			if gotResourceGroup != tt.wantResourceGroup {
+				t.Errorf("parseAzureVolumeID() gotResourceGroup = %v, want %v", gotResourceGroup, tt.wantResourceGroup)
+			}
+			if gotDiskName != tt.wantDiskName {
+				t.Errorf("parseAzureVolumeID() gotDiskName = %v, want %v", gotDiskName, tt.wantDiskName)
+			}
+		})
+	}
+}
+
+func Test_parseAzureSnapshotID(t *testing.T) {
+	tests := []struct {
+		name              string
+		snapshotID        string
+		wantSubscription  string
+		wantResourceGroup string
+		wantSnapshotName  string
+		wantErr           bool
+	}{
+		{
+			name:              "test using a correct snapshot ID",
+			snapshotID:        "/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/snapshots/{snapshotname}",
+			wantSubscription:  "{subscription}",
+			wantResourceGroup: "{resourceGroup}",
+			wantSnapshotName:  "{snapshotname}",
+		},
+		{
+			name:       "test using a disk ID",
+			snapshotID: "/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/disks/{diskname}",
+			wantErr:    true,
+		},
+		{
+			name:       "test using an incomplete snapshot ID",
+			snapshotID: "/subscriptions/{subscription}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/snapshots",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSubscription, gotResourceGroup, gotSnapshotName, err := parseAzureSnapshotID(tt.snapshotID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAzureSnapshotID() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.wantSubscription, gotSubscription)
+			assert.Equal(t, tt.wantResourceGroup, gotResourceGroup)
+			assert.Equal(t, tt.wantSnapshotName, gotSnapshotName)
+		})
+	}
+}
+
+func Test_sanitizeKeyForAzure(t *testing.T) {
+	type args struct {
+		s string
+	}
+	var tests = []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "the key should be trimmed to 512 characters",
+			args: args{
+				s: strings.Repeat("1", 513),
+			},
+			want: strings.Repeat("1", 512),
+		},
+		{
+			name: "the key should remove all invalid characters",
+			args: args{
+				s: `1<>&\?%/`,
+			},
+			want: "1_______",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := sanitizeKeyForAzure(tt.args.s); got != tt.want {
+				t.Errorf("sanitizeKeyForAzure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sanitizeValueForAzure(t *testing.T) {
+	type args struct {
+		s string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "a valid value",
+			args:    args{strings.Repeat("1", 256)},
+			want:    strings.Repeat("1", 256),
+			wantErr: false,
+		},
+
+		{
+			name:    "the max value length is 256 characters",
+			args:    args{strings.Repeat("1", 257)},
+			want:    "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := sanitizeValueForAzure(tt.args.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sanitizeValueForAzure() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeValueForAzure() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sanitizeLabelsForAzure(t *testing.T) {
+	t.Run("azure supports up to 50 labels", func(t *testing.T) {
+		t.Parallel()
+		tags := map[string]string{}
+		for x := 0; x < 50; x++ {
+			v := fmt.Sprintf("%d", x)
+			tags[v] = v
+		}
+		_, err := sanitizeLabelsForAzure(tags)
+		assert.NoError(t, err)
+
+		tags["51"] = "51"
+		_, err = sanitizeLabelsForAzure(tags)
+		assert.ErrorIs(t, err, ErrAzureTooManyTags)
+	})
+
+	t.Run("the sanitize labels gives an error when there a duplicated tags after sanitization", func(t *testing.T) {
+		t.Parallel()
+		tags := map[string]string{}
+		tags["Kubernetes/Cluster"] = "foo"
+		tags["Kubernetes_Cluster"] = "bar"
+		_, err := sanitizeLabelsForAzure(tags)
+		assert.ErrorIs(t, err, ErrAzureDuplicatedTags)
+	})
+}
+
+func Test_diskScope(t *testing.T) {
+	type args struct {
+		subscription      string
+		resourceGroupName string
+		diskName          string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			"it should generate a valid scope for disks",
+			args{
+				subscription:      "sub",
+				resourceGroupName: "resource-name",
+				diskName:          "disk-name",
+			},
+			"subscriptions/sub/resourceGroups/resource-name/providers/Microsoft.Compute/disks/disk-name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equalf(t, tt.want, diskScope(tt.args.subscription, tt.args.resourceGroupName, tt.args.diskName), "diskScope(%v, %v, %v)", tt.args.subscription, tt.args.resourceGroupName, tt.args.diskName)
+		})
+	}
+}
+
+// fakeAzureClient holds the tags of each scope
+type fakeAzureClient struct {
+	AzureClient
+	tags map[string]DiskTags
+	// afterGet is called after the tags are read, to change them like a concurrent writer
+	afterGet func()
+}
+
+func (f *fakeAzureClient) GetScopeTags(_ context.Context, scope string) (DiskTags, error) {
+	tags := maps.Clone(f.tags[scope])
+	if f.afterGet != nil {
+		f.afterGet()
+	}
+	return tags, nil
+}
+
+func (f *fakeAzureClient) SetScopeTags(_ context.Context, scope string, tags DiskTags) error {
+	if f.tags[scope] == nil {
+		f.tags[scope] = DiskTags{}
+	}
+	maps.Copy(f.tags[scope], tags)
+	return nil
+}
+
+func (f *fakeAzureClient) DeleteScopeTags(_ context.Context, scope string, tags DiskTags) error {
+	for k, v := range tags {
+		if existing, ok := f.tags[scope][k]; ok && *existing == *v {
+			delete(f.tags[scope], k)
+		}
+	}
+	return nil
+}
+
+func Test_parseAzureFileVolumeID(t *testing.T) {
+	tests := []struct {
+		name              string
+		volumeID          string
+		wantSubscription  string
+		wantResourceGroup string
+		wantAccount       string
+		wantShare         string
+		wantErr           bool
+	}{
+		{
+			name:              "dynamic volume",
+			volumeID:          "mc_rg#f5713de20cde511e8ba4900#pvc-file-dynamic-8ff5d05a#pvc-8ff5d05a#1234#default#my-subscription",
+			wantSubscription:  "my-subscription",
+			wantResourceGroup: "mc_rg",
+			wantAccount:       "f5713de20cde511e8ba4900",
+			wantShare:         "pvc-file-dynamic-8ff5d05a",
+		},
+		{
+			name:              "volume without subscription",
+			volumeID:          "mc_rg#f5713de20cde511e8ba4900#pvc-file-dynamic-8ff5d05a#",
+			wantResourceGroup: "mc_rg",
+			wantAccount:       "f5713de20cde511e8ba4900",
+			wantShare:         "pvc-file-dynamic-8ff5d05a",
+		},
+		{
+			name:     "missing share",
+			volumeID: "mc_rg#f5713de20cde511e8ba4900",
+			wantErr:  true,
+		},
+		{
+			name:     "missing resource group",
+			volumeID: "#f5713de20cde511e8ba4900#share",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subscription, resourceGroup, account, share, err := parseAzureFileVolumeID(tt.volumeID)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSubscription, subscription)
+			assert.Equal(t, tt.wantResourceGroup, resourceGroup)
+			assert.Equal(t, tt.wantAccount, account)
+			assert.Equal(t, tt.wantShare, share)
+		})
+	}
+}
+
+func Test_azureFileVolumes_resourceID(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscription string
+		volumeID     string
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:     "storage account",
+			volumeID: "rg#account#share#disk#uuid#default#sub",
+			want:     "subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account",
+		},
+		{
+			name:         "default subscription",
+			subscription: "default-sub",
+			volumeID:     "rg#account#share",
+			want:         "subscriptions/default-sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account",
+		},
+		{
+			name:     "no subscription",
+			volumeID: "rg#account#share",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := &azureFileVolumes{subscription: tt.subscription}
+			got, err := files.resourceID(context.Background(), tt.volumeID)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_azureFileVolumeID(t *testing.T) {
+	tests := []struct {
+		name   string
+		source corev1.PersistentVolumeSource
+		want   string
+	}{
+		{
+			name:   "dynamic volume",
+			source: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "rg#account#share#"}},
+			want:   "rg#account#share#",
+		},
+		{
+			name: "static volume",
+			source: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				VolumeHandle:     "unique-volumeid",
+				VolumeAttributes: map[string]string{"resourceGroup": "rg", "storageAccount": "account", "shareName": "share"},
+			}},
+			want: "rg#account#share####",
+		},
+		{
+			name:   "static volume without attributes",
+			source: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "unique-volumeid"}},
+			want:   "unique-volumeid",
+		},
+		{
+			name: "no csi volume source",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: tt.source}}
+			assert.Equal(t, tt.want, azureFileVolumeID(pv))
+		})
+	}
+}
+
+func newTestTridentVolume(name string, internalID string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "trident.netapp.io/v1",
+		"kind":       "TridentVolume",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "trident"},
+		"config":     map[string]interface{}{"name": name, "internalID": internalID},
+	}}
+}
+
+func Test_azureNetAppVolumes(t *testing.T) {
+	const volumeScope = "subscriptions/sub/resourceGroups/rg/providers/Microsoft.NetApp/netAppAccounts/account/capacityPools/pool/volumes/pvc-1234"
+	client := &fakeAzureClient{tags: map[string]DiskTags{volumeScope: {"team": to.Ptr("storage")}}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{tridentVolumeGVR: "TridentVolumeList"},
+		newTestTridentVolume("pvc-1234", "/"+volumeScope),
+		newTestTridentVolume("pvc-5678", "/svm/vserver/flexvol/trident_pvc_5678"),
+	)
+	volumes := &azureNetAppVolumes{dynamicClient: dynamicClient}
+	tagger := &azureScopeTagger{client: client, resourceID: volumes.resourceID}
+	ctx := context.Background()
+
+	tags, err := tagger.GetTags(ctx, "pvc-1234")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "storage"}, tags)
+
+	assert.NoError(t, tagger.SetTags(ctx, "pvc-1234", map[string]string{"env": "prod"}, "anf"))
+	assert.NoError(t, tagger.RemoveTags(ctx, "pvc-1234", []string{"team"}, "anf"))
+	assert.Equal(t, map[string]string{"env": "prod"}, diskTagsToMap(client.tags[volumeScope]))
+	listCalls := 0
+	for _, action := range dynamicClient.Actions() {
+		if action.GetVerb() == "list" {
+			listCalls++
+		}
+	}
+	assert.Equal(t, 1, listCalls, "the volume resource ID is cached")
+
+	_, err = tagger.GetTags(ctx, "pvc-5678")
+	assert.Error(t, err, "not an Azure NetApp Files volume")
+	_, err = tagger.GetTags(ctx, "pvc-0000")
+	assert.Error(t, err)
+}
+
+func Test_azureTagsPatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		existingTags DiskTags
+		tags         DiskTags
+		removedTags  []string
+		wantMerged   map[string]string
+		wantDeleted  map[string]string
+	}{
+		{
+			name:        "no existing tags",
+			tags:        DiskTags{"team": to.Ptr("storage")},
+			removedTags: []string{"env"},
+			wantMerged:  map[string]string{"team": "storage"},
+			wantDeleted: map[string]string{},
+		},
+		{
+			name:         "tags already set",
+			existingTags: DiskTags{"team": to.Ptr("storage"), "other": to.Ptr("tag")},
+			tags:         DiskTags{"team": to.Ptr("storage")},
+			removedTags:  []string{"env"},
+			wantMerged:   map[string]string{},
+			wantDeleted:  map[string]string{},
+		},
+		{
+			name:         "changed and removed tags",
+			existingTags: DiskTags{"team": to.Ptr("storage"), "env": to.Ptr("dev"), "other": to.Ptr("tag")},
+			tags:         DiskTags{"team": to.Ptr("storage"), "env": to.Ptr("prod")},
+			removedTags:  []string{"other"},
+			wantMerged:   map[string]string{"env": "prod"},
+			wantDeleted:  map[string]string{"other": "tag"},
+		},
+		{
+			name:         "removed tag with sanitized key",
+			existingTags: DiskTags{"team_app": to.Ptr("storage"), "other": to.Ptr("tag")},
+			tags:         DiskTags{},
+			removedTags:  []string{"team/app"},
+			wantMerged:   map[string]string{},
+			wantDeleted:  map[string]string{"team_app": "storage"},
+		},
+		{
+			name:         "removed tag sanitized to a new tag",
+			existingTags: DiskTags{"team_app": to.Ptr("storage")},
+			tags:         DiskTags{"team_app": to.Ptr("storage")},
+			removedTags:  []string{"team/app"},
+			wantMerged:   map[string]string{},
+			wantDeleted:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, deleted := azureTagsPatch(tt.existingTags, tt.tags, tt.removedTags)
+			assert.Equal(t, tt.wantMerged, diskTagsToMap(merged))
+			assert.Equal(t, tt.wantDeleted, diskTagsToMap(deleted))
+		})
+	}
+}
+
+func Test_azureScopeTagger_concurrentWriter(t *testing.T) {
+	const scope = "subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account"
+	client := &fakeAzureClient{tags: map[string]DiskTags{scope: {"team": to.Ptr("storage"), "env": to.Ptr("dev")}}}
+	// a policy adds a tag between the read and the write of the tagger
+	client.afterGet = func() {
+		client.tags[scope]["cost-center"] = to.Ptr("1234")
+	}
+	tagger := &azureScopeTagger{client: client, resourceID: func(context.Context, string) (string, error) { return scope, nil }}
+	ctx := context.Background()
+
+	assert.NoError(t, tagger.SetTags(ctx, "rg#account#share", map[string]string{"env": "prod"}, "azurefile"))
+	assert.NoError(t, tagger.RemoveTags(ctx, "rg#account#share", []string{"team"}, "azurefile"))
+	assert.Equal(t, map[string]string{"env": "prod", "cost-center": "1234"}, diskTagsToMap(client.tags[scope]))
+}
+
+func Test_azureScopeTagger_shared(t *testing.T) {
+	const scope = "subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account"
+	client := &fakeAzureClient{tags: map[string]DiskTags{scope: {"team": to.Ptr("storage"), "env": to.Ptr("dev")}}}
+	files := &azureFileVolumes{subscription: "sub"}
+	tagger := &azureScopeTagger{client: client, resourceID: files.resourceID, shared: true}
+	ctx := context.Background()
+
+	// the storage account holds the shares of other volumes still setting the tags
+	assert.NoError(t, tagger.SetTags(ctx, "rg#account#share", map[string]string{"env": "prod"}, "azurefile"))
+	assert.NoError(t, tagger.RemoveTags(ctx, "rg#account#share", []string{"team"}, "azurefile"))
+	assert.Equal(t, map[string]string{"team": "storage", "env": "prod"}, diskTagsToMap(client.tags[scope]))
+}
@@ -0,0 +1,281 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	backfillTagged   = "tagged"
+	backfillPlanned  = "planned"
+	backfillInSync   = "in-sync"
+	backfillIgnored  = "ignored"
+	backfillSkipped  = "skipped"
+	backfillFailed   = "failed"
+	backfillPageSize = 500
+)
+
+// BackfillOptions select the PVCs of Backfill
+type BackfillOptions struct {
+	// Namespaces are the namespaces of the PVCs, all namespaces when empty
+	Namespaces []string
+	// StorageClasses are the storage classes of the PVCs, all storage classes when empty
+	StorageClasses []string
+	// Selector is the label selector of the PVCs
+	Selector string
+	// Concurrency is how many volumes are tagged at the same time
+	Concurrency int
+}
+
+// backfillResult is the outcome of backfilling the volume of one PVC
+type backfillResult struct {
+	namespace    string
+	name         string
+	storageclass string
+	volumeID     string
+	status       string
+	detail       string
+}
+
+// Backfill tags the volumes of every existing PVC selected by opts once, and prints
+// a summary of the results to w. It returns an error if any of the volumes failed.
+func (t *Tagger) Backfill(ctx context.Context, opts BackfillOptions, w io.Writer) error {
+	if opts.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if _, err := labels.Parse(opts.Selector); err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+
+	sharedInformers, err := t.startClusterInformers(ctx)
+	if err != nil {
+		return err
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), sharedInformers.hasSynced()...) {
+		return errors.New("timed out waiting for the informers to sync")
+	}
+
+	pvcs, err := listBackfillPersistentVolumeClaims(ctx, t.client, opts)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"pvcs": len(pvcs), "dryRun": t.dryRun}).Infoln("Backfilling volume tags")
+
+	results := t.backfillPersistentVolumeClaims(ctx, pvcs, sharedInformers.pv.Lister(), t.newVolumeTaggers(ctx), opts.Concurrency)
+	printBackfillSummary(w, results)
+
+	var failed int
+	for _, result := range results {
+		if result.status == backfillFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d PVCs failed", failed, len(results))
+	}
+	return nil
+}
+
+// listBackfillPersistentVolumeClaims lists the PVCs of the namespaces, selector and storage classes of opts
+func listBackfillPersistentVolumeClaims(ctx context.Context, client kubernetes.Interface, opts BackfillOptions) ([]*corev1.PersistentVolumeClaim, error) {
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var pvcs []*corev1.PersistentVolumeClaim
+	for _, namespace := range namespaces {
+		listOptions := metav1.ListOptions{LabelSelector: opts.Selector, Limit: backfillPageSize}
+		for {
+			list, err := client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, listOptions)
+			if err != nil {
+				return nil, fmt.Errorf("cannot list PVCs: %w", err)
+			}
+			for i := range list.Items {
+				pvc := &list.Items[i]
+				if len(opts.StorageClasses) > 0 {
+					if pvc.Spec.StorageClassName == nil || !slices.Contains(opts.StorageClasses, *pvc.Spec.StorageClassName) {
+						continue
+					}
+				}
+				pvcs = append(pvcs, pvc)
+			}
+			if list.Continue == "" {
+				break
+			}
+			listOptions.Continue = list.Continue
+		}
+	}
+	return pvcs, nil
+}
+
+// backfillPersistentVolumeClaims backfills the volumes of the PVCs with at most concurrency
+// at the same time. The results are in the order of the PVCs.
+func (t *Tagger) backfillPersistentVolumeClaims(ctx context.Context, pvcs []*corev1.PersistentVolumeClaim, pvLister corelisters.PersistentVolumeLister, taggers volumeTaggers, concurrency int) []backfillResult {
+	results := make([]backfillResult, len(pvcs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(concurrency, len(pvcs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = t.backfillPersistentVolumeClaim(ctx, pvcs[i], pvLister, taggers)
+			}
+		}()
+	}
+	for i := range pvcs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// backfillPersistentVolumeClaim applies the tags of the PVC that are missing or have drifted
+// on its cloud volume. In dry-run mode the taggers only record them. The tag keys are added
+// to the managed tags of the PV; backfill never removes tags.
+func (t *Tagger) backfillPersistentVolumeClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim, pvLister corelisters.PersistentVolumeLister, taggers volumeTaggers) backfillResult {
+	pvc = getPVC(pvc)
+	// a PVC bound to a pre-provisioned PV can have no storage class
+	if pvc.Spec.StorageClassName == nil {
+		storageClassName := ""
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+	result := backfillResult{namespace: pvc.GetNamespace(), name: pvc.GetName(), storageclass: *pvc.Spec.StorageClassName}
+
+	if pvc.Spec.VolumeName == "" {
+		result.status, result.detail = backfillSkipped, "PersistentVolume not created yet"
+		return result
+	}
+	if pvc.GetDeletionTimestamp() != nil {
+		result.status, result.detail = backfillSkipped, "PersistentVolumeClaim is being deleted"
+		return result
+	}
+
+	// The settings are only read under the settingsLock, which is never held during the
+	// cloud and Kubernetes API calls.
+	t.settingsLock.RLock()
+	volumeID, tags, provisionedBy, err := t.processPersistentVolumeClaim(pvc, pvLister)
+	awsRoleARN := t.awsRoleARN(pvc)
+	managedTagsAnnotation := t.managedTagsAnnotation()
+	var managedTags sets.Set[string]
+	pv, pvErr := pvLister.Get(pvc.Spec.VolumeName)
+	if pvErr == nil {
+		managedTags = t.managedTagKeys(pv)
+	}
+	t.settingsLock.RUnlock()
+	if err != nil {
+		result.status, result.detail = backfillFailed, err.Error()
+		return result
+	}
+	// processPersistentVolumeClaim returns no volume for an ignored PVC
+	if volumeID == "" {
+		result.status = backfillIgnored
+		return result
+	}
+	result.volumeID = volumeID
+	tagger, ok := taggers.get(provisionedBy)
+	if !ok {
+		result.status, result.detail = backfillSkipped, "no volume tagger for "+provisionedBy
+		return result
+	}
+	if len(tags) == 0 {
+		result.status, result.detail = backfillInSync, "no tags"
+		return result
+	}
+	ctx = withAWSRole(ctx, awsRoleARN)
+
+	currentTags, err := tagger.GetTags(ctx, volumeID)
+	if err != nil {
+		result.status, result.detail = backfillFailed, fmt.Sprintf("cannot get volume tags: %s", err)
+		return result
+	}
+	desiredTags := tags
+	if sanitizer, ok := tagger.(tagSanitizer); ok {
+		desiredTags, err = sanitizer.SanitizeTags(tags)
+		if err != nil {
+			result.status, result.detail = backfillFailed, fmt.Sprintf("invalid volume tags: %s", err)
+			return result
+		}
+	}
+	result.status = backfillInSync
+	driftedTags := diffTags(currentTags, desiredTags)
+	if len(driftedTags) > 0 {
+		result.detail = strings.Join(slices.Sorted(maps.Keys(driftedTags)), ",")
+		if err := tagger.SetTags(ctx, volumeID, driftedTags, result.storageclass); err != nil {
+			result.status, result.detail = backfillFailed, err.Error()
+			return result
+		}
+		result.status = backfillTagged
+		if t.dryRun {
+			result.status = backfillPlanned
+		}
+	}
+
+	if pvErr != nil {
+		result.status, result.detail = backfillFailed, pvErr.Error()
+		return result
+	}
+	if err := t.recordManagedTags(ctx, pv, managedTagsAnnotation, managedTags, managedTags.Union(sets.KeySet(tags))); err != nil {
+		result.status, result.detail = backfillFailed, err.Error()
+	}
+	return result
+}
+
+// printBackfillSummary writes a table of the results followed by the number of PVCs of each status
+func printBackfillSummary(w io.Writer, results []backfillResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tPVC\tSTORAGECLASS\tVOLUME\tSTATUS\tDETAIL")
+	counts := map[string]int{}
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", result.namespace, result.name, result.storageclass, result.volumeID, result.status, result.detail)
+		counts[result.status]++
+	}
+	if err := tw.Flush(); err != nil {
+		log.Errorln("Cannot write backfill summary:", err)
+		return
+	}
+
+	total := []string{fmt.Sprintf("%d PVCs", len(results))}
+	for _, status := range []string{backfillTagged, backfillPlanned, backfillInSync, backfillIgnored, backfillSkipped, backfillFailed} {
+		if counts[status] > 0 {
+			total = append(total, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	fmt.Fprintf(w, "\nTotal: %s\n", strings.Join(total, ", "))
+}
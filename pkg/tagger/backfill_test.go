@@ -0,0 +1,350 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestBackfillPVC(name string, volumeName string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "my-namespace",
+			Annotations: annotations,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       volumeName,
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+}
+
+func Test_backfillPersistentVolumeClaim(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "vol-1234"},
+			},
+		},
+	}
+	ebsAnnotations := map[string]string{
+		DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\", \"env\": \"prod\"}",
+		"volume.kubernetes.io/storage-provisioner": AWS_EBS_CSI,
+	}
+
+	tests := []struct {
+		name        string
+		pvc         *corev1.PersistentVolumeClaim
+		volumeTags  map[string]string
+		setErr      error
+		dryRun      bool
+		wantStatus  string
+		wantDetail  string
+		wantSetTags map[string]string
+		// the managed tags recorded on the PV
+		wantManagedTags string
+	}{
+		{
+			name:            "missing and drifted tags applied",
+			pvc:             newTestBackfillPVC("my-pvc", "pvc-1234", ebsAnnotations),
+			volumeTags:      map[string]string{"foo": "bar", "env": "dev"},
+			wantStatus:      backfillTagged,
+			wantDetail:      "env",
+			wantSetTags:     map[string]string{"foo": "bar", "env": "prod"},
+			wantManagedTags: "[\"env\",\"foo\"]",
+		},
+		{
+			name:        "dry run",
+			pvc:         newTestBackfillPVC("my-pvc", "pvc-1234", ebsAnnotations),
+			volumeTags:  map[string]string{"foo": "bar"},
+			dryRun:      true,
+			wantStatus:  backfillPlanned,
+			wantDetail:  "env",
+			wantSetTags: map[string]string{"foo": "bar", "env": "prod"},
+		},
+		{
+			name:            "tags in sync",
+			pvc:             newTestBackfillPVC("my-pvc", "pvc-1234", ebsAnnotations),
+			volumeTags:      map[string]string{"foo": "bar", "env": "prod"},
+			wantStatus:      backfillInSync,
+			wantSetTags:     map[string]string{"foo": "bar", "env": "prod"},
+			wantManagedTags: "[\"env\",\"foo\"]",
+		},
+		{
+			name:        "failed tag call",
+			pvc:         newTestBackfillPVC("my-pvc", "pvc-1234", ebsAnnotations),
+			setErr:      errors.New("throttled"),
+			wantStatus:  backfillFailed,
+			wantDetail:  "throttled",
+			wantSetTags: map[string]string{},
+		},
+		{
+			name:        "unbound PVC",
+			pvc:         newTestBackfillPVC("my-pvc", "", ebsAnnotations),
+			wantStatus:  backfillSkipped,
+			wantDetail:  "PersistentVolume not created yet",
+			wantSetTags: map[string]string{},
+		},
+		{
+			name: "ignored PVC",
+			pvc: newTestBackfillPVC("my-pvc", "pvc-1234", map[string]string{
+				DefaultAnnotationPrefix + "/ignore":        "",
+				"volume.kubernetes.io/storage-provisioner": AWS_EBS_CSI,
+			}),
+			wantStatus:  backfillIgnored,
+			wantSetTags: map[string]string{},
+		},
+		{
+			name: "ignored PVC without storage class",
+			pvc: func() *corev1.PersistentVolumeClaim {
+				pvc := newTestBackfillPVC("my-pvc", "pvc-1234", map[string]string{
+					DefaultAnnotationPrefix + "/ignore":        "",
+					"volume.kubernetes.io/storage-provisioner": AWS_EBS_CSI,
+				})
+				pvc.Spec.StorageClassName = nil
+				return pvc
+			}(),
+			wantStatus:  backfillIgnored,
+			wantSetTags: map[string]string{},
+		},
+		{
+			name: "no tagger for the provisioner",
+			pvc: newTestBackfillPVC("my-pvc", "pvc-1234", map[string]string{
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
+				"volume.kubernetes.io/storage-provisioner": AZURE_DISK_CSI,
+			}),
+			wantStatus:  backfillSkipped,
+			wantDetail:  "no volume tagger for " + AZURE_DISK_CSI,
+			wantSetTags: map[string]string{},
+		},
+		{
+			name:        "missing PV",
+			pvc:         newTestBackfillPVC("my-pvc", "pvc-missing", ebsAnnotations),
+			wantStatus:  backfillFailed,
+			wantDetail:  "persistentvolume \"pvc-missing\" not found",
+			wantSetTags: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumeTagger := &fakeVolumeTagger{tags: map[string]string{}, setErr: tt.setErr}
+			for k, v := range tt.volumeTags {
+				volumeTagger.tags[k] = v
+			}
+			var tagger VolumeTagger = volumeTagger
+			if tt.dryRun {
+				tagger = &dryRunVolumeTagger{tagger: volumeTagger}
+			}
+			client := fake.NewClientset(pv.DeepCopy())
+			tg := newTestTagger()
+			tg.client = client
+			tg.dryRun = tt.dryRun
+
+			storageclass := storageClassName(tt.pvc)
+			ignoredBefore := testutil.ToFloat64(promIgnoredTotal.WithLabelValues(storageclass))
+			got := tg.backfillPersistentVolumeClaim(context.Background(), tt.pvc, newTestPVLister(t, pv), volumeTaggers{AWS_EBS_CSI: tagger})
+			if got.status != tt.wantStatus {
+				t.Errorf("backfillPersistentVolumeClaim() status = %v, want %v", got.status, tt.wantStatus)
+			}
+			if got.detail != tt.wantDetail {
+				t.Errorf("backfillPersistentVolumeClaim() detail = %q, want %q", got.detail, tt.wantDetail)
+			}
+			wantIgnored := 0.0
+			if tt.wantStatus == backfillIgnored {
+				wantIgnored = 1
+			}
+			if got := testutil.ToFloat64(promIgnoredTotal.WithLabelValues(storageclass)) - ignoredBefore; got != wantIgnored {
+				t.Errorf("ignored PVCs metric = %v, want %v", got, wantIgnored)
+			}
+			if tt.dryRun && volumeTagger.setCalls != 0 {
+				t.Errorf("SetTags() calls = %v in dry run, want 0", volumeTagger.setCalls)
+			}
+			if !tt.dryRun && !reflect.DeepEqual(volumeTagger.tags, tt.wantSetTags) {
+				t.Errorf("volume tags = %v, want %v", volumeTagger.tags, tt.wantSetTags)
+			}
+			gotPV, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pv.GetName(), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := gotPV.GetAnnotations()[DefaultAnnotationPrefix+"/managed-tags"]; got != tt.wantManagedTags {
+				t.Errorf("managed tags annotation = %v, want %v", got, tt.wantManagedTags)
+			}
+		})
+	}
+}
+
+func Test_backfillPersistentVolumeClaims(t *testing.T) {
+	var pvcs []*corev1.PersistentVolumeClaim
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		pvcs = append(pvcs, newTestBackfillPVC(name, "", nil))
+	}
+
+	for _, concurrency := range []int{1, 2, 10} {
+		results := newTestTagger().backfillPersistentVolumeClaims(context.Background(), pvcs, newTestPVLister(t), volumeTaggers{}, concurrency)
+		var got []string
+		for _, result := range results {
+			got = append(got, result.name)
+		}
+		if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("backfillPersistentVolumeClaims(concurrency %d) = %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+// Test_backfillPersistentVolumeClaims_settingsChange backfills while the settings are
+// reloaded, go test -race reports the settings read without the settingsLock.
+func Test_backfillPersistentVolumeClaims_settingsChange(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "vol-1234"},
+			},
+		},
+	}
+	pvc := newTestBackfillPVC("my-pvc", "pvc-1234", map[string]string{
+		DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
+		"volume.kubernetes.io/storage-provisioner": AWS_EBS_CSI,
+	})
+	tg := newTestTagger()
+	tg.client = fake.NewClientset(pv)
+	pvLister := newTestPVLister(t, pv)
+	volumeTagger := &fakeVolumeTagger{}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := newTestSettings()
+			s.DefaultTags = map[string]string{"revision": strconv.Itoa(i)}
+			s.AWSRoles.Namespaces = map[string]string{"my-namespace": "arn:aws:iam::123456789012:role/tagger-" + strconv.Itoa(i)}
+			if err := tg.UpdateSettings(s); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for range 100 {
+		results := tg.backfillPersistentVolumeClaims(context.Background(), []*corev1.PersistentVolumeClaim{pvc}, pvLister, volumeTaggers{AWS_EBS_CSI: volumeTagger}, 1)
+		if results[0].status == backfillFailed {
+			t.Errorf("backfillPersistentVolumeClaims() failed: %s", results[0].detail)
+			break
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func Test_listBackfillPersistentVolumeClaims(t *testing.T) {
+	otherStorageClass := "other"
+	newPVC := func(namespace, name string, storageClass *string, labels map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: storageClass},
+		}
+	}
+	client := fake.NewClientset(
+		newPVC("ns1", "db", &dummyStorageClassName, map[string]string{"app": "db"}),
+		newPVC("ns1", "cache", &otherStorageClass, map[string]string{"app": "cache"}),
+		newPVC("ns2", "db", &dummyStorageClassName, map[string]string{"app": "db"}),
+		newPVC("ns3", "no-class", nil, nil),
+	)
+
+	tests := []struct {
+		name string
+		opts BackfillOptions
+		want []string
+	}{
+		{
+			name: "all PVCs",
+			want: []string{"ns1/cache", "ns1/db", "ns2/db", "ns3/no-class"},
+		},
+		{
+			name: "namespaces",
+			opts: BackfillOptions{Namespaces: []string{"ns2", "ns3"}},
+			want: []string{"ns2/db", "ns3/no-class"},
+		},
+		{
+			name: "storage class",
+			opts: BackfillOptions{StorageClasses: []string{dummyStorageClassName}},
+			want: []string{"ns1/db", "ns2/db"},
+		},
+		{
+			name: "label selector",
+			opts: BackfillOptions{Namespaces: []string{"ns1"}, Selector: "app=cache"},
+			want: []string{"ns1/cache"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvcs, err := listBackfillPersistentVolumeClaims(context.Background(), client, tt.opts)
+			if err != nil {
+				t.Fatalf("listBackfillPersistentVolumeClaims() error = %v", err)
+			}
+			var got []string
+			for _, pvc := range pvcs {
+				got = append(got, pvc.GetNamespace()+"/"+pvc.GetName())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listBackfillPersistentVolumeClaims() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_printBackfillSummary(t *testing.T) {
+	var b bytes.Buffer
+	printBackfillSummary(&b, []backfillResult{
+		{namespace: "ns1", name: "db", storageclass: "gp3", volumeID: "vol-1", status: backfillTagged, detail: "env,team"},
+		{namespace: "ns1", name: "cache", storageclass: "gp3", volumeID: "vol-2", status: backfillInSync},
+		{namespace: "ns2", name: "logs", storageclass: "gp3", volumeID: "vol-3", status: backfillFailed, detail: "throttled"},
+	})
+
+	want := strings.Join([]string{
+		"NAMESPACE  PVC    STORAGECLASS  VOLUME  STATUS   DETAIL",
+		"ns1        db     gp3           vol-1   tagged   env,team",
+		"ns1        cache  gp3           vol-2   in-sync  ",
+		"ns2        logs   gp3           vol-3   failed   throttled",
+		"",
+		"Total: 3 PVCs, 1 tagged, 1 in-sync, 1 failed",
+		"",
+	}, "\n")
+	if got := b.String(); got != want {
+		t.Errorf("printBackfillSummary() =\n%s\nwant\n%s", got, want)
+	}
+}
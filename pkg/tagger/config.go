@@ -0,0 +1,277 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// Settings are the tag settings of a Tagger, they can be changed at runtime
+type Settings struct {
+	// DefaultTags are set on every volume
+	DefaultTags map[string]string
+	// TagFormat is the format of the tags annotations, json or csv
+	TagFormat string
+	// AllowAllTags allows the restricted tags, like the kubernetes.io ones, to be set
+	AllowAllTags bool
+	// AnnotationPrefix is the prefix of the annotations, see DefaultAnnotationPrefix
+	AnnotationPrefix string
+	// CopyLabels are the PVC labels copied to the tags, "*" for all of them
+	CopyLabels []string
+	// CopyAnnotations are the PVC annotations copied to the tags
+	CopyAnnotations []string
+	// CopyNamespaceLabels are the Namespace labels copied to the tags of its PVCs, "*" for all of them
+	CopyNamespaceLabels []string
+	// AWSRoles are the IAM roles assumed to tag the AWS volumes of some PVCs
+	AWSRoles AWSRoles
+}
+
+// AWSRoles map the namespaces and the StorageClasses of the PVCs to the ARN of the IAM
+// role assumed to tag their AWS volumes, e.g. when they live in another account. The role
+// of the StorageClass wins over the one of the namespace. The volumes of the other PVCs
+// are tagged with the pod credentials.
+type AWSRoles struct {
+	Namespaces     map[string]string `json:"namespaces,omitempty"`
+	StorageClasses map[string]string `json:"storageClasses,omitempty"`
+}
+
+// fileSettings are the settings of the config file, the unset ones keep their value
+type fileSettings struct {
+	DefaultTags         map[string]string `json:"defaultTags,omitempty"`
+	TagFormat           string            `json:"tagFormat,omitempty"`
+	AllowAllTags        *bool             `json:"allowAllTags,omitempty"`
+	AnnotationPrefix    string            `json:"annotationPrefix,omitempty"`
+	CopyLabels          []string          `json:"copyLabels,omitempty"`
+	CopyAnnotations     []string          `json:"copyAnnotations,omitempty"`
+	CopyNamespaceLabels []string          `json:"copyNamespaceLabels,omitempty"`
+	AWSRoles            *AWSRoles         `json:"awsRoles,omitempty"`
+}
+
+// ParseDefaultTags parses default tags in the tag format
+func ParseDefaultTags(value string, format string) (map[string]string, error) {
+	tags := map[string]string{}
+	if value == "" {
+		return tags, nil
+	}
+	if format == "csv" {
+		tags, _ = parseCsv(value)
+		return tags, nil
+	}
+	if err := json.Unmarshal([]byte(value), &tags); err != nil {
+		return nil, fmt.Errorf("default-tags are not valid json key/value pairs: %w", err)
+	}
+	return tags, nil
+}
+
+// merge returns the settings with the ones of override that are set
+func (s Settings) merge(override fileSettings) Settings {
+	if override.DefaultTags != nil {
+		s.DefaultTags = override.DefaultTags
+	}
+	if override.TagFormat != "" {
+		s.TagFormat = override.TagFormat
+	}
+	if override.AllowAllTags != nil {
+		s.AllowAllTags = *override.AllowAllTags
+	}
+	if override.AnnotationPrefix != "" {
+		s.AnnotationPrefix = override.AnnotationPrefix
+	}
+	if override.CopyLabels != nil {
+		s.CopyLabels = override.CopyLabels
+	}
+	if override.CopyAnnotations != nil {
+		s.CopyAnnotations = override.CopyAnnotations
+	}
+	if override.CopyNamespaceLabels != nil {
+		s.CopyNamespaceLabels = override.CopyNamespaceLabels
+	}
+	if override.AWSRoles != nil {
+		s.AWSRoles = *override.AWSRoles
+	}
+	return s
+}
+
+// validate returns all the invalid settings
+func (s Settings) validate() error {
+	var errs []error
+	if s.TagFormat != "json" && s.TagFormat != "csv" {
+		errs = append(errs, fmt.Errorf("tagFormat %q must be json or csv", s.TagFormat))
+	}
+	for _, msg := range validation.IsQualifiedName(s.AnnotationPrefix + "/tags") {
+		errs = append(errs, fmt.Errorf("annotationPrefix %q is invalid: %s", s.AnnotationPrefix, msg))
+	}
+	for k := range s.DefaultTags {
+		if strings.TrimSpace(k) == "" {
+			errs = append(errs, errors.New("defaultTags cannot have an empty key"))
+		}
+	}
+	if slices.Contains(s.CopyLabels, "*") && len(s.CopyLabels) > 1 {
+		errs = append(errs, errors.New("copyLabels cannot have other labels with '*'"))
+	}
+	if slices.Contains(s.CopyAnnotations, "*") {
+		errs = append(errs, errors.New("copyAnnotations doesn't support '*'"))
+	}
+	if slices.Contains(s.CopyNamespaceLabels, "*") && len(s.CopyNamespaceLabels) > 1 {
+		errs = append(errs, errors.New("copyNamespaceLabels cannot have other labels with '*'"))
+	}
+	for name, keys := range map[string][]string{"copyLabels": s.CopyLabels, "copyAnnotations": s.CopyAnnotations, "copyNamespaceLabels": s.CopyNamespaceLabels} {
+		if slices.Contains(keys, "") {
+			errs = append(errs, fmt.Errorf("%s cannot have an empty key", name))
+		}
+	}
+	roleARN := regexp.MustCompile(regexpAWSRoleARN)
+	for name, roles := range map[string]map[string]string{"awsRoles.namespaces": s.AWSRoles.Namespaces, "awsRoles.storageClasses": s.AWSRoles.StorageClasses} {
+		for k, v := range roles {
+			if !roleARN.MatchString(v) {
+				errs = append(errs, fmt.Errorf("%s %q has an invalid IAM role ARN %q", name, k, v))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfigFile returns the base settings overridden by the ones of the YAML config
+// file data. Unknown settings are an error.
+func LoadConfigFile(base Settings, data []byte) (Settings, error) {
+	var override fileSettings
+	if err := yaml.UnmarshalStrict(data, &override); err != nil {
+		return Settings{}, fmt.Errorf("invalid config file: %w", err)
+	}
+	s := base.merge(override)
+	if err := s.validate(); err != nil {
+		return Settings{}, fmt.Errorf("invalid config file: %w", err)
+	}
+	return s, nil
+}
+
+// WatchConfigFile reads the config file every period until the ctx is done. data is the
+// content of the file the current settings were loaded from. A changed file is validated
+// and applied over the base settings at once, an invalid one or one changing the
+// annotationPrefix is logged and the current settings are kept.
+func (t *Tagger) WatchConfigFile(ctx context.Context, path string, period time.Duration, base Settings, data []byte) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		newData, err := os.ReadFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{"path": path}).Errorln("Cannot read config file:", err)
+			promConfigReloadsTotal.With(prometheus.Labels{"status": "error"}).Inc()
+			continue
+		}
+		if bytes.Equal(newData, data) {
+			continue
+		}
+		data = newData
+
+		s, err := LoadConfigFile(base, data)
+		if err != nil {
+			log.WithFields(log.Fields{"path": path}).Errorln("Not reloading the config, keeping the current one:", err)
+			promConfigReloadsTotal.With(prometheus.Labels{"status": "error"}).Inc()
+			continue
+		}
+		if !reflect.DeepEqual(s, t.Settings()) {
+			log.WithFields(log.Fields{"path": path}).Infoln("Config file changed")
+			if err := t.UpdateSettings(s); err != nil {
+				log.WithFields(log.Fields{"path": path}).Errorln("Not reloading the config, keeping the current one:", err)
+				promConfigReloadsTotal.With(prometheus.Labels{"status": "error"}).Inc()
+				continue
+			}
+		}
+		promConfigReloadsTotal.With(prometheus.Labels{"status": "success"}).Inc()
+	}
+}
+
+// subscribeSettingsChanges returns a channel receiving a value after the settings changed,
+// until the ctx is done. Changes made while the previous one wasn't received are merged.
+func (t *Tagger) subscribeSettingsChanges(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	t.subscribers.Lock()
+	t.subscribers.chans = append(t.subscribers.chans, ch)
+	t.subscribers.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.subscribers.Lock()
+		t.subscribers.chans = slices.DeleteFunc(t.subscribers.chans, func(c chan struct{}) bool { return c == ch })
+		t.subscribers.Unlock()
+	}()
+	return ch
+}
+
+// notifySettingsChange notifies the subscribers that the settings changed
+func (t *Tagger) notifySettingsChange() {
+	t.subscribers.Lock()
+	defer t.subscribers.Unlock()
+	for _, ch := range t.subscribers.chans {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// withSettingsReadLock returns the handler with its funcs reading the settings under the settingsLock
+func (t *Tagger) withSettingsReadLock(handler cache.ResourceEventHandlerFuncs) cache.ResourceEventHandlerFuncs {
+	locked := cache.ResourceEventHandlerFuncs{}
+	if handler.AddFunc != nil {
+		locked.AddFunc = func(obj interface{}) {
+			t.settingsLock.RLock()
+			defer t.settingsLock.RUnlock()
+			handler.AddFunc(obj)
+		}
+	}
+	if handler.UpdateFunc != nil {
+		locked.UpdateFunc = func(oldObj, newObj interface{}) {
+			t.settingsLock.RLock()
+			defer t.settingsLock.RUnlock()
+			handler.UpdateFunc(oldObj, newObj)
+		}
+	}
+	if handler.DeleteFunc != nil {
+		locked.DeleteFunc = func(obj interface{}) {
+			t.settingsLock.RLock()
+			defer t.settingsLock.RUnlock()
+			handler.DeleteFunc(obj)
+		}
+	}
+	return locked
+}
@@ -0,0 +1,265 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSettings() Settings {
+	return Settings{
+		DefaultTags:      map[string]string{"team": "storage"},
+		TagFormat:        "json",
+		AnnotationPrefix: DefaultAnnotationPrefix,
+	}
+}
+
+func Test_ParseDefaultTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		format  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", value: "", format: "json", want: map[string]string{}},
+		{name: "json", value: "{\"foo\": \"bar\"}", format: "json", want: map[string]string{"foo": "bar"}},
+		{name: "csv", value: "foo=bar,me=touge", format: "csv", want: map[string]string{"foo": "bar", "me": "touge"}},
+		{name: "invalid json", value: "foo=bar", format: "json", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDefaultTags(tt.value, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDefaultTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDefaultTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_LoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    func(s Settings) Settings
+		wantErr string
+	}{
+		{
+			name: "empty file keeps the flags",
+			data: "",
+			want: func(s Settings) Settings { return s },
+		},
+		{
+			name: "overridden settings",
+			data: strings.Join([]string{
+				"defaultTags:",
+				"  env: prod",
+				"tagFormat: csv",
+				"allowAllTags: true",
+				"annotationPrefix: example.com",
+				"copyLabels: ['*']",
+				"copyAnnotations: [owner]",
+				"copyNamespaceLabels: [team]",
+			}, "\n"),
+			want: func(s Settings) Settings {
+				return Settings{
+					DefaultTags:         map[string]string{"env": "prod"},
+					TagFormat:           "csv",
+					AllowAllTags:        true,
+					AnnotationPrefix:    "example.com",
+					CopyLabels:          []string{"*"},
+					CopyAnnotations:     []string{"owner"},
+					CopyNamespaceLabels: []string{"team"},
+				}
+			},
+		},
+		{
+			name: "aws roles",
+			data: strings.Join([]string{
+				"awsRoles:",
+				"  namespaces:",
+				"    shared: arn:aws:iam::111122223333:role/pvc-tagger",
+				"  storageClasses:",
+				"    shared-gp3: arn:aws-us-gov:iam::444455556666:role/path/pvc-tagger",
+			}, "\n"),
+			want: func(s Settings) Settings {
+				s.AWSRoles = AWSRoles{
+					Namespaces:     map[string]string{"shared": "arn:aws:iam::111122223333:role/pvc-tagger"},
+					StorageClasses: map[string]string{"shared-gp3": "arn:aws-us-gov:iam::444455556666:role/path/pvc-tagger"},
+				}
+				return s
+			},
+		},
+		{
+			name:    "invalid aws role",
+			data:    "awsRoles:\n  namespaces:\n    shared: arn:aws:iam::1234:user/pvc-tagger\n",
+			wantErr: "awsRoles.namespaces \"shared\" has an invalid IAM role ARN \"arn:aws:iam::1234:user/pvc-tagger\"",
+		},
+		{
+			name:    "unknown setting",
+			data:    "defaultTag:\n  env: prod\n",
+			wantErr: "unknown field \"defaultTag\"",
+		},
+		{
+			name:    "invalid YAML",
+			data:    "defaultTags: [",
+			wantErr: "invalid config file",
+		},
+		{
+			name:    "invalid settings",
+			data:    "tagFormat: yaml\nannotationPrefix: Not_A_Domain\ncopyAnnotations: ['*']\n",
+			wantErr: "tagFormat \"yaml\" must be json or csv\nannotationPrefix \"Not_A_Domain\" is invalid: prefix part a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')\ncopyAnnotations doesn't support '*'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := newTestSettings()
+			got, err := LoadConfigFile(base, []byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfigFile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigFile() error = %v", err)
+			}
+			if want := tt.want(newTestSettings()); !reflect.DeepEqual(got, want) {
+				t.Errorf("LoadConfigFile() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func Test_UpdateSettings(t *testing.T) {
+	tg := newTestTagger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := tg.subscribeSettingsChanges(ctx)
+
+	s := newTestSettings()
+	s.CopyLabels = []string{"app"}
+	if err := tg.UpdateSettings(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := tg.Settings(); !reflect.DeepEqual(got, s) {
+		t.Errorf("Settings() = %+v, want %+v", got, s)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Error("UpdateSettings() didn't notify the change")
+	}
+
+	// the same settings are not a change
+	if err := tg.UpdateSettings(s); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Error("UpdateSettings() notified unchanged settings")
+	default:
+	}
+
+	invalid := s
+	invalid.TagFormat = "yaml"
+	if err := tg.UpdateSettings(invalid); err == nil {
+		t.Error("UpdateSettings() applied invalid settings")
+	}
+	if got := tg.Settings(); !reflect.DeepEqual(got, s) {
+		t.Errorf("Settings() = %+v, want %+v", got, s)
+	}
+
+	// the managed tags and status annotations of the current prefix would be orphaned
+	prefixChange := s
+	prefixChange.AnnotationPrefix = "example.com"
+	if err := tg.UpdateSettings(prefixChange); err == nil {
+		t.Error("UpdateSettings() changed the annotationPrefix")
+	}
+	if got := tg.Settings(); !reflect.DeepEqual(got, s) {
+		t.Errorf("Settings() = %+v, want %+v", got, s)
+	}
+	select {
+	case <-changes:
+		t.Error("UpdateSettings() notified rejected settings")
+	default:
+	}
+}
+
+func Test_WatchConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := "defaultTags:\n  env: dev\n"
+	writeConfig(data)
+	base := newTestSettings()
+	current, err := LoadConfigFile(base, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := newTestTagger()
+	tg.settings = current
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := tg.subscribeSettingsChanges(ctx)
+	go tg.WatchConfigFile(ctx, path, 10*time.Millisecond, base, []byte(data))
+
+	// an invalid config is not applied
+	writeConfig("tagFormat: yaml\n")
+	select {
+	case <-changes:
+		t.Fatal("invalid config file was applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// nor is an annotationPrefix change
+	writeConfig("annotationPrefix: example.com\n")
+	select {
+	case <-changes:
+		t.Fatal("annotationPrefix change was applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	writeConfig("defaultTags:\n  env: prod\n")
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config file change was not applied")
+	}
+	got := tg.Settings()
+	if want := map[string]string{"env": "prod"}; !reflect.DeepEqual(got.DefaultTags, want) {
+		t.Errorf("DefaultTags = %v, want %v", got.DefaultTags, want)
+	}
+	if got.TagFormat != "json" {
+		t.Errorf("TagFormat = %v, want json", got.TagFormat)
+	}
+}
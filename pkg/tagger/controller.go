@@ -0,0 +1,393 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// errInvalidVolumeTags is returned for tags the cloud doesn't accept, they
+// won't become valid by retrying.
+var errInvalidVolumeTags = errors.New("invalid volume tags")
+
+const (
+	// Backoff between retries of a failed tag operation
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// pvcQueueItem is a PVC waiting to have its volume tagged. Resync items compare the
+// desired tags with the tags currently set on the volume instead of setting all of them.
+type pvcQueueItem struct {
+	key    string
+	resync bool
+}
+
+type pvcController struct {
+	queue    workqueue.TypedRateLimitingInterface[pvcQueueItem]
+	lister   corelisters.PersistentVolumeClaimLister
+	pvLister corelisters.PersistentVolumeLister
+	// tagger builds the tags of the PVCs, its client records the managed tags on
+	// the PVs and the status of the PVCs
+	tagger   *Tagger
+	recorder record.EventRecorder
+
+	taggers volumeTaggers
+}
+
+func newPVCController(tagger *Tagger, recorder record.EventRecorder, lister corelisters.PersistentVolumeClaimLister, pvLister corelisters.PersistentVolumeLister, taggers volumeTaggers) *pvcController {
+	return &pvcController{
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[pvcQueueItem](retryBaseDelay, retryMaxDelay),
+			workqueue.TypedRateLimitingQueueConfig[pvcQueueItem]{Name: "pvc"},
+		),
+		lister:   lister,
+		pvLister: pvLister,
+		tagger:   tagger,
+		recorder: recorder,
+		taggers:  taggers,
+	}
+}
+
+func (c *pvcController) enqueue(pvc *corev1.PersistentVolumeClaim, resync bool) {
+	key, err := cache.MetaNamespaceKeyFunc(pvc)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Cannot build queue key:", err)
+		return
+	}
+	c.queue.Add(pvcQueueItem{key: key, resync: resync})
+}
+
+// enqueueClaimOf enqueues the PVC a PV is bound to through its claimRef, if that PVC
+// is in the watched namespace.
+func (c *pvcController) enqueueClaimOf(pv *corev1.PersistentVolume, watchNamespace string) {
+	claimRef := pv.Spec.ClaimRef
+	if claimRef == nil || claimRef.Name == "" {
+		return
+	}
+	if watchNamespace != "" && claimRef.Namespace != watchNamespace {
+		return
+	}
+	c.queue.Add(pvcQueueItem{key: claimRef.Namespace + "/" + claimRef.Name})
+}
+
+// enqueueMatching enqueues the PVCs with a volume for which match returns true
+func (c *pvcController) enqueueMatching(pvcs []*corev1.PersistentVolumeClaim, match func(pvc *corev1.PersistentVolumeClaim) bool) {
+	for _, pvc := range pvcs {
+		// the lister returns the shared cache objects, never modify them
+		pvc = getPVC(pvc.DeepCopy())
+		if pvc.Spec.VolumeName == "" || pvc.Spec.StorageClassName == nil || pvc.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if match(pvc) {
+			c.enqueue(pvc, false)
+		}
+	}
+}
+
+// enqueuePolicyChange enqueues the PVCs selected by the old or the new version of a TaggingPolicy
+func (c *pvcController) enqueuePolicyChange(oldPolicy, newPolicy *TaggingPolicy) {
+	pvcs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Cannot list PVCs:", err)
+		return
+	}
+
+	c.enqueueMatching(pvcs, func(pvc *corev1.PersistentVolumeClaim) bool {
+		namespace := c.tagger.getNamespace(pvc.GetNamespace())
+		return (oldPolicy != nil && oldPolicy.matches(pvc, namespace)) || (newPolicy != nil && newPolicy.matches(pvc, namespace))
+	})
+}
+
+// enqueueNamespaceChange enqueues the PVCs of a changed namespace
+func (c *pvcController) enqueueNamespaceChange(namespace *corev1.Namespace) {
+	pvcs, err := c.lister.PersistentVolumeClaims(namespace.GetName()).List(labels.Everything())
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": namespace.GetName()}).Errorln("Cannot list PVCs:", err)
+		return
+	}
+
+	c.enqueueMatching(pvcs, func(*corev1.PersistentVolumeClaim) bool {
+		return true
+	})
+}
+
+// enqueueStorageClassChange enqueues the PVCs of a changed storage class
+func (c *pvcController) enqueueStorageClassChange(storageClass *storagev1.StorageClass) {
+	pvcs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Cannot list PVCs:", err)
+		return
+	}
+
+	c.enqueueMatching(pvcs, func(pvc *corev1.PersistentVolumeClaim) bool {
+		return *pvc.Spec.StorageClassName == storageClass.GetName()
+	})
+}
+
+// enqueueSettingsChange enqueues every PVC after the settings changed
+func (c *pvcController) enqueueSettingsChange() {
+	pvcs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		log.Errorln("Cannot list PVCs:", err)
+		return
+	}
+
+	c.enqueueMatching(pvcs, func(*corev1.PersistentVolumeClaim) bool {
+		return true
+	})
+}
+
+func (c *pvcController) run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+
+	<-ctx.Done()
+}
+
+func (c *pvcController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *pvcController) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	err := c.syncPersistentVolumeClaim(ctx, item)
+	c.handleErr(item, err)
+	return true
+}
+
+// handleErr requeues a failed item with exponential backoff until maxAttempts is reached.
+func (c *pvcController) handleErr(item pvcQueueItem, err error) {
+	if err == nil {
+		c.queue.Forget(item)
+		return
+	}
+
+	attempts := c.queue.NumRequeues(item) + 1
+	if attempts < c.tagger.maxAttempts {
+		log.WithFields(log.Fields{"pvc": item.key, "attempt": attempts}).Warnln("Failed to tag volume, retrying:", err)
+		c.queue.AddRateLimited(item)
+		return
+	}
+
+	c.queue.Forget(item)
+	log.WithFields(log.Fields{"pvc": item.key, "attempts": attempts}).Errorln("Failed to tag volume, giving up:", err)
+}
+
+func (c *pvcController) syncPersistentVolumeClaim(ctx context.Context, item pvcQueueItem) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(item.key)
+	if err != nil {
+		log.WithFields(log.Fields{"pvc": item.key}).Errorln("Invalid queue key:", err)
+		return nil
+	}
+
+	pvc, err := c.lister.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		log.WithFields(log.Fields{"namespace": namespace, "pvc": name}).Debugln("PersistentVolumeClaim no longer exists")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the lister returns the shared cache object, never modify it
+	pvc = getPVC(pvc.DeepCopy())
+	// a PVC bound to a pre-provisioned PV can have no storage class
+	if pvc.Spec.StorageClassName == nil {
+		storageClassName := ""
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+
+	if pvc.Spec.VolumeName == "" || pvc.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	// The settings are only read under the settingsLock, which is never held during the
+	// cloud and Kubernetes API calls: UpdateSettings would wait for them, blocking the
+	// informer handlers and the webhooks meanwhile.
+	c.tagger.settingsLock.RLock()
+	volume, err := c.volumeTags(pvc)
+	c.tagger.settingsLock.RUnlock()
+	if err != nil || volume == nil {
+		return err
+	}
+	// An error here means the PVC or its PV can't be tagged, which
+	// isn't going to change by retrying.
+	if volume.err != nil {
+		c.reportStatus(ctx, pvc, volume.status, nil, volume.err)
+		return nil
+	}
+	// the AWS taggers assume the IAM role of the PVC, if any
+	ctx = withAWSRole(ctx, volume.awsRoleARN)
+
+	if item.resync {
+		err = c.resyncVolumeTags(ctx, pvc, volume.id, volume.tags, volume.removedTags, volume.provisionedBy, volume.storageclass)
+	} else if len(volume.tags) > 0 || len(volume.removedTags) > 0 {
+		err = c.applyVolumeTags(ctx, volume.id, volume.tags, volume.removedTags, volume.provisionedBy, volume.storageclass)
+	}
+
+	if err == nil {
+		err = c.tagger.recordManagedTags(ctx, volume.pv, volume.managedTagsAnnotation, volume.managedTags, sets.KeySet(volume.tags))
+	}
+	c.reportStatus(ctx, pvc, volume.status, volume.tags, err)
+	if errors.Is(err, errInvalidVolumeTags) {
+		return nil
+	}
+	return err
+}
+
+// pvcVolumeTags are the tags of the cloud volume of a PVC
+type pvcVolumeTags struct {
+	id            string
+	provisionedBy string
+	storageclass  string
+	awsRoleARN    string
+	pv            *corev1.PersistentVolume
+	tags          map[string]string
+	// managedTags are the keys recorded in the managedTagsAnnotation of the pv
+	managedTagsAnnotation string
+	managedTags           sets.Set[string]
+	// removedTags are the managed tag keys no longer in tags
+	removedTags []string
+	status      pvcStatusReport
+	// err is why the PVC or its PV can't be tagged
+	err error
+}
+
+// volumeTags returns the tags of the volume of the PVC built from the settings, nil when the
+// volume is not tagged. The caller holds the settingsLock.
+func (c *pvcController) volumeTags(pvc *corev1.PersistentVolumeClaim) (*pvcVolumeTags, error) {
+	status := c.tagger.newPVCStatusReport(pvc)
+	volumeID, tags, provisionedBy, err := c.tagger.processPersistentVolumeClaim(pvc, c.pvLister)
+	if err != nil {
+		return &pvcVolumeTags{status: status, err: err}, nil
+	}
+	if volumeID == "" {
+		return nil, nil
+	}
+	if _, ok := c.taggers.get(provisionedBy); !ok {
+		log.WithFields(log.Fields{"volumeID": volumeID}).Debugln("No volume tagger registered for", provisionedBy)
+		return nil, nil
+	}
+	pv, err := c.pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the keys recorded on the PV are removed, never the tags set by someone else
+	managedTags := c.tagger.managedTagKeys(pv)
+	return &pvcVolumeTags{
+		id:                    volumeID,
+		provisionedBy:         provisionedBy,
+		storageclass:          *pvc.Spec.StorageClassName,
+		awsRoleARN:            c.tagger.awsRoleARN(pvc),
+		pv:                    pv,
+		tags:                  tags,
+		managedTagsAnnotation: c.tagger.managedTagsAnnotation(),
+		managedTags:           managedTags,
+		removedTags:           removedManagedTags(managedTags, tags),
+		status:                status,
+	}, nil
+}
+
+// applyVolumeTags sets tags on the cloud volume and removes the removedTags keys from it.
+// Tags the cloud doesn't accept return errInvalidVolumeTags without calling the cloud.
+func (c *pvcController) applyVolumeTags(ctx context.Context, volumeID string, tags map[string]string, removedTags []string, provisionedBy string, storageclass string) error {
+	tagger, ok := c.taggers.get(provisionedBy)
+	if !ok {
+		log.WithFields(log.Fields{"volumeID": volumeID}).Debugln("No volume tagger registered for", provisionedBy)
+		return nil
+	}
+
+	if sanitizer, ok := tagger.(tagSanitizer); ok && len(tags) > 0 {
+		if _, err := sanitizer.SanitizeTags(tags); err != nil {
+			log.WithFields(log.Fields{"volumeID": volumeID}).Errorln("Invalid volume tags:", err)
+			return fmt.Errorf("%w: %w", errInvalidVolumeTags, err)
+		}
+	}
+	if len(tags) > 0 {
+		if err := tagger.SetTags(ctx, volumeID, tags, storageclass); err != nil {
+			return err
+		}
+	}
+	if len(removedTags) > 0 {
+		return tagger.RemoveTags(ctx, volumeID, removedTags, storageclass)
+	}
+	return nil
+}
+
+// resyncVolumeTags reads the tags currently set on the PVC's cloud volume, compares them
+// with the output of buildTags and applies only the tags that are missing or have drifted.
+// The removedTags keys still set on the volume are removed.
+func (c *pvcController) resyncVolumeTags(ctx context.Context, pvc *corev1.PersistentVolumeClaim, volumeID string, tags map[string]string, removedTags []string, provisionedBy string, storageclass string) error {
+	if len(tags) == 0 && len(removedTags) == 0 {
+		return nil
+	}
+	tagger, ok := c.taggers.get(provisionedBy)
+	if !ok {
+		return nil
+	}
+
+	currentTags, err := tagger.GetTags(ctx, volumeID)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Errorln("Could not get current volume tags:", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+
+	desiredTags := tags
+	if sanitizer, ok := tagger.(tagSanitizer); ok {
+		desiredTags, err = sanitizer.SanitizeTags(tags)
+		if err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Invalid volume tags:", err)
+			return fmt.Errorf("%w: %w", errInvalidVolumeTags, err)
+		}
+	}
+
+	driftedTags := diffTags(currentTags, desiredTags)
+	if len(driftedTags) == 0 && len(removedTags) == 0 {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("Volume tags are in sync")
+		return nil
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID, "tags": driftedTags, "removedTags": removedTags}).Infoln("Resyncing drifted volume tags")
+
+	return c.applyVolumeTags(ctx, volumeID, driftedTags, removedTags, provisionedBy, storageclass)
+}
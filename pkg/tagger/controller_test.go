@@ -0,0 +1,516 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestPVCController(t *testing.T, pvs []*corev1.PersistentVolume, taggers volumeTaggers, objects ...*corev1.PersistentVolumeClaim) *pvcController {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objects {
+		if err := indexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := fake.NewClientset()
+	for _, pv := range pvs {
+		if _, err := client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pvc := range objects {
+		if _, err := client.CoreV1().PersistentVolumeClaims(pvc.GetNamespace()).Create(context.Background(), pvc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tg := newTestTagger()
+	tg.client = client
+	c := newPVCController(tg, record.NewFakeRecorder(10), corelisters.NewPersistentVolumeClaimLister(indexer), newTestPVLister(t, pvs...), taggers)
+	t.Cleanup(c.queue.ShutDown)
+	return c
+}
+
+func Test_pvcController_handleErr(t *testing.T) {
+	c := newTestPVCController(t, nil, nil)
+	c.tagger.maxAttempts = 3
+	item := pvcQueueItem{key: "my-namespace/my-pvc"}
+
+	c.handleErr(item, errors.New("failed"))
+	c.handleErr(item, errors.New("failed"))
+	if got := c.queue.NumRequeues(item); got != 2 {
+		t.Errorf("NumRequeues() = %v, want %v", got, 2)
+	}
+
+	// the third failed attempt reaches maxAttempts and the item is dropped
+	c.handleErr(item, errors.New("failed"))
+	if got := c.queue.NumRequeues(item); got != 0 {
+		t.Errorf("NumRequeues() after giving up = %v, want %v", got, 0)
+	}
+
+	c.handleErr(item, errors.New("failed"))
+	c.handleErr(item, nil)
+	if got := c.queue.NumRequeues(item); got != 0 {
+		t.Errorf("NumRequeues() after success = %v, want %v", got, 0)
+	}
+}
+
+func Test_pvcController_syncPersistentVolumeClaim(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "my-namespace",
+			Annotations: map[string]string{
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "pvc-1234",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	// a PVC bound to a pre-provisioned PV can have no storage class
+	noClassPVC := pvc.DeepCopy()
+	noClassPVC.SetName("no-class-pvc")
+	noClassPVC.Spec.StorageClassName = nil
+	newPV := func(managedTags string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{
+						VolumeHandle: "projects/my-project/zones/us-east1-a/disks/my-disk",
+					},
+				},
+			},
+		}
+		if managedTags != "" {
+			pv.SetAnnotations(map[string]string{DefaultAnnotationPrefix + "/managed-tags": managedTags})
+		}
+		return pv
+	}
+
+	tests := []struct {
+		name            string
+		key             string
+		pv              *corev1.PersistentVolume
+		setLabelsErr    error
+		wantErr         bool
+		wantLabels      map[string]string
+		wantManagedTags string
+		wantEvent       string
+		wantStatusError string
+	}{
+		{
+			name:            "tags applied and recorded",
+			key:             "my-namespace/my-pvc",
+			pv:              newPV(""),
+			wantLabels:      map[string]string{"old": "value", "foreign": "value", "foo": "bar"},
+			wantManagedTags: "[\"foo\"]",
+			wantEvent:       "Normal TagsApplied Applied 1 tags to volume",
+		},
+		{
+			name:            "only the managed tags are removed",
+			key:             "my-namespace/my-pvc",
+			pv:              newPV("[\"foo\",\"old\"]"),
+			wantLabels:      map[string]string{"foreign": "value", "foo": "bar"},
+			wantManagedTags: "[\"foo\"]",
+			wantEvent:       "Normal TagsApplied Applied 1 tags to volume",
+		},
+		{
+			name:            "failed tag call is returned for a retry and keeps the managed tags",
+			key:             "my-namespace/my-pvc",
+			pv:              newPV("[\"foo\",\"old\"]"),
+			setLabelsErr:    errors.New("quota exceeded"),
+			wantErr:         true,
+			wantLabels:      map[string]string{"old": "value", "foreign": "value"},
+			wantManagedTags: "[\"foo\",\"old\"]",
+			wantEvent:       "Warning TagsFailed Failed to tag volume: quota exceeded",
+			wantStatusError: "quota exceeded",
+		},
+		{
+			name:            "PVC without storage class",
+			key:             "my-namespace/no-class-pvc",
+			pv:              newPV(""),
+			wantLabels:      map[string]string{"old": "value", "foreign": "value", "foo": "bar"},
+			wantManagedTags: "[\"foo\"]",
+			wantEvent:       "Normal TagsApplied Applied 1 tags to volume",
+		},
+		{
+			name:            "deleted PVC is not retried",
+			key:             "my-namespace/deleted-pvc",
+			pv:              newPV(""),
+			wantLabels:      map[string]string{"old": "value", "foreign": "value"},
+			wantManagedTags: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := map[string]string{"old": "value", "foreign": "value"}
+			gcpClient := &fakeGCPClient{
+				fakeGetDisk: func(project, zone, name string) (*compute.Disk, error) {
+					return &compute.Disk{Labels: maps.Clone(labels)}, nil
+				},
+				fakeSetDiskLabels: func(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+					if tt.setLabelsErr != nil {
+						return nil, tt.setLabelsErr
+					}
+					labels = labelReq.Labels
+					return &compute.Operation{Status: "PENDING"}, nil
+				},
+				fakeGetGCEOp: func(project, zone, name string) (*compute.Operation, error) {
+					return &compute.Operation{Status: "DONE"}, nil
+				},
+			}
+			c := newTestPVCController(t, []*corev1.PersistentVolume{tt.pv}, volumeTaggers{GCP_PD_CSI: &gcpPDTagger{client: gcpClient}}, pvc, noClassPVC)
+
+			err := c.syncPersistentVolumeClaim(context.Background(), pvcQueueItem{key: tt.key})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncPersistentVolumeClaim() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Errorf("disk labels = %v, want %v", labels, tt.wantLabels)
+			}
+			pv, err := c.tagger.client.CoreV1().PersistentVolumes().Get(context.Background(), tt.pv.GetName(), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pv.GetAnnotations()[DefaultAnnotationPrefix+"/managed-tags"]; got != tt.wantManagedTags {
+				t.Errorf("managed tags annotation = %v, want %v", got, tt.wantManagedTags)
+			}
+
+			var gotEvent string
+			select {
+			case gotEvent = <-c.recorder.(*record.FakeRecorder).Events:
+			default:
+			}
+			if gotEvent != tt.wantEvent {
+				t.Errorf("event = %q, want %q", gotEvent, tt.wantEvent)
+			}
+			if tt.wantEvent == "" {
+				return
+			}
+			namespace, name, _ := cache.SplitMetaNamespaceKey(tt.key)
+			gotPVC, err := c.tagger.client.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := c.tagger.getPVCStatus(gotPVC); status.Error != tt.wantStatusError || status.Time == "" {
+				t.Errorf("status = %+v, want error %q", status, tt.wantStatusError)
+			}
+		})
+	}
+}
+
+// fakeSanitizingVolumeTagger is a fakeVolumeTagger whose cloud rejects every tag set
+type fakeSanitizingVolumeTagger struct {
+	fakeVolumeTagger
+	sanitizeErr error
+}
+
+func (f *fakeSanitizingVolumeTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	if f.sanitizeErr != nil {
+		return nil, f.sanitizeErr
+	}
+	return tags, nil
+}
+
+func Test_pvcController_processNextItem_invalidTags(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "my-namespace",
+			Annotations: map[string]string{
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "pvc-1234",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle: "projects/my-project/zones/us-east1-a/disks/my-disk",
+				},
+			},
+		},
+	}
+
+	for _, resync := range []bool{false, true} {
+		// like the cloud taggers, SetTags fails the same way as SanitizeTags
+		sanitizeErr := errors.New("duplicated tags")
+		tagger := &fakeSanitizingVolumeTagger{fakeVolumeTagger: fakeVolumeTagger{setErr: sanitizeErr}, sanitizeErr: sanitizeErr}
+		c := newTestPVCController(t, []*corev1.PersistentVolume{pv}, volumeTaggers{GCP_PD_CSI: tagger}, pvc)
+		c.tagger.maxAttempts = 3
+		item := pvcQueueItem{key: "my-namespace/my-pvc", resync: resync}
+		c.queue.Add(item)
+
+		// an invalid tag set is given up at the first attempt instead of being retried
+		if !c.processNextItem(context.Background()) {
+			t.Fatal("processNextItem() = false, want true")
+		}
+		if got := c.queue.NumRequeues(item); got != 0 {
+			t.Errorf("resync %v: NumRequeues() = %v, want %v", resync, got, 0)
+		}
+		if tagger.setCalls != 0 {
+			t.Errorf("resync %v: SetTags() calls = %v, want %v", resync, tagger.setCalls, 0)
+		}
+	}
+}
+
+func Test_pvcController_processNextItem_taggerCreationError(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pvc",
+			Namespace: "my-namespace",
+			Annotations: map[string]string{
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
+				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "pvc-1234",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle: "projects/my-project/zones/us-east1-a/disks/my-disk",
+				},
+			},
+		},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		for _, resync := range []bool{false, true} {
+			// the cloud client can't be created, e.g. the metadata server is down
+			var tagger VolumeTagger = newLazyVolumeTagger(func() (VolumeTagger, error) {
+				return nil, errors.New("metadata server unavailable")
+			}, sanitizeTagsForGCP)
+			if dryRun {
+				tagger = &dryRunVolumeTagger{tagger: tagger}
+			}
+			c := newTestPVCController(t, []*corev1.PersistentVolume{pv}, volumeTaggers{GCP_PD_CSI: tagger}, pvc)
+			c.tagger.maxAttempts = 3
+			item := pvcQueueItem{key: "my-namespace/my-pvc", resync: resync}
+			c.queue.Add(item)
+
+			// a failure of the infrastructure is retried, it's not an invalid tag set
+			if !c.processNextItem(context.Background()) {
+				t.Fatal("processNextItem() = false, want true")
+			}
+			if got := c.queue.NumRequeues(item); got != 1 {
+				t.Errorf("dry run %v, resync %v: NumRequeues() = %v, want %v", dryRun, resync, got, 1)
+			}
+		}
+	}
+}
+
+func Test_pvcController_applyVolumeTags(t *testing.T) {
+	tests := []struct {
+		name           string
+		provisionedBy  string
+		tags           map[string]string
+		removedTags    []string
+		setErr         error
+		wantErr        bool
+		wantSetCalls   int
+		wantRemoveKeys []string
+	}{
+		{
+			name:          "tags set through the registered tagger",
+			provisionedBy: AWS_EBS_CSI,
+			tags:          map[string]string{"foo": "bar"},
+			wantSetCalls:  1,
+		},
+		{
+			name:           "tags set and removed",
+			provisionedBy:  AWS_EBS_CSI,
+			tags:           map[string]string{"foo": "bar"},
+			removedTags:    []string{"old"},
+			wantSetCalls:   1,
+			wantRemoveKeys: []string{"old"},
+		},
+		{
+			name:          "failed set skips the removal",
+			provisionedBy: AWS_EBS_CSI,
+			tags:          map[string]string{"foo": "bar"},
+			removedTags:   []string{"old"},
+			setErr:        errors.New("throttled"),
+			wantErr:       true,
+			wantSetCalls:  1,
+		},
+		{
+			name:          "no tagger registered for the provisioner",
+			provisionedBy: "unknown.csi.example.com",
+			tags:          map[string]string{"foo": "bar"},
+			wantSetCalls:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tagger := &fakeVolumeTagger{setErr: tt.setErr}
+			c := newTestPVCController(t, nil, volumeTaggers{AWS_EBS_CSI: tagger})
+
+			err := c.applyVolumeTags(context.Background(), "vol-1234", tt.tags, tt.removedTags, tt.provisionedBy, dummyStorageClassName)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("applyVolumeTags() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tagger.setCalls != tt.wantSetCalls {
+				t.Errorf("SetTags() calls = %v, want %v", tagger.setCalls, tt.wantSetCalls)
+			}
+			if !reflect.DeepEqual(tagger.removeKeys, tt.wantRemoveKeys) {
+				t.Errorf("RemoveTags() keys = %v, want %v", tagger.removeKeys, tt.wantRemoveKeys)
+			}
+		})
+	}
+}
+
+func Test_pvcController_enqueuePolicyChange(t *testing.T) {
+	newPVC := func(name string, labels map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "my-namespace", Labels: labels},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				VolumeName:       "pvc-" + name,
+				StorageClassName: &dummyStorageClassName,
+			},
+		}
+	}
+	db := newPVC("db", map[string]string{"app": "db"})
+	web := newPVC("web", map[string]string{"app": "web"})
+	unbound := newPVC("unbound", map[string]string{"app": "db"})
+	unbound.Spec.VolumeName = ""
+
+	oldPolicy := &TaggingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "db"},
+		Spec: TaggingPolicySpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			Tags:     map[string]string{"backup": "daily", "tier": "data"},
+		},
+	}
+	newPolicy := &TaggingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "db"},
+		Spec: TaggingPolicySpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			Tags:     map[string]string{"tier": "data"},
+		},
+	}
+	c := newTestPVCController(t, nil, nil, db, web, unbound)
+	// the informer store already holds the new version when the handlers run
+	setTestTaggingPolicies(t, c.tagger, nil, newPolicy)
+	c.enqueuePolicyChange(oldPolicy, newPolicy)
+
+	if got := c.queue.Len(); got != 1 {
+		t.Errorf("queue length = %v, want %v", got, 1)
+	}
+	if item, _ := c.queue.Get(); item.key != "my-namespace/db" {
+		t.Errorf("queued item = %v, want %v", item.key, "my-namespace/db")
+	}
+}
+
+func Test_pvcController_enqueueNamespaceChange(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "my-namespace"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "pvc-1234",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	otherPVC := pvc.DeepCopy()
+	otherPVC.SetNamespace("other-namespace")
+
+	newNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "my-namespace",
+		Labels:      map[string]string{"team": "b"},
+		Annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"cost-center\": \"5678\"}"},
+	}}
+	c := newTestPVCController(t, nil, nil, pvc, otherPVC)
+	// the informer stores already hold the new namespace when the handlers run
+	setTestTaggingPolicies(t, c.tagger, []*corev1.Namespace{newNamespace}, &TaggingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+		Spec: TaggingPolicySpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			Tags:              map[string]string{"team": "a"},
+		},
+	})
+	c.enqueueNamespaceChange(newNamespace)
+
+	if got := c.queue.Len(); got != 1 {
+		t.Errorf("queue length = %v, want %v", got, 1)
+	}
+	if item, _ := c.queue.Get(); item.key != "my-namespace/my-pvc" {
+		t.Errorf("queued item = %v, want %v", item.key, "my-namespace/my-pvc")
+	}
+}
+
+func Test_pvcController_enqueueStorageClassChange(t *testing.T) {
+	otherStorageClassName := "other"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "my-namespace"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "pvc-1234",
+			StorageClassName: &dummyStorageClassName,
+		},
+	}
+	otherPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-pvc", Namespace: "my-namespace"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName:       "pvc-5678",
+			StorageClassName: &otherStorageClassName,
+		},
+	}
+
+	newStorageClass := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+		Name:        dummyStorageClassName,
+		Annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"fast\"}"},
+	}}
+	c := newTestPVCController(t, nil, nil, pvc, otherPVC)
+	// the informer store already holds the new storage class when the handlers run
+	setTestStorageClasses(t, c.tagger, newStorageClass)
+	c.enqueueStorageClassChange(newStorageClass)
+
+	if got := c.queue.Len(); got != 1 {
+		t.Errorf("queue length = %v, want %v", got, 1)
+	}
+	if item, _ := c.queue.Get(); item.key != "my-namespace/my-pvc" {
+		t.Errorf("queued item = %v, want %v", item.key, "my-namespace/my-pvc")
+	}
+}
@@ -0,0 +1,824 @@
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/file/v1"
+	"google.golang.org/api/googleapi"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func init() {
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:    GCP,
+		Drivers:  []string{GCP_PD_CSI, GCP_PD_LEGACY},
+		VolumeID: gcpPDVolumeID,
+		NewTagger: func(ctx context.Context, _ *Tagger) (VolumeTagger, error) {
+			// the client outlives the tag calls, so it gets the long-lived context
+			gcpClient, err := newGCPClient(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create GCP client: %w", err)
+			}
+			return &gcpPDTagger{client: gcpClient}, nil
+		},
+		NewSnapshotTagger: func(ctx context.Context, _ *Tagger) (VolumeTagger, error) {
+			gcpClient, err := newGCPSnapshotClient(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create GCP client: %w", err)
+			}
+			return &gcpSnapshotTagger{client: gcpClient}, nil
+		},
+		SanitizeTags: sanitizeTagsForGCP,
+	})
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:    GCP,
+		Drivers:  []string{GCP_FILESTORE_CSI},
+		VolumeID: gcpFilestoreVolumeID,
+		NewTagger: func(ctx context.Context, _ *Tagger) (VolumeTagger, error) {
+			gcpClient, err := newGCPClient(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create GCP client: %w", err)
+			}
+			// the Filestore volume handles don't have the project of the instance
+			project, err := gcpProjectID(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &gcpFilestoreTagger{client: gcpClient, project: project}, nil
+		},
+		SanitizeTags: sanitizeTagsForGCP,
+	})
+}
+
+// gcpPDVolumeID returns the disk of a persistent disk PV, CSI or in-tree, see getGCPVolumeID
+func gcpPDVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	volumeID := getGCPVolumeID(pv)
+	if volumeID == "" {
+		return "", errors.New("the PV has no GCP disk")
+	}
+	return volumeID, nil
+}
+
+// gcpFilestoreVolumeID returns the volume handle of a Filestore PV
+func gcpFilestoreVolumeID(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+	return csiVolumeHandle(pv)
+}
+
+// gcpLabelUpdateAttempts is the number of times the labels of a disk or a Filestore instance
+// are read and set when other writers keep changing them in between
+const gcpLabelUpdateAttempts = 5
+
+// grpcCodeAborted is the code of the status of an operation aborted by a concurrent update
+const grpcCodeAborted = 10
+
+// errGCPEtagMismatch is the error of an update aborted by a concurrent update
+var errGCPEtagMismatch = errors.New("resource changed by another writer")
+
+var gcpLabelCharReplacer = strings.NewReplacer(
+	// slash and dot are common, use different replacement chars:
+	"/", "_", // replace slashes with underscores
+	".", "-", // replace dots with dashes
+
+	// less common characters, replace with dashes:
+	" ", "-", // replace spaces with dashes
+	":", "-", // replace colons with dashes
+	",", "-", // replace commas with dashes
+	";", "-", // replace semi-colons with dashes
+	"=", "-", // replace equals with dashes
+	"+", "-", // replace plus with dashes
+)
+
+// GCPClient reads and sets the labels of the GCP zonal and regional persistent disks,
+// Hyperdisks included, and of the Filestore instances
+type GCPClient interface {
+	GetDisk(ctx context.Context, project, zone, name string) (*compute.Disk, error)
+	SetDiskLabels(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error)
+	GetGCEOp(ctx context.Context, project, zone, name string) (*compute.Operation, error)
+	GetRegionDisk(ctx context.Context, project, region, name string) (*compute.Disk, error)
+	SetRegionDiskLabels(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error)
+	GetRegionOp(ctx context.Context, project, region, name string) (*compute.Operation, error)
+	// GetFilestoreInstance returns the instance projects/{project}/locations/{location}/instances/{instance}
+	GetFilestoreInstance(ctx context.Context, name string) (*file.Instance, error)
+	// SetFilestoreInstanceLabels replaces the labels of the instance if it still has the etag
+	SetFilestoreInstanceLabels(ctx context.Context, name string, labels map[string]string, etag string) (*file.Operation, error)
+	GetFilestoreOp(ctx context.Context, name string) (*file.Operation, error)
+}
+
+// GCPSnapshotClient reads and sets the labels of GCP disk snapshots
+type GCPSnapshotClient interface {
+	GetSnapshot(ctx context.Context, project, name string) (*compute.Snapshot, error)
+	SetSnapshotLabels(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error)
+	GetGlobalOp(ctx context.Context, project, name string) (*compute.Operation, error)
+}
+
+type gcpClient struct {
+	gce       *compute.Service
+	filestore *file.Service
+}
+
+func newGCPClient(ctx context.Context) (GCPClient, error) {
+	client, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filestoreClient, err := file.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpClient{gce: client, filestore: filestoreClient}, nil
+}
+
+func newGCPSnapshotClient(ctx context.Context) (GCPSnapshotClient, error) {
+	client, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpClient{gce: client}, nil
+}
+
+func (c *gcpClient) GetDisk(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+	return c.gce.Disks.Get(project, zone, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) SetDiskLabels(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+	return c.gce.Disks.SetLabels(project, zone, name, labelReq).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetGCEOp(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+	return c.gce.ZoneOperations.Get(project, zone, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetRegionDisk(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+	return c.gce.RegionDisks.Get(project, region, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) SetRegionDiskLabels(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error) {
+	return c.gce.RegionDisks.SetLabels(project, region, name, labelReq).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetRegionOp(ctx context.Context, project, region, name string) (*compute.Operation, error) {
+	return c.gce.RegionOperations.Get(project, region, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetFilestoreInstance(ctx context.Context, name string) (*file.Instance, error) {
+	return c.filestore.Projects.Locations.Instances.Get(name).Context(ctx).Do()
+}
+
+func (c *gcpClient) SetFilestoreInstanceLabels(ctx context.Context, name string, labels map[string]string, etag string) (*file.Operation, error) {
+	// an empty map must be sent to remove the last labels
+	instance := &file.Instance{Labels: labels, Etag: etag, ForceSendFields: []string{"Labels"}}
+	return c.filestore.Projects.Locations.Instances.Patch(name, instance).UpdateMask("labels").Context(ctx).Do()
+}
+
+func (c *gcpClient) GetFilestoreOp(ctx context.Context, name string) (*file.Operation, error) {
+	return c.filestore.Projects.Locations.Operations.Get(name).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetSnapshot(ctx context.Context, project, name string) (*compute.Snapshot, error) {
+	return c.gce.Snapshots.Get(project, name).Context(ctx).Do()
+}
+
+func (c *gcpClient) SetSnapshotLabels(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+	return c.gce.Snapshots.SetLabels(project, name, labelReq).Context(ctx).Do()
+}
+
+func (c *gcpClient) GetGlobalOp(ctx context.Context, project, name string) (*compute.Operation, error) {
+	return c.gce.GlobalOperations.Get(project, name).Context(ctx).Do()
+}
+
+// gcpPDTagger tags GCP persistent disks
+type gcpPDTagger struct {
+	client GCPClient
+}
+
+func (t *gcpPDTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	return getPDVolumeLabels(ctx, t.client, volumeID)
+}
+
+func (t *gcpPDTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	return addPDVolumeLabels(ctx, t.client, volumeID, tags, storageclass)
+}
+
+func (t *gcpPDTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	return deletePDVolumeLabels(ctx, t.client, volumeID, keys, storageclass)
+}
+
+func (t *gcpPDTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return sanitizeTagsForGCP(tags)
+}
+
+// gcpDisk is a persistent disk of a zone or, for a regional disk, of a region
+type gcpDisk struct {
+	project  string
+	location string
+	name     string
+	regional bool
+}
+
+// get returns the disk with the zonal or regional API
+func (d gcpDisk) get(ctx context.Context, c GCPClient) (*compute.Disk, error) {
+	if d.regional {
+		return c.GetRegionDisk(ctx, d.project, d.location, d.name)
+	}
+	return c.GetDisk(ctx, d.project, d.location, d.name)
+}
+
+// setLabels replaces the labels of the disk if its labels still have the fingerprint,
+// and waits for the operation to complete
+func (d gcpDisk) setLabels(ctx context.Context, c GCPClient, labels map[string]string, fingerprint string) error {
+	var op *compute.Operation
+	var err error
+	if d.regional {
+		op, err = c.SetRegionDiskLabels(ctx, d.project, d.location, d.name, &compute.RegionSetLabelsRequest{
+			Labels:           labels,
+			LabelFingerprint: fingerprint,
+		})
+	} else {
+		op, err = c.SetDiskLabels(ctx, d.project, d.location, d.name, &compute.ZoneSetLabelsRequest{
+			Labels:           labels,
+			LabelFingerprint: fingerprint,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	waitForCompletion := func(ctx context.Context) (bool, error) {
+		var resp *compute.Operation
+		var err error
+		if d.regional {
+			resp, err = c.GetRegionOp(ctx, d.project, d.location, op.Name)
+		} else {
+			resp, err = c.GetGCEOp(ctx, d.project, d.location, op.Name)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve status of label update operation on PD %s: %s", d.name, err)
+		}
+		if resp.Status == "DONE" && resp.Error != nil {
+			return false, fmt.Errorf("failed to set labels on PD %s: %s", d.name, gceOperationError(resp.Error))
+		}
+		return resp.Status == "DONE", nil
+	}
+	return wait.PollUntilContextTimeout(ctx,
+		time.Second,
+		time.Minute,
+		false,
+		waitForCompletion)
+}
+
+func getPDVolumeLabels(ctx context.Context, c GCPClient, volumeID string) (map[string]string, error) {
+	pd, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := pd.get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if disk.Labels == nil {
+		return map[string]string{}, nil
+	}
+	return disk.Labels, nil
+}
+
+func addPDVolumeLabels(ctx context.Context, c GCPClient, volumeID string, labels map[string]string, storageclass string) error {
+	sanitizedLabels := sanitizeLabelsForGCP(labels)
+	log.Debugf("labels to add to PD volume: %s: %s", volumeID, sanitizedLabels)
+	return updatePDVolumeLabels(ctx, c, volumeID, storageclass, func(labels map[string]string) {
+		maps.Copy(labels, sanitizedLabels)
+	})
+}
+
+func deletePDVolumeLabels(ctx context.Context, c GCPClient, volumeID string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	sanitizedKeys := sanitizeKeysForGCP(keys)
+	log.Debugf("labels to delete from PD volume: %s: %s", volumeID, sanitizedKeys)
+	return updatePDVolumeLabels(ctx, c, volumeID, storageclass, func(labels map[string]string) {
+		for _, k := range sanitizedKeys {
+			delete(labels, k)
+		}
+	})
+}
+
+// updatePDVolumeLabels sets the labels of the disk changed by update. When the labels of
+// the disk were changed by another writer since they were read, the label fingerprint
+// doesn't match anymore: the disk is read again and the update applied to its new labels.
+func updatePDVolumeLabels(ctx context.Context, c GCPClient, volumeID string, storageclass string, update func(labels map[string]string)) error {
+	pd, err := parseVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+
+	var updated bool
+	for attempt := 1; ; attempt++ {
+		updated, err = pd.updateLabels(ctx, c, update)
+		if !isGCPFingerprintMismatch(err) || attempt == gcpLabelUpdateAttempts {
+			break
+		}
+		log.Debugf("labels of PD %s changed by another writer, retrying", pd.name)
+	}
+	if err != nil {
+		log.Errorf("failed to set labels on PD: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	if !updated {
+		log.Debug("labels already set on PD")
+		return nil
+	}
+
+	log.Debug("successfully set labels on PD")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// updateLabels reads the labels of the disk and sets them to the labels changed by update,
+// returning whether they were changed
+func (d gcpDisk) updateLabels(ctx context.Context, c GCPClient, update func(labels map[string]string)) (bool, error) {
+	disk, err := d.get(ctx, c)
+	if err != nil {
+		return false, err
+	}
+
+	updatedLabels := make(map[string]string)
+	if disk.Labels != nil {
+		updatedLabels = maps.Clone(disk.Labels)
+	}
+	update(updatedLabels)
+	if maps.Equal(disk.Labels, updatedLabels) {
+		return false, nil
+	}
+
+	if err := d.setLabels(ctx, c, updatedLabels, disk.LabelFingerprint); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// gceOperationError returns the messages of the errors of a failed compute operation
+func gceOperationError(opErr *compute.OperationError) string {
+	var messages []string
+	for _, e := range opErr.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// isGCPEtagMismatch returns true if the error is the rejection of an update whose etag is
+// not the one of the resource anymore
+func isGCPEtagMismatch(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusConflict || apiErr.Code == http.StatusPreconditionFailed
+	}
+	return errors.Is(err, errGCPEtagMismatch)
+}
+
+// isGCPFingerprintMismatch returns true if the error is the precondition failure of a label
+// update whose fingerprint is not the one of the current labels
+func isGCPFingerprintMismatch(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// gcpFilestoreTagger labels the Filestore instances of the Filestore CSI volumes. The
+// instances are in the project of the tagger.
+type gcpFilestoreTagger struct {
+	client  GCPClient
+	project string
+}
+
+func (t *gcpFilestoreTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	name, err := t.instanceName(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := t.client.GetFilestoreInstance(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Labels == nil {
+		return map[string]string{}, nil
+	}
+	return instance.Labels, nil
+}
+
+func (t *gcpFilestoreTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	sanitizedLabels := sanitizeLabelsForGCP(tags)
+	log.Debugf("labels to add to Filestore instance: %s: %s", volumeID, sanitizedLabels)
+	return t.updateLabels(ctx, volumeID, storageclass, func(labels map[string]string) {
+		maps.Copy(labels, sanitizedLabels)
+	})
+}
+
+func (t *gcpFilestoreTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	sanitizedKeys := sanitizeKeysForGCP(keys)
+	log.Debugf("labels to delete from Filestore instance: %s: %s", volumeID, sanitizedKeys)
+	return t.updateLabels(ctx, volumeID, storageclass, func(labels map[string]string) {
+		for _, k := range sanitizedKeys {
+			delete(labels, k)
+		}
+	})
+}
+
+func (t *gcpFilestoreTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return sanitizeTagsForGCP(tags)
+}
+
+// instanceName returns the resource name of the Filestore instance of the volume handle
+func (t *gcpFilestoreTagger) instanceName(volumeID string) (string, error) {
+	location, instance, _, err := parseFilestoreVolumeID(volumeID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/instances/%s", t.project, location, instance), nil
+}
+
+// updateLabels sets the labels of the Filestore instance changed by update. When another
+// writer changed the instance since it was read, its etag doesn't match anymore: the
+// instance is read again and the update applied to its new labels.
+func (t *gcpFilestoreTagger) updateLabels(ctx context.Context, volumeID string, storageclass string, update func(labels map[string]string)) error {
+	name, err := t.instanceName(volumeID)
+	if err != nil {
+		return err
+	}
+
+	var updated bool
+	for attempt := 1; ; attempt++ {
+		updated, err = t.setLabels(ctx, name, update)
+		if !isGCPEtagMismatch(err) || attempt == gcpLabelUpdateAttempts {
+			break
+		}
+		log.Debugf("Filestore instance %s changed by another writer, retrying", name)
+	}
+	if err != nil {
+		log.Errorf("failed to set labels on Filestore instance: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	if !updated {
+		log.Debug("labels already set on Filestore instance")
+		return nil
+	}
+
+	log.Debug("successfully set labels on Filestore instance")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// setLabels reads the labels of the instance and sets them to the labels changed by update
+// if the instance still has the etag it was read with, and waits for the long-running
+// operation to complete. It returns whether the labels were changed.
+func (t *gcpFilestoreTagger) setLabels(ctx context.Context, name string, update func(labels map[string]string)) (bool, error) {
+	instance, err := t.client.GetFilestoreInstance(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	updatedLabels := make(map[string]string)
+	if instance.Labels != nil {
+		updatedLabels = maps.Clone(instance.Labels)
+	}
+	update(updatedLabels)
+	if maps.Equal(instance.Labels, updatedLabels) {
+		return false, nil
+	}
+
+	op, err := t.client.SetFilestoreInstanceLabels(ctx, name, updatedLabels, instance.Etag)
+	if err != nil {
+		return false, err
+	}
+
+	waitForCompletion := func(ctx context.Context) (bool, error) {
+		resp, err := t.client.GetFilestoreOp(ctx, op.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve status of label update operation on Filestore instance %s: %s", name, err)
+		}
+		if resp.Done && resp.Error != nil {
+			return false, filestoreOperationError(name, resp.Error)
+		}
+		return resp.Done, nil
+	}
+	if !op.Done {
+		err = wait.PollUntilContextTimeout(ctx,
+			time.Second,
+			time.Minute,
+			false,
+			waitForCompletion)
+	} else if op.Error != nil {
+		err = filestoreOperationError(name, op.Error)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// filestoreOperationError returns the error of a failed Filestore operation, an
+// errGCPEtagMismatch when it was aborted by a concurrent update
+func filestoreOperationError(name string, status *file.Status) error {
+	if status.Code == grpcCodeAborted {
+		return fmt.Errorf("%w: Filestore instance %s: %s", errGCPEtagMismatch, name, status.Message)
+	}
+	return fmt.Errorf("failed to set labels on Filestore instance %s: %s", name, status.Message)
+}
+
+// gcpSnapshotTagger tags the GCP snapshots of persistent disks
+type gcpSnapshotTagger struct {
+	client GCPSnapshotClient
+}
+
+func (t *gcpSnapshotTagger) GetTags(ctx context.Context, snapshotID string) (map[string]string, error) {
+	project, name, err := parseGCPSnapshotID(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := t.client.GetSnapshot(ctx, project, name)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Labels == nil {
+		return map[string]string{}, nil
+	}
+	return snapshot.Labels, nil
+}
+
+func (t *gcpSnapshotTagger) SetTags(ctx context.Context, snapshotID string, tags map[string]string, storageclass string) error {
+	sanitizedLabels := sanitizeLabelsForGCP(tags)
+	log.Debugf("labels to add to snapshot: %s: %s", snapshotID, sanitizedLabels)
+	return t.updateLabels(ctx, snapshotID, storageclass, func(labels map[string]string) {
+		maps.Copy(labels, sanitizedLabels)
+	})
+}
+
+func (t *gcpSnapshotTagger) RemoveTags(ctx context.Context, snapshotID string, keys []string, storageclass string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	sanitizedKeys := sanitizeKeysForGCP(keys)
+	log.Debugf("labels to delete from snapshot: %s: %s", snapshotID, sanitizedKeys)
+	return t.updateLabels(ctx, snapshotID, storageclass, func(labels map[string]string) {
+		for _, k := range sanitizedKeys {
+			delete(labels, k)
+		}
+	})
+}
+
+func (t *gcpSnapshotTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return sanitizeTagsForGCP(tags)
+}
+
+// updateLabels sets the labels of the snapshot changed by update. When the labels of the
+// snapshot were changed by another writer since they were read, the label fingerprint
+// doesn't match anymore: the snapshot is read again and the update applied to its new labels.
+func (t *gcpSnapshotTagger) updateLabels(ctx context.Context, snapshotID string, storageclass string, update func(labels map[string]string)) error {
+	project, name, err := parseGCPSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	var updated bool
+	for attempt := 1; ; attempt++ {
+		updated, err = t.setLabels(ctx, project, name, update)
+		if !isGCPFingerprintMismatch(err) || attempt == gcpLabelUpdateAttempts {
+			break
+		}
+		log.Debugf("labels of snapshot %s changed by another writer, retrying", name)
+	}
+	if err != nil {
+		log.Errorf("failed to set labels on snapshot: %s", err)
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return err
+	}
+	if !updated {
+		log.Debug("labels already set on snapshot")
+		return nil
+	}
+
+	log.Debug("successfully set labels on snapshot")
+	promActionsTotal.With(prometheus.Labels{"status": "success", "storageclass": storageclass}).Inc()
+	return nil
+}
+
+// setLabels reads the labels of the snapshot and sets them to the labels changed by update
+// if they still have the fingerprint, and waits for the operation to complete. It returns
+// whether the labels were changed.
+func (t *gcpSnapshotTagger) setLabels(ctx context.Context, project, name string, update func(labels map[string]string)) (bool, error) {
+	snapshot, err := t.client.GetSnapshot(ctx, project, name)
+	if err != nil {
+		return false, err
+	}
+
+	updatedLabels := make(map[string]string)
+	if snapshot.Labels != nil {
+		updatedLabels = maps.Clone(snapshot.Labels)
+	}
+	update(updatedLabels)
+	if maps.Equal(snapshot.Labels, updatedLabels) {
+		return false, nil
+	}
+
+	op, err := t.client.SetSnapshotLabels(ctx, project, name, &compute.GlobalSetLabelsRequest{
+		Labels:           updatedLabels,
+		LabelFingerprint: snapshot.LabelFingerprint,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	waitForCompletion := func(ctx context.Context) (bool, error) {
+		resp, err := t.client.GetGlobalOp(ctx, project, op.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve status of label update operation on snapshot %s: %s", name, err)
+		}
+		if resp.Status == "DONE" && resp.Error != nil {
+			return false, fmt.Errorf("failed to set labels on snapshot %s: %s", name, gceOperationError(resp.Error))
+		}
+		return resp.Status == "DONE", nil
+	}
+	if err := wait.PollUntilContextTimeout(ctx,
+		time.Second,
+		time.Minute,
+		false,
+		waitForCompletion); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// parseGCPSnapshotID returns the project and the name of a snapshot handle of the
+// PD CSI driver: projects/{project}/global/snapshots/{name}
+func parseGCPSnapshotID(id string) (string, string, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 5 || parts[0] != "projects" || parts[2] != "global" || parts[3] != "snapshots" {
+		return "", "", fmt.Errorf("invalid snapshot handle format")
+	}
+	return parts[1], parts[4], nil
+}
+
+// parseFilestoreVolumeID returns the location, the instance and the share of a Filestore
+// CSI volume handle: modeInstance/{location}/{instance}/{share}. The shares of the
+// multishare instances aren't supported, their instance is shared by many PVCs.
+func parseFilestoreVolumeID(id string) (string, string, string, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) > 0 && parts[0] == "modeMultishare" {
+		return "", "", "", fmt.Errorf("multishare Filestore volume %s not supported", id)
+	}
+	if len(parts) != 4 || parts[0] != "modeInstance" || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return "", "", "", fmt.Errorf("invalid Filestore volume handle format")
+	}
+	return parts[1], parts[2], parts[3], nil
+}
+
+// gcpProjectID returns the project of the GOOGLE_CLOUD_PROJECT environment variable,
+// else the project of the GCE metadata server
+func gcpProjectID(ctx context.Context) (string, error) {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project, nil
+	}
+	project, err := metadata.ProjectIDWithContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not get the GCP project, set GOOGLE_CLOUD_PROJECT: %w", err)
+	}
+	return project, nil
+}
+
+// parseVolumeID returns the disk of a PD volume handle, a zonal disk
+// projects/{project}/zones/{zone}/disks/{name} or a regional disk
+// projects/{project}/regions/{region}/disks/{name}
+func parseVolumeID(id string) (gcpDisk, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 6 || parts[0] != "projects" || (parts[2] != "zones" && parts[2] != "regions") || parts[4] != "disks" ||
+		parts[1] == "" || parts[3] == "" || parts[5] == "" {
+		return gcpDisk{}, fmt.Errorf("invalid volume handle format")
+	}
+	return gcpDisk{project: parts[1], location: parts[3], name: parts[5], regional: parts[2] == "regions"}, nil
+}
+
+// isValidGCPChar returns true if the rune is valid for GCP labels:
+// lowercase letters, numbers, dash, or underscore. International characters are
+// allowed.
+func isValidGCPChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_'
+}
+
+// sanitizeGCPLabelComponent handles the common sanitization logic for both keys
+// and values
+func sanitizeGCPLabelComponent(s string, isKey bool) string {
+	// Convert to lowercase
+	s = strings.ToLower(s)
+
+	// Replace invalid characters with dashes
+	s = gcpLabelCharReplacer.Replace(s)
+
+	// Filter to only valid characters
+	var b strings.Builder
+	for _, r := range s {
+		if isValidGCPChar(r) {
+			b.WriteRune(r)
+		}
+	}
+	s = b.String()
+
+	// For keys, ensure they start with a letter
+	if isKey && len(s) > 0 && !unicode.IsLetter(rune(s[0])) {
+		s = "k" + s
+	}
+
+	// Remove consecutive dashes/underscores
+	for strings.Contains(s, "--") || strings.Contains(s, "__") {
+		s = strings.ReplaceAll(s, "--", "-")
+		s = strings.ReplaceAll(s, "__", "_")
+	}
+
+	// Remove any trailing dashes or underscores
+	s = strings.TrimRight(s, "-_")
+
+	// Truncate to maximum length
+	if len(s) > 63 {
+		s = s[:63]
+		s = strings.TrimRight(s, "-_")
+	}
+
+	return s
+}
+
+// sanitizeKeyForGCP sanitizes a Kubernetes label key to fit GCP's label key constraints:
+// - Must start with a lowercase letter or international character
+// - Can only contain lowercase letters, numbers, dashes and underscores
+// - Must be between 1 and 63 characters long
+// - Must use UTF-8 encoding
+func sanitizeKeyForGCP(key string) string {
+	return sanitizeGCPLabelComponent(key, true)
+}
+
+// sanitizeValueForGCP sanitizes a Kubernetes label value to fit GCP's label value constraints:
+// - Can be empty
+// - Maximum length of 63 characters
+// - Can only contain lowercase letters, numbers, dashes and underscores
+// - Must use UTF-8 encoding
+func sanitizeValueForGCP(value string) string {
+	return sanitizeGCPLabelComponent(value, false)
+}
+
+// sanitizeLabelsForGCP sanitizes a map of Kubernetes labels to fit GCP's constraints.
+// Empty keys after sanitization are dropped from the result.
+func sanitizeLabelsForGCP(labels map[string]string) map[string]string {
+	if len(labels) > 64 {
+		// If we have more than 64 labels, only take the first 64
+		truncatedLabels := make(map[string]string, 64)
+		i := 0
+		for k, v := range labels {
+			if i >= 64 {
+				break
+			}
+			truncatedLabels[k] = v
+			i++
+		}
+		labels = truncatedLabels
+	}
+
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if sanitizedKey := sanitizeKeyForGCP(k); sanitizedKey != "" {
+			result[sanitizedKey] = sanitizeValueForGCP(v)
+		}
+	}
+	return result
+}
+
+// sanitizeTagsForGCP returns the tags the way the GCP taggers write them as labels
+func sanitizeTagsForGCP(tags map[string]string) (map[string]string, error) {
+	return sanitizeLabelsForGCP(tags), nil
+}
+
+// sanitizeKeysForGCP sanitizes a slice of label keys to fit GCP's constraints.
+// Empty keys after sanitization are dropped from the result.
+func sanitizeKeysForGCP(keys []string) []string {
+	result := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if sanitized := sanitizeKeyForGCP(k); sanitized != "" {
+			result = append(result, sanitized)
+		}
+	}
+	return result
+}
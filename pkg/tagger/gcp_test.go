@@ -0,0 +1,865 @@
+package tagger
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/file/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type fakeGCPClient struct {
+	fakeGetDisk       func(project, zone, name string) (*compute.Disk, error)
+	fakeSetDiskLabels func(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error)
+	fakeGetGCEOp      func(project, zone, name string) (*compute.Operation, error)
+
+	fakeGetFilestoreInstance       func(name string) (*file.Instance, error)
+	fakeSetFilestoreInstanceLabels func(name string, labels map[string]string, etag string) (*file.Operation, error)
+	fakeGetFilestoreOp             func(name string) (*file.Operation, error)
+
+	setLabelsCalled bool
+	// regionalCalls counts the calls of the regional disk API
+	regionalCalls int
+}
+
+func (c *fakeGCPClient) GetDisk(ctx context.Context, project, zone, name string) (*compute.Disk, error) {
+	if c.fakeGetDisk == nil {
+		return nil, nil
+	}
+	return c.fakeGetDisk(project, zone, name)
+}
+
+func (c *fakeGCPClient) SetDiskLabels(ctx context.Context, project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+	c.setLabelsCalled = true
+	if c.fakeSetDiskLabels == nil {
+		return nil, nil
+	}
+	return c.fakeSetDiskLabels(project, zone, name, labelReq)
+}
+
+func (c *fakeGCPClient) GetGCEOp(ctx context.Context, project, zone, name string) (*compute.Operation, error) {
+	if c.fakeSetDiskLabels == nil {
+		return nil, nil
+	}
+	return c.fakeGetGCEOp(project, zone, name)
+}
+
+func (c *fakeGCPClient) GetRegionDisk(ctx context.Context, project, region, name string) (*compute.Disk, error) {
+	c.regionalCalls++
+	return c.GetDisk(ctx, project, region, name)
+}
+
+func (c *fakeGCPClient) SetRegionDiskLabels(ctx context.Context, project, region, name string, labelReq *compute.RegionSetLabelsRequest) (*compute.Operation, error) {
+	c.regionalCalls++
+	return c.SetDiskLabels(ctx, project, region, name, &compute.ZoneSetLabelsRequest{Labels: labelReq.Labels, LabelFingerprint: labelReq.LabelFingerprint})
+}
+
+func (c *fakeGCPClient) GetRegionOp(ctx context.Context, project, region, name string) (*compute.Operation, error) {
+	c.regionalCalls++
+	return c.GetGCEOp(ctx, project, region, name)
+}
+
+func (c *fakeGCPClient) GetFilestoreInstance(ctx context.Context, name string) (*file.Instance, error) {
+	if c.fakeGetFilestoreInstance == nil {
+		return nil, nil
+	}
+	return c.fakeGetFilestoreInstance(name)
+}
+
+func (c *fakeGCPClient) SetFilestoreInstanceLabels(ctx context.Context, name string, labels map[string]string, etag string) (*file.Operation, error) {
+	c.setLabelsCalled = true
+	if c.fakeSetFilestoreInstanceLabels == nil {
+		return nil, nil
+	}
+	return c.fakeSetFilestoreInstanceLabels(name, labels, etag)
+}
+
+func (c *fakeGCPClient) GetFilestoreOp(ctx context.Context, name string) (*file.Operation, error) {
+	if c.fakeGetFilestoreOp == nil {
+		return nil, nil
+	}
+	return c.fakeGetFilestoreOp(name)
+}
+
+func setupFakeGCPClient(t *testing.T, currentLabels map[string]string, expectedSetLabels map[string]string) *fakeGCPClient {
+	return &fakeGCPClient{
+		fakeGetDisk: func(project, zone, name string) (*compute.Disk, error) {
+			return &compute.Disk{Labels: currentLabels}, nil
+		},
+		fakeSetDiskLabels: func(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			if !maps.Equal(labelReq.Labels, expectedSetLabels) {
+				t.Errorf("SetDiskLabels(), got labels = %v, want = %v", labelReq.Labels, expectedSetLabels)
+			}
+			return &compute.Operation{Status: "PENDING"}, nil
+		},
+		fakeGetGCEOp: func(project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+}
+
+func TestAddPDVolumeLabels(t *testing.T) {
+	tests := []struct {
+		name                  string
+		volumeID              string
+		currentLabels         map[string]string
+		newPvcLabels          map[string]string
+		expectSetLabelsCalled bool
+		expectedSetLabels     map[string]string
+		expectRegionalCalls   int
+	}{
+		{
+			name:                  "add new labels",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			newPvcLabels:          map[string]string{"foo": "bar", "dom.tld/key": "value"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key1": "val1", "key2": "val2", "foo": "bar", "dom-tld_key": "value"},
+		},
+		{
+			name:                  "add new labels to regional disk",
+			volumeID:              "projects/myproject/regions/myregion/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1"},
+			newPvcLabels:          map[string]string{"foo": "bar"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key1": "val1", "foo": "bar"},
+			expectRegionalCalls:   3,
+		},
+		{
+			name:                  "labels already set",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			expectSetLabelsCalled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := setupFakeGCPClient(t, tt.currentLabels, tt.expectedSetLabels)
+
+			addPDVolumeLabels(context.Background(), client, tt.volumeID, tt.newPvcLabels, "storage-ssd")
+
+			if client.setLabelsCalled != tt.expectSetLabelsCalled {
+				t.Error("SetDiskLabels() was not called")
+			}
+			if client.regionalCalls != tt.expectRegionalCalls {
+				t.Errorf("regional API calls = %v, want %v", client.regionalCalls, tt.expectRegionalCalls)
+			}
+		})
+	}
+}
+
+func TestDeletePDVolumeLabels(t *testing.T) {
+	tests := []struct {
+		name                  string
+		volumeID              string
+		currentLabels         map[string]string
+		labelsToDelete        []string
+		expectSetLabelsCalled bool
+		expectedSetLabels     map[string]string
+	}{
+		{
+			name:                  "delete existing labels",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2", "dom-tld_key": "bar"},
+			labelsToDelete:        []string{"key1", "dom.tld/key"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key2": "val2"},
+		},
+		{
+			name:                  "no labels to delete",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			labelsToDelete:        []string{},
+			expectSetLabelsCalled: false,
+		},
+		{
+			name:                  "no matching labels to delete",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1", "key2": "val2"},
+			labelsToDelete:        []string{"foo"},
+			expectSetLabelsCalled: false,
+		},
+		{
+			name:                  "all labels deleted",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         map[string]string{"key1": "val1"},
+			labelsToDelete:        []string{"key1"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{},
+		},
+		{
+			name:                  "no labels on disk",
+			volumeID:              "projects/myproject/zones/myzone/disks/mydisk",
+			currentLabels:         nil,
+			labelsToDelete:        []string{"foo"},
+			expectSetLabelsCalled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := setupFakeGCPClient(t, tt.currentLabels, tt.expectedSetLabels)
+
+			deletePDVolumeLabels(context.Background(), client, tt.volumeID, tt.labelsToDelete, "storage-ssd")
+
+			if client.setLabelsCalled != tt.expectSetLabelsCalled {
+				t.Error("SetDiskLabels() was not called")
+			}
+		})
+	}
+}
+
+func TestAddPDVolumeLabels_fingerprintMismatch(t *testing.T) {
+	// another writer adds a label between the first read and write of the disk
+	disk := &compute.Disk{Labels: map[string]string{"key1": "val1"}, LabelFingerprint: "fp1"}
+	reads := 0
+	var setLabels []map[string]string
+	client := &fakeGCPClient{
+		fakeGetDisk: func(project, zone, name string) (*compute.Disk, error) {
+			reads++
+			current := &compute.Disk{Labels: maps.Clone(disk.Labels), LabelFingerprint: disk.LabelFingerprint}
+			if reads == 1 {
+				disk = &compute.Disk{Labels: map[string]string{"key1": "val1", "other": "writer"}, LabelFingerprint: "fp2"}
+			}
+			return current, nil
+		},
+		fakeSetDiskLabels: func(project, zone, name string, labelReq *compute.ZoneSetLabelsRequest) (*compute.Operation, error) {
+			if labelReq.LabelFingerprint != disk.LabelFingerprint {
+				return nil, &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "Labels fingerprint either invalid or resource labels have changed"}
+			}
+			setLabels = append(setLabels, labelReq.Labels)
+			return &compute.Operation{Status: "PENDING"}, nil
+		},
+		fakeGetGCEOp: func(project, zone, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+
+	if err := addPDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"foo": "bar"}, "storage-ssd"); err != nil {
+		t.Fatalf("addPDVolumeLabels() err = %v", err)
+	}
+	if reads != 2 {
+		t.Errorf("GetDisk() calls = %v, want 2", reads)
+	}
+	want := []map[string]string{{"key1": "val1", "other": "writer", "foo": "bar"}}
+	if diff := cmp.Diff(want, setLabels); diff != "" {
+		t.Errorf("SetDiskLabels() labels mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddPDVolumeLabels_failedOperation(t *testing.T) {
+	client := setupFakeGCPClient(t, map[string]string{}, map[string]string{"foo": "bar"})
+	client.fakeGetGCEOp = func(project, zone, name string) (*compute.Operation, error) {
+		return &compute.Operation{Status: "DONE", Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{
+			{Code: "LABEL_LIMIT_EXCEEDED", Message: "too many labels"},
+		}}}, nil
+	}
+
+	err := addPDVolumeLabels(context.Background(), client, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"foo": "bar"}, "storage-ssd")
+	if err == nil || !strings.Contains(err.Error(), "LABEL_LIMIT_EXCEEDED: too many labels") {
+		t.Errorf("addPDVolumeLabels() err = %v, want the error of the operation", err)
+	}
+}
+
+func TestAddPDVolumeLabels_canceledContext(t *testing.T) {
+	client := setupFakeGCPClient(t, map[string]string{}, map[string]string{"foo": "bar"})
+	client.fakeGetGCEOp = func(project, zone, name string) (*compute.Operation, error) {
+		return &compute.Operation{Status: "RUNNING"}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := addPDVolumeLabels(ctx, client, "projects/myproject/zones/myzone/disks/mydisk", map[string]string{"foo": "bar"}, "storage-ssd"); err == nil {
+		t.Error("addPDVolumeLabels() expected an error for a canceled context")
+	}
+}
+
+func TestParseVolumeID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    gcpDisk
+		wantErr bool
+	}{
+		{
+			name: "valid volume ID",
+			id:   "projects/my-project/zones/us-central1/disks/my-disk",
+			want: gcpDisk{project: "my-project", location: "us-central1", name: "my-disk"},
+		},
+		{
+			name: "regional volume ID",
+			id:   "projects/my-project/regions/us-central1/disks/my-disk",
+			want: gcpDisk{project: "my-project", location: "us-central1", name: "my-disk", regional: true},
+		},
+		{
+			name:    "missing parts",
+			id:      "projects/my-project/zones/",
+			wantErr: true,
+		},
+		{
+			name:    "missing name",
+			id:      "projects/my-project/zones/us-central1-a/disks",
+			wantErr: true,
+		},
+		{
+			name:    "unknown location type",
+			id:      "projects/my-project/global/us-central1/disks/my-disk",
+			wantErr: true,
+		},
+		{
+			name:    "empty input",
+			id:      "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVolumeID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseVolumeID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseVolumeID() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCPFilestoreTagger(t *testing.T) {
+	const instanceName = "projects/myproject/locations/us-central1-a/instances/myinstance"
+	tests := []struct {
+		name                  string
+		currentLabels         map[string]string
+		addLabels             map[string]string
+		removeKeys            []string
+		opError               *file.Status
+		expectSetLabelsCalled bool
+		expectedSetLabels     map[string]string
+		wantErr               bool
+	}{
+		{
+			name:                  "add new labels",
+			currentLabels:         map[string]string{"key1": "val1"},
+			addLabels:             map[string]string{"dom.tld/key": "value"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key1": "val1", "dom-tld_key": "value"},
+		},
+		{
+			name:          "labels already set",
+			currentLabels: map[string]string{"key1": "val1"},
+			addLabels:     map[string]string{"key1": "val1"},
+		},
+		{
+			name:                  "delete labels",
+			currentLabels:         map[string]string{"key1": "val1", "dom-tld_key": "value"},
+			removeKeys:            []string{"dom.tld/key"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key1": "val1"},
+		},
+		{
+			name:                  "failed operation",
+			addLabels:             map[string]string{"key1": "val1"},
+			opError:               &file.Status{Message: "permission denied"},
+			expectSetLabelsCalled: true,
+			expectedSetLabels:     map[string]string{"key1": "val1"},
+			wantErr:               true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeGCPClient{
+				fakeGetFilestoreInstance: func(name string) (*file.Instance, error) {
+					if name != instanceName {
+						t.Errorf("GetFilestoreInstance() name = %v, want %v", name, instanceName)
+					}
+					return &file.Instance{Labels: tt.currentLabels}, nil
+				},
+				fakeSetFilestoreInstanceLabels: func(name string, labels map[string]string, etag string) (*file.Operation, error) {
+					if !maps.Equal(labels, tt.expectedSetLabels) {
+						t.Errorf("SetFilestoreInstanceLabels(), got labels = %v, want = %v", labels, tt.expectedSetLabels)
+					}
+					return &file.Operation{Name: "operation-1"}, nil
+				},
+				fakeGetFilestoreOp: func(name string) (*file.Operation, error) {
+					return &file.Operation{Name: name, Done: true, Error: tt.opError}, nil
+				},
+			}
+			tagger := &gcpFilestoreTagger{client: client, project: "myproject"}
+
+			volumeID := "modeInstance/us-central1-a/myinstance/vol1"
+			var err error
+			if tt.removeKeys != nil {
+				err = tagger.RemoveTags(context.Background(), volumeID, tt.removeKeys, "filestore")
+			} else {
+				err = tagger.SetTags(context.Background(), volumeID, tt.addLabels, "filestore")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("updateLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if client.setLabelsCalled != tt.expectSetLabelsCalled {
+				t.Errorf("SetFilestoreInstanceLabels() called = %v, want %v", client.setLabelsCalled, tt.expectSetLabelsCalled)
+			}
+		})
+	}
+}
+
+func TestGCPFilestoreTagger_etagMismatch(t *testing.T) {
+	// another writer adds a label between the first read and write of the instance
+	instance := &file.Instance{Labels: map[string]string{"key1": "val1"}, Etag: "etag1"}
+	reads := 0
+	var setLabels []map[string]string
+	client := &fakeGCPClient{
+		fakeGetFilestoreInstance: func(name string) (*file.Instance, error) {
+			reads++
+			current := &file.Instance{Labels: maps.Clone(instance.Labels), Etag: instance.Etag}
+			if reads == 1 {
+				instance = &file.Instance{Labels: map[string]string{"key1": "val1", "other": "writer"}, Etag: "etag2"}
+			}
+			return current, nil
+		},
+		fakeSetFilestoreInstanceLabels: func(name string, labels map[string]string, etag string) (*file.Operation, error) {
+			if etag != instance.Etag {
+				return nil, &googleapi.Error{Code: http.StatusConflict, Message: "etag mismatch"}
+			}
+			setLabels = append(setLabels, labels)
+			return &file.Operation{Name: "operation-1", Done: true}, nil
+		},
+	}
+	tagger := &gcpFilestoreTagger{client: client, project: "myproject"}
+
+	if err := tagger.SetTags(context.Background(), "modeInstance/us-central1-a/myinstance/vol1", map[string]string{"foo": "bar"}, "filestore"); err != nil {
+		t.Fatalf("SetTags() err = %v", err)
+	}
+	if reads != 2 {
+		t.Errorf("GetFilestoreInstance() calls = %v, want 2", reads)
+	}
+	want := []map[string]string{{"key1": "val1", "other": "writer", "foo": "bar"}}
+	if diff := cmp.Diff(want, setLabels); diff != "" {
+		t.Errorf("SetFilestoreInstanceLabels() labels mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFilestoreVolumeID(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		wantLocation string
+		wantInstance string
+		wantShare    string
+		wantErr      bool
+	}{
+		{
+			name:         "valid volume ID",
+			id:           "modeInstance/us-central1-a/pvc-1234/vol1",
+			wantLocation: "us-central1-a",
+			wantInstance: "pvc-1234",
+			wantShare:    "vol1",
+		},
+		{
+			name:    "multishare volume ID",
+			id:      "modeMultishare/fs-sc/my-project/us-central1/fs-1234/pvc_1234",
+			wantErr: true,
+		},
+		{
+			name:    "missing share",
+			id:      "modeInstance/us-central1-a/pvc-1234",
+			wantErr: true,
+		},
+		{
+			name:    "empty input",
+			id:      "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, instance, share, err := parseFilestoreVolumeID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFilestoreVolumeID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if location != tt.wantLocation || instance != tt.wantInstance || share != tt.wantShare {
+				t.Errorf("parseFilestoreVolumeID() = %q, %q, %q, want %q, %q, %q", location, instance, share, tt.wantLocation, tt.wantInstance, tt.wantShare)
+			}
+		})
+	}
+}
+
+type fakeGCPSnapshotClient struct {
+	fakeGetSnapshot       func(project, name string) (*compute.Snapshot, error)
+	fakeSetSnapshotLabels func(project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error)
+	fakeGetGlobalOp       func(project, name string) (*compute.Operation, error)
+}
+
+func (c *fakeGCPSnapshotClient) GetSnapshot(ctx context.Context, project, name string) (*compute.Snapshot, error) {
+	return c.fakeGetSnapshot(project, name)
+}
+
+func (c *fakeGCPSnapshotClient) SetSnapshotLabels(ctx context.Context, project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+	return c.fakeSetSnapshotLabels(project, name, labelReq)
+}
+
+func (c *fakeGCPSnapshotClient) GetGlobalOp(ctx context.Context, project, name string) (*compute.Operation, error) {
+	return c.fakeGetGlobalOp(project, name)
+}
+
+func TestGCPSnapshotTagger(t *testing.T) {
+	snapshotID := "projects/myproject/global/snapshots/mysnapshot"
+	newClient := func(snapshot *compute.Snapshot, setLabels *[]map[string]string) *fakeGCPSnapshotClient {
+		reads := 0
+		return &fakeGCPSnapshotClient{
+			fakeGetSnapshot: func(project, name string) (*compute.Snapshot, error) {
+				reads++
+				current := &compute.Snapshot{Labels: maps.Clone(snapshot.Labels), LabelFingerprint: snapshot.LabelFingerprint}
+				// another writer adds a label between the first read and write of the snapshot
+				if reads == 1 {
+					snapshot.Labels["other"] = "writer"
+					snapshot.LabelFingerprint = "fp2"
+				}
+				return current, nil
+			},
+			fakeSetSnapshotLabels: func(project, name string, labelReq *compute.GlobalSetLabelsRequest) (*compute.Operation, error) {
+				if labelReq.LabelFingerprint != snapshot.LabelFingerprint {
+					return nil, &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "Labels fingerprint either invalid or resource labels have changed"}
+				}
+				*setLabels = append(*setLabels, labelReq.Labels)
+				return &compute.Operation{Name: "op", Status: "PENDING"}, nil
+			},
+			fakeGetGlobalOp: func(project, name string) (*compute.Operation, error) {
+				return &compute.Operation{Status: "DONE"}, nil
+			},
+		}
+	}
+
+	t.Run("fingerprint mismatch", func(t *testing.T) {
+		var setLabels []map[string]string
+		client := newClient(&compute.Snapshot{Labels: map[string]string{"key1": "val1"}, LabelFingerprint: "fp1"}, &setLabels)
+		tagger := &gcpSnapshotTagger{client: client}
+
+		if err := tagger.SetTags(context.Background(), snapshotID, map[string]string{"foo": "bar"}, "storage-ssd"); err != nil {
+			t.Fatalf("SetTags() err = %v", err)
+		}
+		want := []map[string]string{{"key1": "val1", "other": "writer", "foo": "bar"}}
+		if diff := cmp.Diff(want, setLabels); diff != "" {
+			t.Errorf("SetSnapshotLabels() labels mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("failed operation", func(t *testing.T) {
+		var setLabels []map[string]string
+		client := newClient(&compute.Snapshot{Labels: map[string]string{}, LabelFingerprint: "fp1"}, &setLabels)
+		client.fakeGetGlobalOp = func(project, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "DONE", Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{
+				{Code: "LABEL_LIMIT_EXCEEDED", Message: "too many labels"},
+			}}}, nil
+		}
+		tagger := &gcpSnapshotTagger{client: client}
+
+		err := tagger.SetTags(context.Background(), snapshotID, map[string]string{"foo": "bar"}, "storage-ssd")
+		if err == nil || !strings.Contains(err.Error(), "LABEL_LIMIT_EXCEEDED: too many labels") {
+			t.Errorf("SetTags() err = %v, want the error of the operation", err)
+		}
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		var setLabels []map[string]string
+		client := newClient(&compute.Snapshot{Labels: map[string]string{}, LabelFingerprint: "fp1"}, &setLabels)
+		client.fakeGetGlobalOp = func(project, name string) (*compute.Operation, error) {
+			return &compute.Operation{Status: "RUNNING"}, nil
+		}
+		tagger := &gcpSnapshotTagger{client: client}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := tagger.SetTags(ctx, snapshotID, map[string]string{"foo": "bar"}, "storage-ssd"); err == nil {
+			t.Error("SetTags() expected an error for a canceled context")
+		}
+	})
+}
+
+func TestParseGCPSnapshotID(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		wantProject string
+		wantName    string
+		wantErr     bool
+	}{
+		{
+			name:        "valid snapshot handle",
+			id:          "projects/my-project/global/snapshots/my-snapshot",
+			wantProject: "my-project",
+			wantName:    "my-snapshot",
+			wantErr:     false,
+		},
+		{
+			name:    "disk ID",
+			id:      "projects/my-project/zones/us-central1-a/disks/my-disk",
+			wantErr: true,
+		},
+		{
+			name:    "empty input",
+			id:      "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project, name, err := parseGCPSnapshotID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseGCPSnapshotID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if project != tt.wantProject {
+				t.Errorf("Expected project %q, got %q", tt.wantProject, project)
+			}
+			if name != tt.wantName {
+				t.Errorf("Expected name %q, got %q", tt.wantName, name)
+			}
+		})
+	}
+}
+
+func TestSanitizeKeyForGCP(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{
+			name: "standard valid key",
+			key:  "app",
+			want: "app",
+		},
+		{
+			name: "uppercase converted to lowercase",
+			key:  "APP",
+			want: "app",
+		},
+		{
+			name: "must start with letter",
+			key:  "123-app",
+			want: "k123-app",
+		},
+		{
+			name: "replace invalid characters",
+			key:  "kubernetes.io/app=name:v1",
+			want: "kubernetes-io_app-name-v1",
+		},
+		{
+			name: "international characters preserved",
+			key:  "café-app",
+			want: "café-app",
+		},
+		{
+			name: "truncate long key",
+			key:  strings.Repeat("a", 70),
+			want: strings.Repeat("a", 63),
+		},
+		{
+			name: "collapse multiple separators",
+			key:  "app--name___test",
+			want: "app-name_test",
+		},
+		{
+			name: "trim trailing separators",
+			key:  "app-name---_",
+			want: "app-name",
+		},
+		{
+			name: "empty string",
+			key:  "",
+			want: "",
+		},
+		{
+			name: "only special characters",
+			key:  "!@#$%^&*()",
+			want: "",
+		},
+		{
+			name: "preserve underscores",
+			key:  "app_name_test",
+			want: "app_name_test",
+		},
+		{
+			name: "complex domain-style key",
+			key:  "k8s.io/persistent-volume/mount-path",
+			want: "k8s-io_persistent-volume_mount-path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeKeyForGCP(tt.key)
+			if got != tt.want {
+				t.Errorf("sanitizeKeyForGCP(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeValueForGCP(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "standard valid value",
+			value: "value-123",
+			want:  "value-123",
+		},
+		{
+			name:  "uppercase converted to lowercase",
+			value: "VALUE_123",
+			want:  "value_123",
+		},
+		{
+			name:  "special characters replaced",
+			value: "value.with:special/chars",
+			want:  "value-with-special_chars",
+		},
+		{
+			name:  "empty value allowed",
+			value: "",
+			want:  "",
+		},
+		{
+			name:  "truncate long value",
+			value: strings.Repeat("v", 70),
+			want:  strings.Repeat("v", 63),
+		},
+		{
+			name:  "collapse multiple separators",
+			value: "value--with___separators",
+			want:  "value-with_separators",
+		},
+		{
+			name:  "trim trailing separators",
+			value: "value-123---_",
+			want:  "value-123",
+		},
+		{
+			name:  "international characters preserved",
+			value: "café-123",
+			want:  "café-123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeValueForGCP(tt.value)
+			if got != tt.want {
+				t.Errorf("sanitizeValueForGCP(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabelsForGCP(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   map[string]string
+	}{
+		{
+			name: "standard valid labels",
+			labels: map[string]string{
+				"app":    "nginx",
+				"env":    "prod",
+				"region": "us-east1",
+			},
+			want: map[string]string{
+				"app":    "nginx",
+				"env":    "prod",
+				"region": "us-east1",
+			},
+		},
+		{
+			name: "sanitize keys and values",
+			labels: map[string]string{
+				"Kubernetes.io/app": "NGINX-1.0",
+				"123-region":        "US-EAST1",
+			},
+			want: map[string]string{
+				"kubernetes-io_app": "nginx-1-0",
+				"k123-region":       "us-east1",
+			},
+		},
+		{
+			name: "handle empty values",
+			labels: map[string]string{
+				"app": "",
+				"env": "prod",
+				"":    "invalid",
+			},
+			want: map[string]string{
+				"app": "",
+				"env": "prod",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeLabelsForGCP(tt.labels)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("sanitizeLabelsForGCP() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSanitizeKeysForGCP(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		want []string
+	}{
+		{
+			name: "standard valid keys",
+			keys: []string{"app", "env", "region"},
+			want: []string{"app", "env", "region"},
+		},
+		{
+			name: "sanitize invalid keys",
+			keys: []string{
+				"Kubernetes.io/app",
+				"123-region",
+				"",
+				"!@#",
+			},
+			want: []string{
+				"kubernetes-io_app",
+				"k123-region",
+			},
+		},
+		{
+			name: "empty slice",
+			keys: []string{},
+			want: []string{},
+		},
+		{
+			name: "all invalid keys",
+			keys: []string{"", "!@#", "123"},
+			want: []string{"k123"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeKeysForGCP(tt.keys)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("sanitizeKeysForGCP() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
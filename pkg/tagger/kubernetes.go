@@ -0,0 +1,1058 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"maps"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fsxtypes "github.com/aws/aws-sdk-go-v2/service/fsx/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	storageinformers "k8s.io/client-go/informers/storage/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+var awsVolumeRegMatch = regexp.MustCompile("^vol-[^/]*$")
+
+const (
+	// Matching strings for volume operations.
+	// EFS CSI volume handles: fs-id, fs-id:/path, fs-id::fsap-id or fs-id:/path:fsap-id
+	regexpEFSVolumeID = `^(?:efs:)?(fs-\w+)(?::([^:]*)(?::(fsap-\w+))?)?$`
+
+	// supported AWS storage provisioners:
+	AWS_EBS_CSI_AUTO = "ebs.csi.eks.amazonaws.com"
+	AWS_EBS_CSI      = "ebs.csi.aws.com"
+	AWS_EBS_LEGACY   = "kubernetes.io/aws-ebs"
+	AWS_EFS_CSI      = "efs.csi.aws.com"
+	AWS_FSX_CSI      = "fsx.csi.aws.com"
+	// AWS_FSX_OPENZFS_CSI volume handles are either an OpenZFS file system or volume ID
+	AWS_FSX_OPENZFS_CSI = "fsx.openzfs.csi.aws.com"
+	// AWS_FSX_ONTAP_TRIDENT is the NetApp Trident driver of the FSx for ONTAP volumes
+	AWS_FSX_ONTAP_TRIDENT = "csi.trident.netapp.io"
+
+	// supported AZURE storage provisioners:
+	AZURE_DISK_CSI = "disk.csi.azure.com"
+	// AZURE_FILE_CSI volumes are tagged on their storage account
+	AZURE_FILE_CSI = "file.csi.azure.com"
+	// AZURE_NETAPP_TRIDENT isn't a provisioner: the Trident volumes of the StorageClasses
+	// with the azure-netapp-files backendType are registered under it
+	AZURE_NETAPP_TRIDENT = "csi.trident.netapp.io/azure-netapp-files"
+
+	// the Trident backendTypes of the FSx for ONTAP and of the Azure NetApp Files volumes
+	tridentBackendONTAPNAS    = "ontap-nas"
+	tridentBackendONTAPSAN    = "ontap-san"
+	tridentBackendAzureNetApp = "azure-netapp-files"
+
+	// supported GCP storage provisioners:
+	GCP_PD_CSI    = "pd.csi.storage.gke.io"
+	GCP_PD_LEGACY = "kubernetes.io/gce-pd"
+	// GCP_FILESTORE_CSI volumes are labelled on their Filestore instance
+	GCP_FILESTORE_CSI = "filestore.csi.storage.gke.io"
+)
+
+type TagTemplate struct {
+	Name                 string
+	Namespace            string
+	Labels               map[string]string
+	Annotations          map[string]string
+	NamespaceLabels      map[string]string
+	NamespaceAnnotations map[string]string
+}
+
+// clusterInformers are the informers of cluster scoped objects, shared by the
+// watchers of every namespace.
+type clusterInformers struct {
+	pv             coreinformers.PersistentVolumeInformer
+	namespaces     coreinformers.NamespaceInformer
+	storageClasses storageinformers.StorageClassInformer
+	// taggingPolicies is nil unless --enable-tagging-policies is set
+	taggingPolicies cache.SharedIndexInformer
+	// snapshotContents is nil unless --enable-snapshots is set
+	snapshotContents cache.SharedIndexInformer
+}
+
+// newNamespaceInformerFactory returns the informer factory of the watchNamespace, shared
+// by the PVC and the VolumeSnapshot watchers of the namespace.
+func (t *Tagger) newNamespaceInformerFactory(watchNamespace string) informers.SharedInformerFactory {
+	if watchNamespace == "" {
+		return informers.NewSharedInformerFactory(t.client, t.resyncPeriod)
+	}
+	return informers.NewSharedInformerFactoryWithOptions(t.client, t.resyncPeriod, informers.WithNamespace(watchNamespace))
+}
+
+func (t *Tagger) watchForPersistentVolumeClaims(ctx context.Context, ch chan struct{}, watchNamespace string, factory informers.SharedInformerFactory, sharedInformers clusterInformers, taggers volumeTaggers, recorder record.EventRecorder) {
+	var err error
+	log.WithFields(log.Fields{"namespace": watchNamespace}).Infoln("Starting informer")
+
+	informer := factory.Core().V1().PersistentVolumeClaims().Informer()
+
+	pvInformer := sharedInformers.pv
+	controller := newPVCController(t, recorder, factory.Core().V1().PersistentVolumeClaims().Lister(), pvInformer.Lister(), taggers)
+
+	_, err = informer.AddEventHandler(t.withSettingsReadLock(t.pvcEventHandlers(controller)))
+	if err != nil {
+		log.Errorln("Can't setup PVC informer! Check RBAC permissions")
+		return
+	}
+
+	// Statically provisioned, rebound and re-annotated PVs don't update their
+	// PVC so they need to enqueue the claim themselves.
+	pvHandler, err := pvInformer.Informer().AddEventHandler(t.withSettingsReadLock(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pv := obj.(*corev1.PersistentVolume)
+			controller.enqueueClaimOf(pv, watchNamespace)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldPV := old.(*corev1.PersistentVolume)
+			newPV := new.(*corev1.PersistentVolume)
+			if !t.shouldReconcilePersistentVolume(oldPV, newPV) {
+				return
+			}
+			log.WithFields(log.Fields{"pv": newPV.GetName()}).Debugln("PersistentVolume changed")
+			controller.enqueueClaimOf(newPV, watchNamespace)
+		},
+	}))
+	if err != nil {
+		log.Errorln("Can't setup PV informer! Check RBAC permissions")
+		return
+	}
+	defer func() {
+		if err := pvInformer.Informer().RemoveEventHandler(pvHandler); err != nil {
+			log.Errorln("Can't remove PV event handler:", err)
+		}
+	}()
+
+	// Namespace tags and namespaceSelectors change the tags of every PVC in the namespace
+	namespaceHandler, err := sharedInformers.namespaces.Informer().AddEventHandler(t.withSettingsReadLock(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldNamespace := old.(*corev1.Namespace)
+			newNamespace := new.(*corev1.Namespace)
+			if !shouldReconcileNamespace(oldNamespace, newNamespace) {
+				return
+			}
+			if watchNamespace != "" && newNamespace.GetName() != watchNamespace {
+				return
+			}
+			log.WithFields(log.Fields{"namespace": newNamespace.GetName()}).Infoln("Namespace changed")
+			controller.enqueueNamespaceChange(newNamespace)
+		},
+	}))
+	if err != nil {
+		log.Errorln("Can't setup Namespace informer! Check RBAC permissions")
+		return
+	}
+	defer func() {
+		if err := sharedInformers.namespaces.Informer().RemoveEventHandler(namespaceHandler); err != nil {
+			log.Errorln("Can't remove Namespace event handler:", err)
+		}
+	}()
+
+	// StorageClass tags change the tags of every PVC of the class
+	storageClassHandler, err := sharedInformers.storageClasses.Informer().AddEventHandler(t.withSettingsReadLock(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldStorageClass := old.(*storagev1.StorageClass)
+			newStorageClass := new.(*storagev1.StorageClass)
+			if oldStorageClass.ResourceVersion == newStorageClass.ResourceVersion ||
+				reflect.DeepEqual(oldStorageClass.GetAnnotations(), newStorageClass.GetAnnotations()) {
+				return
+			}
+			log.WithFields(log.Fields{"storageclass": newStorageClass.GetName()}).Infoln("StorageClass changed")
+			controller.enqueueStorageClassChange(newStorageClass)
+		},
+	}))
+	if err != nil {
+		log.Errorln("Can't setup StorageClass informer! Check RBAC permissions")
+		return
+	}
+	defer func() {
+		if err := sharedInformers.storageClasses.Informer().RemoveEventHandler(storageClassHandler); err != nil {
+			log.Errorln("Can't remove StorageClass event handler:", err)
+		}
+	}()
+
+	if sharedInformers.taggingPolicies != nil {
+		policyHandler, err := sharedInformers.taggingPolicies.AddEventHandler(t.withSettingsReadLock(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if policy, ok := taggingPolicyFromObj(obj); ok {
+					controller.enqueuePolicyChange(nil, policy)
+				}
+			},
+			UpdateFunc: func(old, new interface{}) {
+				oldPolicy, oldOk := taggingPolicyFromObj(old)
+				newPolicy, newOk := taggingPolicyFromObj(new)
+				if !oldOk || !newOk || oldPolicy.ResourceVersion == newPolicy.ResourceVersion {
+					return
+				}
+				log.WithFields(log.Fields{"policy": newPolicy.GetName()}).Infoln("TaggingPolicy changed")
+				controller.enqueuePolicyChange(oldPolicy, newPolicy)
+			},
+			DeleteFunc: func(obj interface{}) {
+				if policy, ok := taggingPolicyFromObj(obj); ok {
+					log.WithFields(log.Fields{"policy": policy.GetName()}).Infoln("TaggingPolicy deleted")
+					controller.enqueuePolicyChange(policy, nil)
+				}
+			},
+		}))
+		if err != nil {
+			log.Errorln("Can't setup TaggingPolicy informer! Check RBAC permissions")
+			return
+		}
+		defer func() {
+			if err := sharedInformers.taggingPolicies.RemoveEventHandler(policyHandler); err != nil {
+				log.Errorln("Can't remove TaggingPolicy event handler:", err)
+			}
+		}()
+	}
+
+	factory.Start(ch)
+	if !cache.WaitForCacheSync(ch, append(sharedInformers.hasSynced(), informer.HasSynced)...) {
+		log.WithFields(log.Fields{"namespace": watchNamespace}).Errorln("Timed out waiting for the informers to sync")
+		return
+	}
+
+	// the settings can change the tags of every PVC
+	settingsChanges := t.subscribeSettingsChanges(ctx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-settingsChanges:
+				log.WithFields(log.Fields{"namespace": watchNamespace}).Infoln("Settings changed")
+				controller.enqueueSettingsChange()
+			}
+		}
+	}()
+
+	controller.run(ctx)
+}
+
+// pvcEventHandlers enqueue the new PVCs with a volume and the PVCs whose tags changed.
+// The caller holds the settingsLock.
+func (t *Tagger) pvcEventHandlers(controller *pvcController) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pvc := getPVC(obj)
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Infoln("New PVC Added to Store")
+
+			if pvc.Spec.VolumeName == "" {
+				log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("PersistentVolume not created yet")
+				return
+			}
+
+			controller.enqueue(pvc, false)
+		},
+
+		UpdateFunc: func(old, new interface{}) {
+			newPVC := getPVC(new)
+			oldPVC := getPVC(old)
+			// The informer re-delivers every PVC with an unchanged ResourceVersion
+			// on each resync period.
+			isResync := newPVC.ResourceVersion == oldPVC.ResourceVersion
+			if isResync && t.resyncPeriod == 0 {
+				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("ResourceVersion are the same")
+				return
+			}
+			if newPVC.Spec.VolumeName == "" {
+				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolume not created yet")
+				return
+			}
+			if newPVC.GetDeletionTimestamp() != nil {
+				log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Debugln("PersistentVolumeClaim is being deleted")
+				return
+			}
+			if isResync {
+				controller.enqueue(newPVC, true)
+				return
+			}
+
+			if !shouldReconcileTags(oldPVC, newPVC, t.buildTags(oldPVC), t.buildTags(newPVC)) {
+				return
+			}
+			log.WithFields(log.Fields{"namespace": newPVC.GetNamespace(), "pvc": newPVC.GetName()}).Infoln("Need to reconcile tags")
+			controller.enqueue(newPVC, false)
+		},
+	}
+}
+
+// shouldReconcilePersistentVolume decides whether a PV update needs its claim to be
+// re-tagged: the PV was bound or rebound to a claim, or its annotations changed.
+func (t *Tagger) shouldReconcilePersistentVolume(oldPV, newPV *corev1.PersistentVolume) bool {
+	if oldPV.ResourceVersion == newPV.ResourceVersion {
+		return false
+	}
+	if newPV.Spec.ClaimRef == nil {
+		return false
+	}
+	if oldPV.Spec.ClaimRef == nil || oldPV.Spec.ClaimRef.UID != newPV.Spec.ClaimRef.UID ||
+		oldPV.Spec.ClaimRef.Namespace != newPV.Spec.ClaimRef.Namespace || oldPV.Spec.ClaimRef.Name != newPV.Spec.ClaimRef.Name {
+		return true
+	}
+	if oldPV.Status.Phase != corev1.VolumeBound && newPV.Status.Phase == corev1.VolumeBound {
+		return true
+	}
+	// recording the managed tags doesn't change the tags of the volume
+	return !maps.Equal(t.withoutManagedTagsAnnotation(oldPV.GetAnnotations()), t.withoutManagedTagsAnnotation(newPV.GetAnnotations()))
+}
+
+// shouldReconcileNamespace decides whether a namespace update can change the tags of its PVCs
+func shouldReconcileNamespace(oldNamespace, newNamespace *corev1.Namespace) bool {
+	if oldNamespace.ResourceVersion == newNamespace.ResourceVersion {
+		return false
+	}
+	return !reflect.DeepEqual(oldNamespace.GetLabels(), newNamespace.GetLabels()) ||
+		!reflect.DeepEqual(oldNamespace.GetAnnotations(), newNamespace.GetAnnotations())
+}
+
+// getNamespace returns the namespace from the informer cache, nil if it's unknown
+func (t *Tagger) getNamespace(name string) *corev1.Namespace {
+	if t.namespaceLister == nil {
+		return nil
+	}
+	namespace, err := t.namespaceLister.Get(name)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": name}).Debugln("Cannot get namespace:", err)
+		return nil
+	}
+	return namespace
+}
+
+// namespaceTags returns the tags a namespace sets on the volumes of its PVCs: its
+// labels selected by --copy-namespace-labels and its tags annotation.
+func (t *Tagger) namespaceTags(namespace *corev1.Namespace) map[string]string {
+	tags := map[string]string{}
+	if namespace == nil {
+		return tags
+	}
+
+	if len(t.settings.CopyNamespaceLabels) > 0 {
+		for k, v := range namespace.GetLabels() {
+			if t.settings.CopyNamespaceLabels[0] == "*" || slices.Contains(t.settings.CopyNamespaceLabels, k) {
+				tags[k] = v
+			}
+		}
+	}
+	if tagString, ok := namespace.GetAnnotations()[t.settings.AnnotationPrefix+"/tags"]; ok {
+		maps.Copy(tags, t.parseTags(tagString))
+	}
+	return tags
+}
+
+// getStorageClass returns the storage class from the informer cache, nil if it's unknown
+func (t *Tagger) getStorageClass(name string) *storagev1.StorageClass {
+	if t.storageClassLister == nil {
+		return nil
+	}
+	storageClass, err := t.storageClassLister.Get(name)
+	if err != nil {
+		log.WithFields(log.Fields{"storageclass": name}).Debugln("Cannot get StorageClass:", err)
+		return nil
+	}
+	return storageClass
+}
+
+// tridentBackendType returns the Trident backendType parameter of the StorageClass,
+// empty if it's unknown
+func tridentBackendType(storageClass *storagev1.StorageClass) string {
+	if storageClass == nil {
+		return ""
+	}
+	return storageClass.Parameters["backendType"]
+}
+
+// storageClassTags returns the tags a storage class sets on the volumes of its PVCs
+func (t *Tagger) storageClassTags(storageClass *storagev1.StorageClass) map[string]string {
+	if storageClass == nil {
+		return map[string]string{}
+	}
+	if tagString, ok := storageClass.GetAnnotations()[t.settings.AnnotationPrefix+"/tags"]; ok {
+		return t.parseTags(tagString)
+	}
+	return map[string]string{}
+}
+
+// storageClassName returns the name of the storage class of the PVC, empty if it has none
+// like a PVC bound to a pre-provisioned PV
+func storageClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.StorageClassName
+}
+
+// getPVCStorageClass returns the storage class of the PVC, nil if it has none
+func (t *Tagger) getPVCStorageClass(pvc *corev1.PersistentVolumeClaim) *storagev1.StorageClass {
+	if pvc.Spec.StorageClassName == nil {
+		return nil
+	}
+	return t.getStorageClass(*pvc.Spec.StorageClassName)
+}
+
+// storageClassIgnored returns whether the PVC's storage class has the ignore annotation
+func (t *Tagger) storageClassIgnored(pvc *corev1.PersistentVolumeClaim) bool {
+	storageClass := t.getPVCStorageClass(pvc)
+	if storageClass == nil {
+		return false
+	}
+	_, ok := storageClass.GetAnnotations()[t.settings.AnnotationPrefix+"/ignore"]
+	return ok
+}
+
+// parseTags parses a tags annotation in the --tag-format
+func (t *Tagger) parseTags(tagString string) map[string]string {
+	tags := map[string]string{}
+	if t.settings.TagFormat == "csv" {
+		tags, _ = parseCsv(tagString)
+		return tags
+	}
+	err := json.Unmarshal([]byte(tagString), &tags)
+	if err != nil {
+		log.Errorln("Failed to Unmarshal JSON:", err)
+	}
+	return tags
+}
+
+// parseCsv parses key=value pairs separated by commas. The invalid pairs are skipped
+// and returned.
+func parseCsv(value string) (map[string]string, []string) {
+	tags := make(map[string]string)
+	var invalid []string
+	for _, s := range strings.Split(value, ",") {
+		if len(s) == 0 {
+			continue
+		}
+		pairs := strings.SplitN(s, "=", 2)
+		if len(pairs) != 2 {
+			log.Errorln("invalid csv key/value pair. Skipping...")
+			invalid = append(invalid, s)
+			continue
+		}
+		k := strings.TrimSpace(pairs[0])
+		v := strings.TrimSpace(pairs[1])
+		if k == "" || v == "" {
+			log.Errorln("invalid csv key/value pair. Skipping...")
+			invalid = append(invalid, s)
+			continue
+		}
+		tags[k] = v
+	}
+
+	return tags, invalid
+}
+
+// formatTags encodes the tags in the tag format, so parseTags returns them. In the csv
+// format the tags with a ',' or '=' in their key, or a ',' or no value, can't be encoded
+// and are skipped. The keys of the skipped tags are returned.
+func (t *Tagger) formatTags(tags map[string]string) (string, []string) {
+	if t.settings.TagFormat != "csv" {
+		// json.Marshal sorts the map keys
+		data, err := json.Marshal(tags)
+		if err != nil {
+			log.Errorln("Failed to Marshal JSON:", err)
+		}
+		return string(data), nil
+	}
+	var pairs []string
+	var skipped []string
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		v := tags[k]
+		if strings.ContainsAny(k, ",=") || strings.TrimSpace(k) == "" || strings.Contains(v, ",") || strings.TrimSpace(v) == "" {
+			skipped = append(skipped, k)
+			continue
+		}
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ","), skipped
+}
+
+// diffTags returns the desired tags that are either missing from the current tags
+// or set to a different value.
+func diffTags(currentTags, desiredTags map[string]string) map[string]string {
+	diff := map[string]string{}
+	for k, v := range desiredTags {
+		if current, ok := currentTags[k]; !ok || current != v {
+			diff[k] = v
+		}
+	}
+	return diff
+}
+
+func provisionedByAzureDisk(pvc *corev1.PersistentVolumeClaim) bool {
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+
+	provisionedBy, ok := getProvisionedBy(annotations)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
+		return false
+	}
+
+	switch provisionedBy {
+	case AZURE_DISK_CSI:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AZURE_DISK_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func convertTagsToFSxTags(tags map[string]string) []fsxtypes.Tag {
+	convertedTags := []fsxtypes.Tag{}
+	for tagKey, tagValue := range tags {
+		convertedTags = append(convertedTags, fsxtypes.Tag{
+			Key:   aws.String(tagKey),
+			Value: aws.String(tagValue),
+		})
+	}
+	return convertedTags
+}
+
+func parseAWSEBSVolumeID(kubernetesID string) string {
+	// Pulled from https://github.com/kubernetes/csi-translation-lib/blob/release-1.26/plugins/aws_ebs.go#L244
+	if !strings.HasPrefix(kubernetesID, "aws://") {
+		// Assume a bare aws volume id (vol-1234...)
+		return kubernetesID
+	}
+	url, err := url.Parse(kubernetesID)
+	if err != nil {
+		log.Errorln(fmt.Sprintf("Invalid disk name (%s): %v", kubernetesID, err))
+		return ""
+	}
+	if url.Scheme != "aws" {
+		log.Errorln(fmt.Sprintf("Invalid scheme for AWS volume (%s)", kubernetesID))
+		return ""
+	}
+	awsID := url.Path
+	awsID = strings.Trim(awsID, "/")
+
+	if !awsVolumeRegMatch.MatchString(awsID) {
+		log.Errorln(fmt.Sprintf("Invalid format for AWS volume (%s)", kubernetesID))
+		return ""
+	}
+
+	return awsID
+}
+
+// parseAWSEFSVolumeID returns the file system ID and the access point ID, empty for
+// the handles without one, of an EFS CSI volume handle.
+func parseAWSEFSVolumeID(k8sVolumeID string) (string, string, error) {
+	re := regexp.MustCompile(regexpEFSVolumeID)
+	matches := re.FindStringSubmatch(k8sVolumeID)
+	if matches == nil {
+		return "", "", fmt.Errorf("can't parse valid AWS EFS volumeID: %s", k8sVolumeID)
+	}
+	return matches[1], matches[3], nil
+}
+
+// efsVolumeID returns the volume ID of an EFS volume passed to the EFS tagger: the
+// file system ID, followed by the access point ID when the volume has one.
+func efsVolumeID(fileSystemID string, accessPointID string) string {
+	if accessPointID == "" {
+		return fileSystemID
+	}
+	return fileSystemID + "::" + accessPointID
+}
+
+// shouldReconcileTags decides whether an updated PVC's tags need to be reconciled against the
+// underlying cloud volume. It always reconciles when the PV was just bound (VolumeName newly
+// populated), since that may be the first opportunity to tag the volume even if the desired tags
+// themselves didn't change; otherwise it only reconciles when the desired tags actually differ.
+func shouldReconcileTags(oldPVC, newPVC *corev1.PersistentVolumeClaim, oldTags, newTags map[string]string) bool {
+	if oldPVC.Spec.VolumeName == "" && newPVC.Spec.VolumeName != "" {
+		return true
+	}
+	return !reflect.DeepEqual(oldTags, newTags)
+}
+
+// tagsAnnotation returns the name and the value of the tags annotation of the
+// annotations, the legacy one unless it was replaced or the prefix changed.
+func (t *Tagger) tagsAnnotation(annotations map[string]string) (string, string, bool) {
+	annotation := t.settings.AnnotationPrefix + "/tags"
+	if tagString, ok := annotations[annotation]; ok {
+		return annotation, tagString, true
+	}
+	if t.settings.AnnotationPrefix == DefaultAnnotationPrefix {
+		annotation = legacyAnnotationPrefix + "/tags"
+		if tagString, ok := annotations[annotation]; ok {
+			return annotation, tagString, true
+		}
+	}
+	return "", "", false
+}
+
+// validateTagsAnnotation checks the value of a tags annotation. It returns the problems
+// making buildTags skip tags, and warnings about the tags the clouds will change to fit
+// their constraints.
+func (t *Tagger) validateTagsAnnotation(annotation string, tagString string, clouds []string) ([]string, []string) {
+	var invalid, warnings []string
+	tags := map[string]string{}
+	if t.settings.TagFormat == "csv" {
+		var invalidPairs []string
+		tags, invalidPairs = parseCsv(tagString)
+		for _, s := range invalidPairs {
+			invalid = append(invalid, fmt.Sprintf("invalid csv key/value pair %q in %s annotation", s, annotation))
+		}
+	} else if err := json.Unmarshal([]byte(tagString), &tags); err != nil {
+		return []string{fmt.Sprintf("invalid JSON in %s annotation: %s", annotation, err)}, nil
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		if !isValidTagName(k) && !t.settings.AllowAllTags {
+			invalid = append(invalid, fmt.Sprintf("%s is a restricted tag", k))
+			delete(tags, k)
+			continue
+		}
+		if _, err := template.New("tag").Parse(tags[k]); err != nil {
+			invalid = append(invalid, fmt.Sprintf("invalid template in tag %s: %s", k, err))
+		}
+	}
+
+	for _, c := range clouds {
+		switch c {
+		case AZURE:
+			if _, err := sanitizeLabelsForAzure(tags); err != nil {
+				invalid = append(invalid, fmt.Sprintf("invalid Azure tags: %s", err))
+			}
+			for _, k := range slices.Sorted(maps.Keys(tags)) {
+				if sanitized := sanitizeKeyForAzure(k); sanitized != k {
+					warnings = append(warnings, fmt.Sprintf("tag %s is set as %s on Azure", k, sanitized))
+				}
+			}
+		case GCP:
+			if len(tags) > 64 {
+				warnings = append(warnings, "only 64 labels can be set on GCP, the others are dropped")
+			}
+			for _, k := range slices.Sorted(maps.Keys(tags)) {
+				if sanitized := sanitizeKeyForGCP(k); sanitized == "" {
+					warnings = append(warnings, fmt.Sprintf("tag %s is not a valid GCP label and is dropped", k))
+				} else if sanitized != k {
+					warnings = append(warnings, fmt.Sprintf("tag %s is set as %s on GCP", k, sanitized))
+				}
+				// templates are rendered before the value is sanitized
+				if v := tags[k]; !strings.Contains(v, "{{") && sanitizeValueForGCP(v) != v {
+					warnings = append(warnings, fmt.Sprintf("value of tag %s is set as %s on GCP", k, sanitizeValueForGCP(v)))
+				}
+			}
+		}
+	}
+	return invalid, warnings
+}
+
+// buildTags returns the rendered tags of the volume of the PVC and counts the ignored
+// PVCs and the restricted tags in the metrics.
+func (t *Tagger) buildTags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	return t.renderTagTemplates(pvc, t.mergedTags(pvc, true))
+}
+
+// mergedTags returns the tags of the volume of the PVC before their templates are
+// rendered. The ignored PVCs and the restricted tags are only counted in the metrics
+// when countMetrics is set, the admission webhook computes the tags of PVCs that may
+// never be created.
+func (t *Tagger) mergedTags(pvc *corev1.PersistentVolumeClaim, countMetrics bool) map[string]string {
+	tags := map[string]string{}
+	customTags := map[string]string{}
+	var tagString string
+	var legacyTagString string
+
+	annotations := pvc.GetAnnotations()
+	// Skip if the annotation says to ignore this PVC
+	if _, ok := annotations[t.settings.AnnotationPrefix+"/ignore"]; ok {
+		log.Debugln(t.settings.AnnotationPrefix + "/ignore annotation is set")
+		countIgnored(pvc, countMetrics)
+		return tags
+	}
+	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
+	if t.settings.AnnotationPrefix == DefaultAnnotationPrefix {
+		if _, ok := annotations[legacyAnnotationPrefix+"/ignore"]; ok {
+			log.Debugln(legacyAnnotationPrefix + "/ignore annotation is set")
+			countIgnored(pvc, countMetrics)
+			return tags
+		}
+	}
+
+	if t.storageClassIgnored(pvc) {
+		log.Debugln("StorageClass " + t.settings.AnnotationPrefix + "/ignore annotation is set")
+		countIgnored(pvc, countMetrics)
+		return tags
+	}
+
+	storageclass := storageClassName(pvc)
+	// Set the default tags
+	t.mergeAllowedTags(tags, t.settings.DefaultTags, storageclass, countMetrics)
+
+	// Merge the tags of the PVC's storage class
+	t.mergeAllowedTags(tags, t.storageClassTags(t.getPVCStorageClass(pvc)), storageclass, countMetrics)
+
+	// Merge the matching TaggingPolicies, from the lowest to the highest priority
+	for _, policy := range t.matchingTaggingPolicies(pvc) {
+		t.mergeAllowedTags(tags, policy.tags(pvc), storageclass, countMetrics)
+	}
+
+	// Merge the tags of the PVC's namespace
+	t.mergeAllowedTags(tags, t.namespaceTags(t.getNamespace(pvc.GetNamespace())), storageclass, countMetrics)
+
+	if len(t.settings.CopyLabels) > 0 {
+		copiedLabels := map[string]string{}
+		for k, v := range pvc.GetLabels() {
+			if t.settings.CopyLabels[0] == "*" || slices.Contains(t.settings.CopyLabels, k) {
+				copiedLabels[k] = v
+			}
+		}
+		t.mergeAllowedTags(tags, copiedLabels, storageclass, countMetrics)
+	}
+
+	if len(t.settings.CopyAnnotations) > 0 {
+		copiedAnnotations := map[string]string{}
+		for _, k := range t.settings.CopyAnnotations {
+			if v, ok := pvc.GetAnnotations()[k]; ok {
+				copiedAnnotations[k] = v
+			}
+		}
+		t.mergeAllowedTags(tags, copiedAnnotations, storageclass, countMetrics)
+	}
+
+	var legacyOk bool
+	tagString, ok := annotations[t.settings.AnnotationPrefix+"/tags"]
+	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
+	if t.settings.AnnotationPrefix == DefaultAnnotationPrefix {
+		legacyTagString, legacyOk = annotations[legacyAnnotationPrefix+"/tags"]
+	} else {
+		legacyOk = false
+		legacyTagString = ""
+	}
+	if !ok && !legacyOk {
+		log.Debugln("Does not have " + t.settings.AnnotationPrefix + "/tags or legacy " + legacyAnnotationPrefix + "/tags annotation")
+		return tags
+	} else if ok && legacyOk {
+		log.Warnln("Has both " + t.settings.AnnotationPrefix + "/tags AND legacy " + legacyAnnotationPrefix + "/tags annotation. Using newer " + t.settings.AnnotationPrefix + "/tags annotation")
+	} else if legacyOk && !ok {
+		tagString = legacyTagString
+	}
+	customTags = t.parseTags(tagString)
+	t.mergeAllowedTags(tags, customTags, storageclass, countMetrics)
+
+	return tags
+}
+
+// countIgnored counts the ignored PVC in the metrics when countMetrics is set
+func countIgnored(pvc *corev1.PersistentVolumeClaim, countMetrics bool) {
+	if !countMetrics {
+		return
+	}
+	promIgnoredTotal.With(prometheus.Labels{"storageclass": storageClassName(pvc)}).Inc()
+	promIgnoredLegacyTotal.Inc()
+}
+
+// mergeAllowedTags copies the tags of src into dst, skipping the restricted tags unless
+// all tags are allowed
+func (t *Tagger) mergeAllowedTags(dst map[string]string, src map[string]string, storageclass string, countMetrics bool) {
+	for k, v := range src {
+		if !isValidTagName(k) {
+			if !t.settings.AllowAllTags {
+				log.Warnln(k, "is a restricted tag. Skipping...")
+				if countMetrics {
+					promInvalidTagsTotal.With(prometheus.Labels{"storageclass": storageclass}).Inc()
+					promInvalidTagsLegacyTotal.Inc()
+				}
+				continue
+			} else {
+				log.Warnln(k, "is a restricted tag but still allowing it to be set...")
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func (t *Tagger) renderTagTemplates(pvc *corev1.PersistentVolumeClaim, tags map[string]string) map[string]string {
+	tplData := TagTemplate{
+		Name:        pvc.GetName(),
+		Namespace:   pvc.GetNamespace(),
+		Labels:      pvc.GetLabels(),
+		Annotations: pvc.GetAnnotations(),
+	}
+	if namespace := t.getNamespace(pvc.GetNamespace()); namespace != nil {
+		tplData.NamespaceLabels = namespace.GetLabels()
+		tplData.NamespaceAnnotations = namespace.GetAnnotations()
+	}
+
+	for k, v := range tags {
+		tmpl, err := template.New("tag").Parse(v)
+		if err != nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		err = tmpl.Execute(buf, tplData)
+		if err != nil {
+			continue
+		}
+		tags[k] = buf.String()
+	}
+
+	return tags
+}
+
+func isValidTagName(name string) bool {
+	if strings.HasPrefix(strings.ToLower(name), "kubernetes.io") {
+		return false
+	} else if strings.ToLower(name) == "name" {
+		return false
+	} else if strings.ToLower(name) == "kubernetescluster" {
+		return false
+	}
+
+	return true
+}
+
+func provisionedByAwsEfs(pvc *corev1.PersistentVolumeClaim) bool {
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+
+	provisionedBy, ok := getProvisionedBy(annotations)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
+		return false
+	}
+
+	if provisionedBy == AWS_EFS_CSI {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EFS_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByAwsEbs(pvc *corev1.PersistentVolumeClaim) bool {
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+
+	provisionedBy, ok := getProvisionedBy(annotations)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
+		return false
+	}
+
+	switch provisionedBy {
+	case AWS_EBS_LEGACY:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_LEGACY + " volume")
+		return true
+	case AWS_EBS_CSI:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_CSI + " volume")
+		return true
+	case AWS_EBS_CSI_AUTO:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(AWS_EBS_CSI_AUTO + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByAwsFsx(pvc *corev1.PersistentVolumeClaim) bool {
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+
+	provisionedBy, ok := getProvisionedBy(annotations)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
+		return false
+	}
+
+	switch provisionedBy {
+	case AWS_FSX_CSI, AWS_FSX_OPENZFS_CSI, AWS_FSX_ONTAP_TRIDENT:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(provisionedBy + " volume")
+		return true
+	}
+	return false
+}
+
+func provisionedByGcpPD(pvc *corev1.PersistentVolumeClaim) bool {
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+
+	provisionedBy, ok := getProvisionedBy(annotations)
+	if !ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("no volume.kubernetes.io/storage-provisioner annotation")
+		return false
+	}
+
+	switch provisionedBy {
+	case GCP_PD_LEGACY:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_PD_LEGACY + " volume")
+		return true
+	case GCP_PD_CSI:
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(GCP_PD_CSI + " volume")
+		return true
+	}
+	return false
+}
+
+func (t *Tagger) shouldIgnore(pvc *corev1.PersistentVolumeClaim) bool {
+	if t.storageClassIgnored(pvc) {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("StorageClass " + t.settings.AnnotationPrefix + "/ignore annotation is set")
+		promIgnoredTotal.With(prometheus.Labels{"storageclass": storageClassName(pvc)}).Inc()
+		promIgnoredLegacyTotal.Inc()
+		return true
+	}
+
+	annotations := pvc.GetAnnotations()
+	if annotations == nil {
+		return false
+	}
+
+	// Check if the annotation says to ignore this PVC
+	if _, ok := annotations[t.settings.AnnotationPrefix+"/ignore"]; ok {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(t.settings.AnnotationPrefix + "/ignore annotation is set")
+		promIgnoredTotal.With(prometheus.Labels{"storageclass": storageClassName(pvc)}).Inc()
+		promIgnoredLegacyTotal.Inc()
+		return true
+	}
+
+	// if the annotationPrefix has been changed, then we don't compare to the legacyAnnotationPrefix anymore
+	if t.settings.AnnotationPrefix == DefaultAnnotationPrefix {
+		if _, ok := annotations[legacyAnnotationPrefix+"/ignore"]; ok {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln(legacyAnnotationPrefix + "/ignore annotation is set")
+			promIgnoredTotal.With(prometheus.Labels{"storageclass": storageClassName(pvc)}).Inc()
+			promIgnoredLegacyTotal.Inc()
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Tagger) processPersistentVolumeClaim(pvc *corev1.PersistentVolumeClaim, pvLister corelisters.PersistentVolumeLister) (string, map[string]string, string, error) {
+	// Check for ignore annotation early and stop processing if found
+	if t.shouldIgnore(pvc) {
+		return "", nil, "", nil
+	}
+
+	tags := t.buildTags(pvc)
+
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "tags": tags}).Debugln("PVC Tags")
+
+	pv, err := pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Get PV from informer cache error:", err)
+		return "", nil, "", err
+	}
+
+	provisionedBy, ok := getProvisionedByFromPVCAndPV(pvc.GetAnnotations(), pv.GetAnnotations())
+	if !ok {
+		log.Errorf("cannot get provisioner annotation; checked keys: volume.kubernetes.io/storage-provisioner, volume.beta.kubernetes.io/storage-provisioner, pv.kubernetes.io/provisioned-by")
+		return "", nil, "", errors.New("cannot get provisioner annotation; checked keys: volume.kubernetes.io/storage-provisioner, volume.beta.kubernetes.io/storage-provisioner, pv.kubernetes.io/provisioned-by")
+	}
+
+	// the volume ID is parsed by the volume backend registered for the provisioner
+	volumeID, provisionedBy, err := backendVolumeID(provisionedBy, pv, t.getPVCStorageClass(pvc))
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Cannot parse VolumeID:", err)
+		return "", nil, "", fmt.Errorf("cannot parse VolumeID: %w", err)
+	}
+	if volumeID == "" {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Volume isn't supported by the backends of its provisioner, not tagging")
+		return "", nil, "", nil
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "volumeID": volumeID}).Debugln("parsed volumeID:", volumeID)
+
+	return volumeID, tags, provisionedBy, nil
+}
+
+func getProvisionedBy(annotations map[string]string) (string, bool) {
+	var provisionedBy string
+	provisionedBy, ok := annotations["volume.kubernetes.io/storage-provisioner"]
+	if !ok {
+		provisionedBy, ok = annotations["volume.beta.kubernetes.io/storage-provisioner"]
+	}
+
+	return provisionedBy, ok
+}
+
+func getProvisionedByFromPVCAndPV(pvcAnnotations map[string]string, pvAnnotations map[string]string) (string, bool) {
+	provisionedBy, ok := getProvisionedBy(pvcAnnotations)
+	if ok {
+		return provisionedBy, true
+	}
+
+	if pvAnnotations != nil {
+		provisionedBy, ok = pvAnnotations["pv.kubernetes.io/provisioned-by"]
+	}
+
+	return provisionedBy, ok
+}
+
+func getPVC(obj interface{}) *corev1.PersistentVolumeClaim {
+	pvc := obj.(*corev1.PersistentVolumeClaim)
+
+	// https://kubernetes.io/docs/reference/labels-annotations-taints/#volume-beta-kubernetes-io-storage-class-deprecated
+	// The "volume.beta.kubernetes.io/storage-class" annotation is deprecated but can be used
+	// to specify the name of StorageClass in PVC. When both storageClassName attribute and
+	// volume.beta.kubernetes.io/storage-class annotation are specified, the annotation
+	// volume.beta.kubernetes.io/storage-class takes precedence over the storageClassName attribute.
+	storageClassName, ok := pvc.GetAnnotations()["volume.beta.kubernetes.io/storage-class"]
+	if ok {
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+
+	return pvc
+}
+
+// getGCPVolumeID extracts the GCP volume ID from a PersistentVolume.
+// For GCP volumes, this will either be in CSI format or GCEPersistentDisk format.
+func getGCPVolumeID(pv *corev1.PersistentVolume) string {
+	if pv == nil {
+		return ""
+	}
+
+	// In the Kubernetes API, PersistentVolumeSource is designed so that
+	// exactly one of its fields is non-nil to indicate the volume type.
+
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.VolumeHandle
+	}
+
+	if pv.Spec.GCEPersistentDisk != nil {
+		return pv.Spec.GCEPersistentDisk.PDName
+	}
+
+	return ""
+}
@@ -16,19 +16,53 @@
 // specific language governing permissions and limitations
 // under the License.
 
-package main
+package tagger
 
 import (
 	"reflect"
+	"slices"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 var dummyStorageClassName string = "fakeName"
 
+func setTestNamespaces(t *testing.T, tg *Tagger, namespaces ...*corev1.Namespace) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		if err := indexer.Add(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tg.namespaceLister = corelisters.NewNamespaceLister(indexer)
+}
+
+func setTestStorageClasses(t *testing.T, tg *Tagger, storageClasses ...*storagev1.StorageClass) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, sc := range storageClasses {
+		if err := indexer.Add(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tg.storageClassLister = storagelisters.NewStorageClassLister(indexer)
+}
+
+func newTestPVLister(t *testing.T, pvs ...*corev1.PersistentVolume) corelisters.PersistentVolumeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pv := range pvs {
+		if err := indexer.Add(pv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return corelisters.NewPersistentVolumeLister(indexer)
+}
+
 func Test_parseAWSEBSVolumeID(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -72,40 +106,82 @@ func Test_parseAWSEBSVolumeID(t *testing.T) {
 
 func Test_parseAWSEFSVolumeID(t *testing.T) {
 	tests := []struct {
-		name        string
-		k8sVolumeID string
-		want        string
+		name              string
+		k8sVolumeID       string
+		wantFileSystemID  string
+		wantAccessPointID string
+		wantErr           bool
 	}{
 		{
-			name:        "full AWS-EFS.VolumeID",
-			k8sVolumeID: "fs-05b82f747004ac501::fsap-06cc098e562d24942",
-			want:        "fsap-06cc098e562d24942",
+			name:              "full AWS-EFS.VolumeID",
+			k8sVolumeID:       "fs-05b82f747004ac501::fsap-06cc098e562d24942",
+			wantFileSystemID:  "fs-05b82f747004ac501",
+			wantAccessPointID: "fsap-06cc098e562d24942",
 		},
 		{
-			name:        "full AWS-EFS.VolumeID - with efs:",
-			k8sVolumeID: "efs:fs-05b82f747004ac501::fsap-06cc098e562d24942",
-			want:        "fsap-06cc098e562d24942",
+			name:              "full AWS-EFS.VolumeID - with efs:",
+			k8sVolumeID:       "efs:fs-05b82f747004ac501::fsap-06cc098e562d24942",
+			wantFileSystemID:  "fs-05b82f747004ac501",
+			wantAccessPointID: "fsap-06cc098e562d24942",
+		},
+		{
+			name:             "file system AWS-EFS.VolumeID",
+			k8sVolumeID:      "fs-05b82f747004ac501",
+			wantFileSystemID: "fs-05b82f747004ac501",
+		},
+		{
+			name:             "file system AWS-EFS.VolumeID - with efs:",
+			k8sVolumeID:      "efs:fs-05b82f747004ac501",
+			wantFileSystemID: "fs-05b82f747004ac501",
+		},
+		{
+			name:             "file system AWS-EFS.VolumeID with a subpath",
+			k8sVolumeID:      "fs-05b82f747004ac501:/data/dir1",
+			wantFileSystemID: "fs-05b82f747004ac501",
+		},
+		{
+			name:              "access point AWS-EFS.VolumeID with a subpath",
+			k8sVolumeID:       "fs-05b82f747004ac501:/data:fsap-06cc098e562d24942",
+			wantFileSystemID:  "fs-05b82f747004ac501",
+			wantAccessPointID: "fsap-06cc098e562d24942",
 		},
 		{
 			name:        "invalid AWS-EFS.VolumeID",
 			k8sVolumeID: "fsp-05b82f747004ac501::fsap-06cc098e562d24942",
-			want:        "",
+			wantErr:     true,
 		},
 		{
 			name:        "invalid AWS-EFS.VolumeID with efs:",
 			k8sVolumeID: "efs:fsp-05b82f747004ac501::fsap-06cc098e562d24942",
-			want:        "",
+			wantErr:     true,
+		},
+		{
+			name:        "invalid access point AWS-EFS.VolumeID",
+			k8sVolumeID: "fs-05b82f747004ac501::fsp-06cc098e562d24942",
+			wantErr:     true,
 		},
 		{
 			name:        "partial AWS-EFS.VolumeID",
 			k8sVolumeID: "fsap-06cc098e562d24942",
-			want:        "",
+			wantErr:     true,
+		},
+		{
+			name:        "empty AWS-EFS.VolumeID",
+			k8sVolumeID: "",
+			wantErr:     true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := parseAWSEFSVolumeID(tt.k8sVolumeID); got != tt.want {
-				t.Errorf("parseAWSEFSVolumeID() = %v, want %v", got, tt.want)
+			fileSystemID, accessPointID, err := parseAWSEFSVolumeID(tt.k8sVolumeID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAWSEFSVolumeID() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fileSystemID != tt.wantFileSystemID {
+				t.Errorf("parseAWSEFSVolumeID() fileSystemID = %v, want %v", fileSystemID, tt.wantFileSystemID)
+			}
+			if accessPointID != tt.wantAccessPointID {
+				t.Errorf("parseAWSEFSVolumeID() accessPointID = %v, want %v", accessPointID, tt.wantAccessPointID)
 			}
 		})
 	}
@@ -279,6 +355,16 @@ func Test_provisionedByAwsFsx(t *testing.T) {
 			annotations: map[string]string{"volume.kubernetes.io/storage-provisioner": "something else"},
 			want:        false,
 		},
+		{
+			name:        "valid provisioner fsx.openzfs.csi.aws.com",
+			annotations: map[string]string{"volume.kubernetes.io/storage-provisioner": AWS_FSX_OPENZFS_CSI},
+			want:        true,
+		},
+		{
+			name:        "valid provisioner csi.trident.netapp.io",
+			annotations: map[string]string{"volume.kubernetes.io/storage-provisioner": AWS_FSX_ONTAP_TRIDENT},
+			want:        true,
+		},
 		{
 			name:        "valid provisioner fsx.csi.aws.com legacy annotation",
 			annotations: map[string]string{"volume.beta.kubernetes.io/storage-provisioner": AWS_FSX_CSI},
@@ -299,7 +385,7 @@ func Test_provisionedByAwsFsx(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			pvc.SetAnnotations(tt.annotations)
 			if got := provisionedByAwsFsx(pvc); got != tt.want {
-				t.Errorf("provisionedByAwsEfs() = %v, want %v", got, tt.want)
+				t.Errorf("provisionedByAwsFsx() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -698,24 +784,216 @@ func Test_buildTags(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			pvc.SetAnnotations(tt.annotations)
 			pvc.SetLabels(tt.pvcLabels)
-			defaultTags = tt.defaultTags
-			allowAllTags = tt.allowAllTags
+			tg := newTestTagger()
+			tg.settings.DefaultTags = tt.defaultTags
+			tg.settings.AllowAllTags = tt.allowAllTags
 			if tt.tagFormat != "" {
-				tagFormat = tt.tagFormat
-			} else {
-				tagFormat = "json"
+				tg.settings.TagFormat = tt.tagFormat
 			}
-			if tt.copyLabels != nil {
-				copyLabels = tt.copyLabels
+			tg.settings.CopyLabels = tt.copyLabels
+			tg.settings.CopyAnnotations = tt.copyAnnotations
+			if got := tg.buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
-			if tt.copyAnnotations != nil {
-				copyAnnotations = tt.copyAnnotations
+		})
+	}
+}
+
+func Test_buildTags_storageClass(t *testing.T) {
+	tests := []struct {
+		name                    string
+		defaultTags             map[string]string
+		storageClassAnnotations map[string]string
+		namespaceAnnotations    map[string]string
+		annotations             map[string]string
+		want                    map[string]string
+		wantIgnored             bool
+	}{
+		{
+			name:                    "storage class tags annotation",
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"fast\"}"},
+			want:                    map[string]string{"tier": "fast"},
+		},
+		{
+			name:                    "storage class overwrites the default tags",
+			defaultTags:             map[string]string{"tier": "default", "foo": "bar"},
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"fast\"}"},
+			want:                    map[string]string{"tier": "fast", "foo": "bar"},
+		},
+		{
+			name:                    "namespace overwrites the storage class",
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"fast\", \"backup\": \"true\"}"},
+			namespaceAnnotations:    map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"slow\"}"},
+			want:                    map[string]string{"tier": "slow", "backup": "true"},
+		},
+		{
+			name:                    "PVC annotation overwrites the storage class",
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"fast\"}"},
+			annotations:             map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"slow\"}"},
+			want:                    map[string]string{"tier": "slow"},
+		},
+		{
+			name:                    "restricted storage class tags are skipped",
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"Name\": \"foo\", \"tier\": \"fast\"}"},
+			want:                    map[string]string{"tier": "fast"},
+		},
+		{
+			name:                    "storage class ignore annotation",
+			defaultTags:             map[string]string{"foo": "bar"},
+			storageClassAnnotations: map[string]string{"k8s-pvc-tagger/ignore": "", "k8s-pvc-tagger/tags": "{\"tier\": \"fast\"}"},
+			annotations:             map[string]string{"k8s-pvc-tagger/tags": "{\"tier\": \"slow\"}"},
+			want:                    map[string]string{},
+			wantIgnored:             true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			tg.settings.DefaultTags = tt.defaultTags
+			setTestStorageClasses(t, tg, &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{
+				Name:        dummyStorageClassName,
+				Annotations: tt.storageClassAnnotations,
+			}})
+			setTestNamespaces(t, tg, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "my-namespace",
+				Annotations: tt.namespaceAnnotations,
+			}})
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetNamespace("my-namespace")
+			pvc.SetAnnotations(tt.annotations)
+			pvc.Spec.StorageClassName = &dummyStorageClassName
+
+			if got := tg.buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+			if got := tg.shouldIgnore(pvc); got != tt.wantIgnored {
+				t.Errorf("shouldIgnore() = %v, want %v", got, tt.wantIgnored)
+			}
+		})
+	}
+}
+
+func Test_buildTags_namespace(t *testing.T) {
+	tests := []struct {
+		name                 string
+		defaultTags          map[string]string
+		copyNamespaceLabels  []string
+		namespaceLabels      map[string]string
+		namespaceAnnotations map[string]string
+		annotations          map[string]string
+		tagFormat            string
+		want                 map[string]string
+	}{
+		{
+			name:                 "namespace tags annotation",
+			namespaceAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"cost-center\": \"1234\"}"},
+			want:                 map[string]string{"cost-center": "1234"},
+		},
+		{
+			name:                 "namespace tags annotation in csv",
+			namespaceAnnotations: map[string]string{"k8s-pvc-tagger/tags": "cost-center=1234,team=a"},
+			tagFormat:            "csv",
+			want:                 map[string]string{"cost-center": "1234", "team": "a"},
+		},
+		{
+			name:                "copied namespace labels",
+			copyNamespaceLabels: []string{"cost-center"},
+			namespaceLabels:     map[string]string{"cost-center": "1234", "team": "a"},
+			want:                map[string]string{"cost-center": "1234"},
+		},
+		{
+			name:                "all namespace labels copied except the restricted ones",
+			copyNamespaceLabels: []string{"*"},
+			namespaceLabels:     map[string]string{"cost-center": "1234", "kubernetes.io/metadata.name": "my-namespace"},
+			want:                map[string]string{"cost-center": "1234"},
+		},
+		{
+			name:                 "namespace overwrites the default tags",
+			defaultTags:          map[string]string{"cost-center": "default", "foo": "bar"},
+			namespaceAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"cost-center\": \"1234\"}"},
+			want:                 map[string]string{"cost-center": "1234", "foo": "bar"},
+		},
+		{
+			name:                 "PVC annotation overwrites the namespace",
+			copyNamespaceLabels:  []string{"team"},
+			namespaceLabels:      map[string]string{"team": "a"},
+			namespaceAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"cost-center\": \"1234\"}"},
+			annotations:          map[string]string{"k8s-pvc-tagger/tags": "{\"cost-center\": \"5678\"}"},
+			want:                 map[string]string{"cost-center": "5678", "team": "a"},
+		},
+		{
+			name:                 "namespace template",
+			namespaceLabels:      map[string]string{"team": "a"},
+			namespaceAnnotations: map[string]string{"k8s-pvc-tagger/tags": "{\"owner\": \"{{ .NamespaceLabels.team }}-{{ .Name }}\"}"},
+			want:                 map[string]string{"owner": "a-my-pvc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			tg.settings.DefaultTags = tt.defaultTags
+			tg.settings.CopyNamespaceLabels = tt.copyNamespaceLabels
+			if tt.tagFormat != "" {
+				tg.settings.TagFormat = tt.tagFormat
 			}
-			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+			setTestNamespaces(t, tg, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "my-namespace",
+				Labels:      tt.namespaceLabels,
+				Annotations: tt.namespaceAnnotations,
+			}})
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetNamespace("my-namespace")
+			pvc.SetAnnotations(tt.annotations)
+			pvc.Spec.StorageClassName = &dummyStorageClassName
+
+			if got := tg.buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
-			tagFormat = "json"
-			defaultTags = map[string]string{}
+		})
+	}
+}
+
+func Test_shouldReconcileNamespace(t *testing.T) {
+	tests := []struct {
+		name         string
+		oldNamespace corev1.Namespace
+		newNamespace corev1.Namespace
+		want         bool
+	}{
+		{
+			name:         "same ResourceVersion",
+			oldNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}},
+			newNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1", Labels: map[string]string{"team": "a"}}},
+			want:         false,
+		},
+		{
+			name:         "labels changed",
+			oldNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1", Labels: map[string]string{"team": "a"}}},
+			newNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2", Labels: map[string]string{"team": "b"}}},
+			want:         true,
+		},
+		{
+			name:         "annotations changed",
+			oldNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}},
+			newNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2", Annotations: map[string]string{"k8s-pvc-tagger/tags": "{}"}}},
+			want:         true,
+		},
+		{
+			name:         "status changed",
+			oldNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}},
+			newNamespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}, Status: corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating}},
+			want:         false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldReconcileNamespace(&tt.oldNamespace, &tt.newNamespace); got != tt.want {
+				t.Errorf("shouldReconcileNamespace() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
@@ -723,7 +1001,6 @@ func Test_buildTags(t *testing.T) {
 func Test_annotationPrefix(t *testing.T) {
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
-	defaultAnnotationPrefix := annotationPrefix
 	pvc.Spec.StorageClassName = &dummyStorageClassName
 
 	tests := []struct {
@@ -779,13 +1056,12 @@ func Test_annotationPrefix(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			pvc.SetAnnotations(tt.annotations)
-			annotationPrefix = tt.annotationPrefix
-			defaultTags = tt.defaultTags
-			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+			tg := newTestTagger()
+			tg.settings.AnnotationPrefix = tt.annotationPrefix
+			tg.settings.DefaultTags = tt.defaultTags
+			if got := tg.buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
-			annotationPrefix = defaultAnnotationPrefix
-			defaultTags = map[string]string{}
 		})
 	}
 }
@@ -846,6 +1122,219 @@ func Test_shouldReconcileTags(t *testing.T) {
 	}
 }
 
+func Test_diffTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		currentTags map[string]string
+		desiredTags map[string]string
+		want        map[string]string
+	}{
+		{
+			name:        "in sync",
+			currentTags: map[string]string{"foo": "bar"},
+			desiredTags: map[string]string{"foo": "bar"},
+			want:        map[string]string{},
+		},
+		{
+			name:        "missing tag",
+			currentTags: map[string]string{"foo": "bar"},
+			desiredTags: map[string]string{"foo": "bar", "me": "touge"},
+			want:        map[string]string{"me": "touge"},
+		},
+		{
+			name:        "drifted value",
+			currentTags: map[string]string{"foo": "baz", "me": "touge"},
+			desiredTags: map[string]string{"foo": "bar", "me": "touge"},
+			want:        map[string]string{"foo": "bar"},
+		},
+		{
+			name:        "extra tags on the volume are left alone",
+			currentTags: map[string]string{"foo": "bar", "other": "tool"},
+			desiredTags: map[string]string{"foo": "bar"},
+			want:        map[string]string{},
+		},
+		{
+			name:        "no current tags",
+			currentTags: nil,
+			desiredTags: map[string]string{"foo": "bar"},
+			want:        map[string]string{"foo": "bar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffTags(tt.currentTags, tt.desiredTags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_formatTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		tagFormat   string
+		tags        map[string]string
+		want        string
+		wantSkipped []string
+	}{
+		{
+			name:      "json",
+			tagFormat: "json",
+			tags:      map[string]string{"me": "touge", "foo": "bar,baz"},
+			want:      "{\"foo\":\"bar,baz\",\"me\":\"touge\"}",
+		},
+		{
+			name:      "csv",
+			tagFormat: "csv",
+			tags:      map[string]string{"me": "touge", "foo": "bar"},
+			want:      "foo=bar,me=touge",
+		},
+		{
+			name:        "csv skipped tags",
+			tagFormat:   "csv",
+			tags:        map[string]string{"me": "touge", "foo": "bar,baz", "a=b": "c", "empty": ""},
+			want:        "me=touge",
+			wantSkipped: []string{"a=b", "empty", "foo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			tg.settings.TagFormat = tt.tagFormat
+
+			got, skipped := tg.formatTags(tt.tags)
+			if got != tt.want {
+				t.Errorf("formatTags() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("formatTags() skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+			want := map[string]string{}
+			for k, v := range tt.tags {
+				if !slices.Contains(skipped, k) {
+					want[k] = v
+				}
+			}
+			if parsed := tg.parseTags(got); !reflect.DeepEqual(parsed, want) {
+				t.Errorf("parseTags(formatTags()) = %v, want %v", parsed, want)
+			}
+		})
+	}
+}
+
+func Test_shouldReconcilePersistentVolume(t *testing.T) {
+	claimRef := &corev1.ObjectReference{Namespace: "my-namespace", Name: "my-pvc", UID: "1234"}
+	tests := []struct {
+		name  string
+		oldPV corev1.PersistentVolume
+		newPV corev1.PersistentVolume
+		want  bool
+	}{
+		{
+			name:  "same ResourceVersion",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			want:  false,
+		},
+		{
+			name:  "no claimRef",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}},
+			want:  false,
+		},
+		{
+			name:  "static PV bound to a claim",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			want:  true,
+		},
+		{
+			name:  "PV rebound to a different claim",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: &corev1.ObjectReference{Namespace: "my-namespace", Name: "other-pvc", UID: "5678"}}},
+			want:  true,
+		},
+		{
+			name:  "PV became bound",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}, Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeAvailable}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}, Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeBound}},
+			want:  true,
+		},
+		{
+			name:  "PV annotations changed",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2", Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": AWS_EBS_CSI}}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			want:  true,
+		},
+		{
+			name:  "managed tags recorded",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2", Annotations: map[string]string{DefaultAnnotationPrefix + "/managed-tags": "[\"foo\"]"}}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}},
+			want:  false,
+		},
+		{
+			name:  "unrelated PV status change",
+			oldPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}, Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeBound}},
+			newPV: corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"}, Spec: corev1.PersistentVolumeSpec{ClaimRef: claimRef}, Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeReleased}},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTestTagger().shouldReconcilePersistentVolume(&tt.oldPV, &tt.newPV); got != tt.want {
+				t.Errorf("shouldReconcilePersistentVolume() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pvcEventHandlers_update(t *testing.T) {
+	// a PVC bound to a pre-provisioned PV can have no storage class
+	oldPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-pvc",
+			Namespace:       "my-namespace",
+			ResourceVersion: "1",
+			Annotations:     map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"bar\"}"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pvc-1234"},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        int
+	}{
+		{
+			name:        "tags changed",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"baz\"}"},
+			want:        1,
+		},
+		{
+			name:        "ignore annotation added",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"bar\"}", DefaultAnnotationPrefix + "/ignore": ""},
+			want:        1,
+		},
+		{
+			name:        "tags unchanged",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"bar\"}"},
+			want:        0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestPVCController(t, nil, nil)
+			newPVC := oldPVC.DeepCopy()
+			newPVC.ResourceVersion = "2"
+			newPVC.SetAnnotations(tt.annotations)
+
+			c.tagger.withSettingsReadLock(c.tagger.pvcEventHandlers(c)).UpdateFunc(oldPVC.DeepCopy(), newPVC)
+			if got := c.queue.Len(); got != tt.want {
+				t.Errorf("queue length = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_getProvisionedByFromPVCAndPV(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -996,7 +1485,7 @@ func Test_processEBSPersistentVolumeClaim(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			pvcAnnotations := map[string]string{
-				annotationPrefix + "/tags": tt.tagsAnnotation,
+				DefaultAnnotationPrefix + "/tags": tt.tagsAnnotation,
 			}
 			if !tt.provisionerOnPVOnly {
 				pvcAnnotations["volume.kubernetes.io/storage-provisioner"] = tt.provisionedBy
@@ -1034,8 +1523,7 @@ func Test_processEBSPersistentVolumeClaim(t *testing.T) {
 				},
 				Spec: pvSpec,
 			}
-			k8sClient = fake.NewSimpleClientset(pv)
-			volumeID, tags, provisionedBy, err := processPersistentVolumeClaim(pvc)
+			volumeID, tags, provisionedBy, err := newTestTagger().processPersistentVolumeClaim(pvc, newTestPVLister(t, pv))
 			if (err == nil) == tt.wantedErr {
 				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
 			}
@@ -1076,7 +1564,7 @@ func Test_processEFSPersistentVolumeClaim(t *testing.T) {
 			volumeName:     volumeName,
 			volumeID:       "fs-05b82f74723423::fsap-06cc098e562d23425",
 			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "fsap-06cc098e562d23425",
+			wantedVolumeID: "fs-05b82f74723423::fsap-06cc098e562d23425",
 			wantedErr:      false,
 		},
 		{
@@ -1086,7 +1574,7 @@ func Test_processEFSPersistentVolumeClaim(t *testing.T) {
 			volumeName:     volumeName,
 			volumeID:       "efs:fs-05b82f74723423::fsap-06cc098e562d23425",
 			wantedTags:     map[string]string{"foo": "bar"},
-			wantedVolumeID: "fsap-06cc098e562d23425",
+			wantedVolumeID: "fs-05b82f74723423::fsap-06cc098e562d23425",
 			wantedErr:      false,
 		},
 		{
@@ -1097,9 +1585,19 @@ func Test_processEFSPersistentVolumeClaim(t *testing.T) {
 			volumeID:            "fs-05b82f74723423::fsap-06cc098e562d23425",
 			provisionerOnPVOnly: true,
 			wantedTags:          map[string]string{"foo": "bar"},
-			wantedVolumeID:      "fsap-06cc098e562d23425",
+			wantedVolumeID:      "fs-05b82f74723423::fsap-06cc098e562d23425",
 			wantedErr:           false,
 		},
+		{
+			name:           "csi with valid tags and file system volume id with a subpath",
+			provisionedBy:  AWS_EFS_CSI,
+			tagsAnnotation: "{\"foo\": \"bar\"}",
+			volumeName:     volumeName,
+			volumeID:       "fs-05b82f74723423:/data",
+			wantedTags:     map[string]string{"foo": "bar"},
+			wantedVolumeID: "fs-05b82f74723423",
+			wantedErr:      false,
+		},
 		{
 			name:           "csi with valid tags and invalid volume id",
 			provisionedBy:  AWS_EFS_CSI,
@@ -1133,7 +1631,7 @@ func Test_processEFSPersistentVolumeClaim(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			pvcAnnotations := map[string]string{
-				annotationPrefix + "/tags": tt.tagsAnnotation,
+				DefaultAnnotationPrefix + "/tags": tt.tagsAnnotation,
 			}
 			if !tt.provisionerOnPVOnly {
 				pvcAnnotations["volume.kubernetes.io/storage-provisioner"] = tt.provisionedBy
@@ -1161,8 +1659,7 @@ func Test_processEFSPersistentVolumeClaim(t *testing.T) {
 				},
 				Spec: pvSpec,
 			}
-			k8sClient = fake.NewSimpleClientset(pv)
-			volumeID, tags, provisionedBy, err := processPersistentVolumeClaim(pvc)
+			volumeID, tags, provisionedBy, err := newTestTagger().processPersistentVolumeClaim(pvc, newTestPVLister(t, pv))
 			if (err == nil) == tt.wantedErr {
 				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
 			}
@@ -1183,20 +1680,20 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 	const volumeName = "pvc-1234"
 
 	tests := []struct {
-		name           string
-		pvcAnnotations map[string]string
-		pvAnnotations  map[string]string
-		pvSource       corev1.PersistentVolumeSource
-		pvName         string
-		wantedVolumeID string
-		wantedTags     map[string]string
+		name              string
+		pvcAnnotations    map[string]string
+		pvAnnotations     map[string]string
+		pvSource          corev1.PersistentVolumeSource
+		pvName            string
+		wantedVolumeID    string
+		wantedTags        map[string]string
 		wantedProvisioner string
-		wantedErr      bool
+		wantedErr         bool
 	}{
 		{
 			name: "csi provisioner with csi volume source",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
 			},
 			pvSource: corev1.PersistentVolumeSource{
@@ -1211,7 +1708,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 		{
 			name: "csi provisioner on PV only",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags": "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags": "{\"foo\": \"bar\"}",
 			},
 			pvAnnotations: map[string]string{
 				"pv.kubernetes.io/provisioned-by": GCP_PD_CSI,
@@ -1229,7 +1726,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 		{
 			name: "legacy in-tree provisioner with legacy in-tree volume source",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": GCP_PD_LEGACY,
 			},
 			pvSource: corev1.PersistentVolumeSource{
@@ -1244,7 +1741,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 		{
 			name: "legacy in-tree provisioner with empty PD name",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": GCP_PD_LEGACY,
 			},
 			pvSource: corev1.PersistentVolumeSource{
@@ -1260,7 +1757,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 		{
 			name: "unknown provisioner",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": "foo",
 			},
 			pvSource:       corev1.PersistentVolumeSource{},
@@ -1272,7 +1769,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 		{
 			name: "Missing PV",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": GCP_PD_LEGACY,
 			},
 			pvSource: corev1.PersistentVolumeSource{
@@ -1291,7 +1788,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 			// PVC is annotated with CSI provisioner, but the PV has GCE PD source
 			name: "CSI provisioner but legacy in-tree PD volume source (migration case)",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": GCP_PD_CSI,
 			},
 			pvSource: corev1.PersistentVolumeSource{
@@ -1308,7 +1805,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 			// This case is unlikely and perhaps impossible, but we cover it just in case.
 			name: "Legacy in-tree provisioner but CSI volume source (migration case)",
 			pvcAnnotations: map[string]string{
-				annotationPrefix + "/tags":                 "{\"foo\": \"bar\"}",
+				DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
 				"volume.kubernetes.io/storage-provisioner": GCP_PD_LEGACY,
 			},
 			pvSource: corev1.PersistentVolumeSource{
@@ -1347,8 +1844,7 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 				},
 			}
 
-			k8sClient = fake.NewSimpleClientset(pv)
-			volumeID, tags, provisionedBy, err := processPersistentVolumeClaim(pvc)
+			volumeID, tags, provisionedBy, err := newTestTagger().processPersistentVolumeClaim(pvc, newTestPVLister(t, pv))
 
 			if (err == nil) == tt.wantedErr {
 				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
@@ -1366,6 +1862,213 @@ func Test_processGCPPDPersistentVolumeClaim(t *testing.T) {
 	}
 }
 
+func Test_processFSxPersistentVolumeClaim(t *testing.T) {
+	const volumeName = "pvc-1234"
+
+	tests := []struct {
+		name           string
+		provisionedBy  string
+		pvSource       corev1.PersistentVolumeSource
+		wantedVolumeID string
+		wantedErr      bool
+	}{
+		{
+			name:          "lustre file system",
+			provisionedBy: AWS_FSX_CSI,
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "fs-0123456789abcdef0"},
+			},
+			wantedVolumeID: "fs-0123456789abcdef0",
+		},
+		{
+			name:          "openzfs volume",
+			provisionedBy: AWS_FSX_OPENZFS_CSI,
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "fsvol-0123456789abcdef0"},
+			},
+			wantedVolumeID: "fsvol-0123456789abcdef0",
+		},
+		{
+			name:          "ontap trident volume",
+			provisionedBy: AWS_FSX_ONTAP_TRIDENT,
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle:     volumeName,
+					VolumeAttributes: map[string]string{"internalName": "trident_pvc_1234"},
+				},
+			},
+			wantedVolumeID: "trident_pvc_1234",
+		},
+		{
+			name:          "ontap trident volume without internal name",
+			provisionedBy: AWS_FSX_ONTAP_TRIDENT,
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: volumeName},
+			},
+			wantedErr: true,
+		},
+		{
+			name:          "lustre without csi volume source",
+			provisionedBy: AWS_FSX_CSI,
+			pvSource:      corev1.PersistentVolumeSource{},
+			wantedErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "my-pvc",
+					Annotations: map[string]string{
+						DefaultAnnotationPrefix + "/tags":          "{\"foo\": \"bar\"}",
+						"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
+					},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					StorageClassName: &dummyStorageClassName,
+					VolumeName:       volumeName,
+				},
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: volumeName},
+				Spec: corev1.PersistentVolumeSpec{
+					StorageClassName:       dummyStorageClassName,
+					PersistentVolumeSource: tt.pvSource,
+				},
+			}
+			tg := newTestTagger()
+			setTestStorageClasses(t, tg, &storagev1.StorageClass{
+				ObjectMeta:  metav1.ObjectMeta{Name: dummyStorageClassName},
+				Provisioner: tt.provisionedBy,
+				Parameters:  map[string]string{"backendType": "ontap-nas"},
+			})
+
+			volumeID, _, _, err := tg.processPersistentVolumeClaim(pvc, newTestPVLister(t, pv))
+			if (err != nil) != tt.wantedErr {
+				t.Errorf("processPersistentVolumeClaim() err = %v, wantedErr %v", err, tt.wantedErr)
+			}
+			if volumeID != tt.wantedVolumeID {
+				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			}
+		})
+	}
+}
+
+func Test_processAzurePersistentVolumeClaim(t *testing.T) {
+	const volumeName = "pvc-1234"
+
+	tests := []struct {
+		name              string
+		provisionedBy     string
+		backendType       string
+		pvSource          corev1.PersistentVolumeSource
+		wantedVolumeID    string
+		wantProvisionedBy string
+	}{
+		{
+			name:          "azure files volume",
+			provisionedBy: AZURE_FILE_CSI,
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "rg#account#share#"},
+			},
+			wantedVolumeID:    "rg#account#share#",
+			wantProvisionedBy: AZURE_FILE_CSI,
+		},
+		{
+			name:          "azure netapp files trident volume",
+			provisionedBy: AWS_FSX_ONTAP_TRIDENT,
+			backendType:   "azure-netapp-files",
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle:     volumeName,
+					VolumeAttributes: map[string]string{"internalName": "trident_pvc_1234"},
+				},
+			},
+			wantedVolumeID:    volumeName,
+			wantProvisionedBy: AZURE_NETAPP_TRIDENT,
+		},
+		{
+			name:          "ontap nas trident volume",
+			provisionedBy: AWS_FSX_ONTAP_TRIDENT,
+			backendType:   "ontap-nas",
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle:     volumeName,
+					VolumeAttributes: map[string]string{"internalName": "trident_pvc_1234"},
+				},
+			},
+			wantedVolumeID:    "trident_pvc_1234",
+			wantProvisionedBy: AWS_FSX_ONTAP_TRIDENT,
+		},
+		{
+			name:          "ontap san trident volume",
+			provisionedBy: AWS_FSX_ONTAP_TRIDENT,
+			backendType:   "ontap-san",
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle:     volumeName,
+					VolumeAttributes: map[string]string{"internalName": "trident_pvc_1234"},
+				},
+			},
+			wantedVolumeID:    "trident_pvc_1234",
+			wantProvisionedBy: AWS_FSX_ONTAP_TRIDENT,
+		},
+		{
+			name:          "unsupported trident backend",
+			provisionedBy: AWS_FSX_ONTAP_TRIDENT,
+			backendType:   "google-cloud-netapp-volumes",
+			pvSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					VolumeHandle:     volumeName,
+					VolumeAttributes: map[string]string{"internalName": "trident_pvc_1234"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "my-pvc",
+					Annotations: map[string]string{
+						"volume.kubernetes.io/storage-provisioner": tt.provisionedBy,
+					},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					StorageClassName: &dummyStorageClassName,
+					VolumeName:       volumeName,
+				},
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: volumeName},
+				Spec: corev1.PersistentVolumeSpec{
+					StorageClassName:       dummyStorageClassName,
+					PersistentVolumeSource: tt.pvSource,
+				},
+			}
+			tg := newTestTagger()
+			setTestStorageClasses(t, tg, &storagev1.StorageClass{
+				ObjectMeta:  metav1.ObjectMeta{Name: dummyStorageClassName},
+				Provisioner: tt.provisionedBy,
+				Parameters:  map[string]string{"backendType": tt.backendType},
+			})
+
+			volumeID, _, provisionedBy, err := tg.processPersistentVolumeClaim(pvc, newTestPVLister(t, pv))
+			if err != nil {
+				t.Fatalf("processPersistentVolumeClaim() err = %v", err)
+			}
+			if volumeID != tt.wantedVolumeID {
+				t.Errorf("processPersistentVolumeClaim() volumeID = %v, want %v", volumeID, tt.wantedVolumeID)
+			}
+			if provisionedBy != tt.wantProvisionedBy {
+				t.Errorf("processPersistentVolumeClaim() provisionedBy = %v, want %v", provisionedBy, tt.wantProvisionedBy)
+			}
+		})
+	}
+}
+
 func Test_templatedTags(t *testing.T) {
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName("my-pvc")
@@ -1389,42 +2092,42 @@ func Test_templatedTags(t *testing.T) {
 		{
 			name:        "default tag overwritten with tag template",
 			defaultTags: map[string]string{"foo": "bar"},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Namespace }}\"}"},
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Namespace }}\"}"},
 			labels:      map[string]string{},
 			want:        map[string]string{"foo": "my-pvc-my-namespace"},
 		},
 		{
 			name:        "template using annotation",
 			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Annotations.TeamID }}\"}", "TeamID": "1234"},
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Annotations.TeamID }}\"}", "TeamID": "1234"},
 			labels:      map[string]string{},
 			want:        map[string]string{"foo": "my-pvc-1234"},
 		},
 		{
 			name:        "template using label",
 			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\"}"},
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\"}"},
 			labels:      map[string]string{"TeamID": "1234"},
 			want:        map[string]string{"foo": "my-pvc-1234"},
 		},
 		{
 			name:        "template using label and annotation",
 			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\",\"bar\": \"{{ .Name }}-{{ .Annotations.DeptID }}\"}", "DeptID": "ABC"},
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.TeamID }}\",\"bar\": \"{{ .Name }}-{{ .Annotations.DeptID }}\"}", "DeptID": "ABC"},
 			labels:      map[string]string{"TeamID": "1234"},
 			want:        map[string]string{"foo": "my-pvc-1234", "bar": "my-pvc-ABC"},
 		},
 		{
 			name:        "template using invalid label",
 			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.SomeLabel }}\"}"},
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"{{ .Name }}-{{ .Labels.SomeLabel }}\"}"},
 			labels:      map[string]string{"TeamID": "1234"},
 			want:        map[string]string{"foo": "my-pvc-"},
 		},
 		{
 			name:        "template using invalid field",
 			defaultTags: map[string]string{},
-			annotations: map[string]string{annotationPrefix + "/tags": "{\"foo\": \"{{ .Blah }}-{{ .Labels.TeamID }}\"}"},
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": "{\"foo\": \"{{ .Blah }}-{{ .Labels.TeamID }}\"}"},
 			labels:      map[string]string{"TeamID": "1234"},
 			want:        map[string]string{"foo": "{{ .Blah }}-{{ .Labels.TeamID }}"},
 		},
@@ -1433,11 +2136,70 @@ func Test_templatedTags(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			pvc.SetAnnotations(tt.annotations)
 			pvc.SetLabels(tt.labels)
-			defaultTags = tt.defaultTags
-			if got := buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+			tg := newTestTagger()
+			tg.settings.DefaultTags = tt.defaultTags
+			if got := tg.buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("buildTags() = %v, want %v", got, tt.want)
 			}
-			defaultTags = map[string]string{}
+		})
+	}
+}
+
+func Test_parseCsv(t *testing.T) {
+	tests := []struct {
+		name        string
+		csv         string
+		want        map[string]string
+		wantInvalid []string
+	}{
+		{
+			name: "empty string",
+			csv:  "",
+			want: map[string]string{},
+		},
+		{
+			name: "single key/value string",
+			csv:  "touge=me",
+			want: map[string]string{"touge": "me"},
+		},
+		{
+			name: "multiple key/value string",
+			csv:  "touge=me,foo=bar",
+			want: map[string]string{"touge": "me", "foo": "bar"},
+		},
+		{
+			name:        "invalid string",
+			csv:         "foo",
+			want:        map[string]string{},
+			wantInvalid: []string{"foo"},
+		},
+		{
+			name:        "invalid key string",
+			csv:         "=foo",
+			want:        map[string]string{},
+			wantInvalid: []string{"=foo"},
+		},
+		{
+			name:        "invalid value string",
+			csv:         "foo=",
+			want:        map[string]string{},
+			wantInvalid: []string{"foo="},
+		},
+		{
+			name: "double delim",
+			csv:  "foo=bar,,touge=me",
+			want: map[string]string{"touge": "me", "foo": "bar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotInvalid := parseCsv(tt.csv)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCsv() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gotInvalid, tt.wantInvalid) {
+				t.Errorf("parseCsv() invalid = %v, want %v", gotInvalid, tt.wantInvalid)
+			}
 		})
 	}
 }
@@ -0,0 +1,103 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// managedTagsAnnotation is the PV annotation recording the tag keys k8s-pvc-tagger set on
+// the volume. Only these keys are ever removed from the volume, tags set by anyone
+// else are left alone.
+func (t *Tagger) managedTagsAnnotation() string {
+	return t.settings.AnnotationPrefix + "/managed-tags"
+}
+
+// managedTagKeys returns the tag keys recorded on the PV
+func (t *Tagger) managedTagKeys(pv *corev1.PersistentVolume) sets.Set[string] {
+	value, ok := pv.GetAnnotations()[t.managedTagsAnnotation()]
+	if !ok || value == "" {
+		return sets.New[string]()
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(value), &keys); err != nil {
+		log.WithFields(log.Fields{"pv": pv.GetName()}).Warnln("Invalid managed tags annotation, ignoring it:", err)
+		return sets.New[string]()
+	}
+	return sets.New(keys...)
+}
+
+// removedManagedTags returns the managed tag keys that are no longer in tags
+func removedManagedTags(managedTags sets.Set[string], tags map[string]string) []string {
+	return sets.List(managedTags.Difference(sets.KeySet(tags)))
+}
+
+// recordManagedTags records the keys in the managed tags annotation of the PV, unless
+// they are its managedTags already. It reads no settings so the settingsLock needn't be
+// held during the API call.
+func (t *Tagger) recordManagedTags(ctx context.Context, pv *corev1.PersistentVolume, annotation string, managedTags sets.Set[string], keys sets.Set[string]) error {
+	if managedTags.Equal(keys) {
+		return nil
+	}
+	if t.dryRun {
+		log.WithFields(log.Fields{"pv": pv.GetName(), "tags": sets.List(keys)}).Infoln("Dry run: would record managed tags")
+		return nil
+	}
+
+	var value interface{}
+	if keys.Len() > 0 {
+		data, err := json.Marshal(sets.List(keys))
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	// a nil value deletes the annotation
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = t.client.CoreV1().PersistentVolumes().Patch(ctx, pv.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot record managed tags on PV %s: %w", pv.GetName(), err)
+	}
+	log.WithFields(log.Fields{"pv": pv.GetName(), "tags": sets.List(keys)}).Debugln("Recorded managed tags")
+	return nil
+}
+
+// withoutManagedTagsAnnotation returns the annotations without the managed tags one
+func (t *Tagger) withoutManagedTagsAnnotation(annotations map[string]string) map[string]string {
+	annotations = maps.Clone(annotations)
+	delete(annotations, t.managedTagsAnnotation())
+	return annotations
+}
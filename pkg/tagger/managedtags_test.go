@@ -0,0 +1,115 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_managedTagKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name: "no annotation",
+			want: []string{},
+		},
+		{
+			name:        "recorded keys",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/managed-tags": "[\"env\",\"team\"]"},
+			want:        []string{"env", "team"},
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/managed-tags": "env,team"},
+			want:        []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234", Annotations: tt.annotations}}
+			if got := sets.List(newTestTagger().managedTagKeys(pv)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("managedTagKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_removedManagedTags(t *testing.T) {
+	got := removedManagedTags(sets.New("env", "team", "owner"), map[string]string{"team": "a", "foreign": "b"})
+	if want := []string{"env", "owner"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removedManagedTags() = %v, want %v", got, want)
+	}
+}
+
+func Test_recordManagedTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		keys        sets.Set[string]
+		dryRun      bool
+		want        map[string]string
+	}{
+		{
+			name: "keys recorded",
+			keys: sets.New("team", "env"),
+			want: map[string]string{DefaultAnnotationPrefix + "/managed-tags": "[\"env\",\"team\"]"},
+		},
+		{
+			name:        "annotation removed without keys",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/managed-tags": "[\"env\"]", "other": "value"},
+			keys:        sets.New[string](),
+			want:        map[string]string{"other": "value"},
+		},
+		{
+			name:   "dry run",
+			keys:   sets.New("env"),
+			dryRun: true,
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234", Annotations: tt.annotations}}
+			client := fake.NewClientset(pv)
+			tg := newTestTagger()
+			tg.client = client
+			tg.dryRun = tt.dryRun
+			if err := tg.recordManagedTags(context.Background(), pv, tg.managedTagsAnnotation(), tg.managedTagKeys(pv), tt.keys); err != nil {
+				t.Fatalf("recordManagedTags() error = %v", err)
+			}
+			got, err := client.CoreV1().PersistentVolumes().Get(context.Background(), pv.GetName(), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.GetAnnotations(), tt.want) {
+				t.Errorf("PV annotations = %v, want %v", got.GetAnnotations(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_actions_total",
+		Help: "The total number of PVCs tagged",
+	}, []string{"status", "storageclass"})
+
+	promIgnoredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_pvc_ignored_total",
+		Help: "The total number of PVCs ignored",
+	}, []string{"storageclass"})
+
+	promInvalidTagsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_invalid_tags_total",
+		Help: "The total number of invalid tags found",
+	}, []string{"storageclass"})
+
+	promDryRunTagsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_dry_run_tags_total",
+		Help: "The total number of tags that would have been added or removed in dry-run mode",
+	}, []string{"action", "storageclass"})
+
+	promConfigReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_pvc_tagger_config_reloads_total",
+		Help: "The total number of config file reloads",
+	}, []string{"status"})
+
+	promActionsLegacyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_aws_ebs_tagger_actions_total",
+		Help: "The total number of PVCs tagged",
+	}, []string{"status"})
+
+	promIgnoredLegacyTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_aws_ebs_tagger_pvc_ignored_total",
+		Help: "The total number of PVCs ignored",
+	})
+
+	promInvalidTagsLegacyTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_aws_ebs_tagger_invalid_tags_total",
+		Help: "The total number of invalid tags found",
+	})
+)
@@ -0,0 +1,180 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+var taggingPolicyGVR = schema.GroupVersionResource{
+	Group:    "k8s-pvc-tagger.tougeron.com",
+	Version:  "v1alpha1",
+	Resource: "taggingpolicies",
+}
+
+// TaggingPolicy is a cluster scoped set of tags for the PVCs it selects
+type TaggingPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TaggingPolicySpec `json:"spec"`
+}
+
+type TaggingPolicySpec struct {
+	// Priority orders the matching policies; a higher priority is merged
+	// later and wins on conflicting keys. Ties are broken by name.
+	Priority int32 `json:"priority,omitempty"`
+	// NamespaceSelector selects the namespaces of the PVCs, all namespaces when empty
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Selector selects PVCs by their labels, all PVCs when empty
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// StorageClassNames selects PVCs by their storage class, all storage classes when empty
+	StorageClassNames []string `json:"storageClassNames,omitempty"`
+	// Tags to set; values are templates, rendered like the tags annotation
+	Tags map[string]string `json:"tags,omitempty"`
+	// CopyLabels are PVC label keys to copy to tags, "*" for all of them
+	CopyLabels []string `json:"copyLabels,omitempty"`
+	// CopyAnnotations are PVC annotation keys to copy to tags
+	CopyAnnotations []string `json:"copyAnnotations,omitempty"`
+}
+
+// taggingPolicyFromUnstructured is the informer transform storing TaggingPolicies
+// instead of the unstructured objects returned by the dynamic client.
+func taggingPolicyFromUnstructured(obj interface{}) (interface{}, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return obj, nil
+	}
+	policy := &TaggingPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), policy); err != nil {
+		return nil, fmt.Errorf("invalid TaggingPolicy %s: %w", u.GetName(), err)
+	}
+	return policy, nil
+}
+
+func taggingPolicyFromObj(obj interface{}) (*TaggingPolicy, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	policy, ok := obj.(*TaggingPolicy)
+	return policy, ok
+}
+
+// matches returns whether the policy selects the PVC of the namespace, nil if it's unknown
+func (p *TaggingPolicy) matches(pvc *corev1.PersistentVolumeClaim, namespace *corev1.Namespace) bool {
+	var namespaceLabels map[string]string
+	if namespace != nil {
+		namespaceLabels = namespace.GetLabels()
+	}
+	return p.matchesWithNamespaceLabels(pvc, namespaceLabels)
+}
+
+// matchesWithNamespaceLabels returns whether the policy selects the PVC when its
+// namespace has the namespaceLabels.
+func (p *TaggingPolicy) matchesWithNamespaceLabels(pvc *corev1.PersistentVolumeClaim, namespaceLabels map[string]string) bool {
+	if len(p.Spec.StorageClassNames) > 0 {
+		if pvc.Spec.StorageClassName == nil || !slices.Contains(p.Spec.StorageClassNames, *pvc.Spec.StorageClassName) {
+			return false
+		}
+	}
+
+	if p.Spec.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(p.Spec.Selector)
+		if err != nil {
+			log.WithFields(log.Fields{"policy": p.GetName()}).Errorln("Invalid selector:", err)
+			return false
+		}
+		if !selector.Matches(labels.Set(pvc.GetLabels())) {
+			return false
+		}
+	}
+
+	if p.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector)
+		if err != nil {
+			log.WithFields(log.Fields{"policy": p.GetName()}).Errorln("Invalid namespaceSelector:", err)
+			return false
+		}
+		if !selector.Empty() && !selector.Matches(labels.Set(namespaceLabels)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tags returns the tags the policy sets on the PVC's volume, before templates are rendered
+func (p *TaggingPolicy) tags(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	tags := map[string]string{}
+	for k, v := range pvc.GetLabels() {
+		if slices.Contains(p.Spec.CopyLabels, "*") || slices.Contains(p.Spec.CopyLabels, k) {
+			tags[k] = v
+		}
+	}
+	for _, k := range p.Spec.CopyAnnotations {
+		if v, ok := pvc.GetAnnotations()[k]; ok {
+			tags[k] = v
+		}
+	}
+	for k, v := range p.Spec.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// taggingPolicies returns every TaggingPolicy of the informer cache
+func (t *Tagger) taggingPolicies() []*TaggingPolicy {
+	if t.taggingPolicyStore == nil {
+		return nil
+	}
+
+	var policies []*TaggingPolicy
+	for _, obj := range t.taggingPolicyStore.List() {
+		if policy, ok := taggingPolicyFromObj(obj); ok {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// matchingTaggingPolicies returns the policies selecting the PVC in the order they are merged
+func (t *Tagger) matchingTaggingPolicies(pvc *corev1.PersistentVolumeClaim) []*TaggingPolicy {
+	var policies []*TaggingPolicy
+	for _, policy := range t.taggingPolicies() {
+		if policy.matches(pvc, t.getNamespace(pvc.GetNamespace())) {
+			policies = append(policies, policy)
+		}
+	}
+	slices.SortFunc(policies, func(a, b *TaggingPolicy) int {
+		return cmp.Or(cmp.Compare(a.Spec.Priority, b.Spec.Priority), strings.Compare(a.GetName(), b.GetName()))
+	})
+	return policies
+}
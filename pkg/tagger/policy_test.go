@@ -0,0 +1,274 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func setTestTaggingPolicies(t *testing.T, tg *Tagger, namespaces []*corev1.Namespace, policies ...*TaggingPolicy) {
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, policy := range policies {
+		if err := store.Add(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTestNamespaces(t, tg, namespaces...)
+
+	tg.taggingPolicyStore = store
+}
+
+func Test_TaggingPolicy_matches(t *testing.T) {
+	otherStorageClassName := "other"
+	tg := newTestTagger()
+	setTestTaggingPolicies(t, tg, []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}},
+	})
+
+	tests := []struct {
+		name             string
+		spec             TaggingPolicySpec
+		pvcNamespace     string
+		pvcLabels        map[string]string
+		storageClassName *string
+		want             bool
+	}{
+		{
+			name:             "empty policy selects every PVC",
+			spec:             TaggingPolicySpec{},
+			pvcNamespace:     "team-a",
+			storageClassName: &dummyStorageClassName,
+			want:             true,
+		},
+		{
+			name:             "storage class selected",
+			spec:             TaggingPolicySpec{StorageClassNames: []string{"gp3", dummyStorageClassName}},
+			pvcNamespace:     "team-a",
+			storageClassName: &dummyStorageClassName,
+			want:             true,
+		},
+		{
+			name:             "storage class not selected",
+			spec:             TaggingPolicySpec{StorageClassNames: []string{dummyStorageClassName}},
+			pvcNamespace:     "team-a",
+			storageClassName: &otherStorageClassName,
+			want:             false,
+		},
+		{
+			name:             "label selector matches",
+			spec:             TaggingPolicySpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+			pvcNamespace:     "team-a",
+			pvcLabels:        map[string]string{"app": "db", "tier": "backend"},
+			storageClassName: &dummyStorageClassName,
+			want:             true,
+		},
+		{
+			name:             "label selector doesn't match",
+			spec:             TaggingPolicySpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+			pvcNamespace:     "team-a",
+			pvcLabels:        map[string]string{"app": "web"},
+			storageClassName: &dummyStorageClassName,
+			want:             false,
+		},
+		{
+			name:             "namespace selector matches",
+			spec:             TaggingPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}},
+			pvcNamespace:     "team-a",
+			storageClassName: &dummyStorageClassName,
+			want:             true,
+		},
+		{
+			name:             "namespace selector doesn't match",
+			spec:             TaggingPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}},
+			pvcNamespace:     "team-b",
+			storageClassName: &dummyStorageClassName,
+			want:             false,
+		},
+		{
+			name:             "unknown namespace",
+			spec:             TaggingPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}},
+			pvcNamespace:     "unknown",
+			storageClassName: &dummyStorageClassName,
+			want:             false,
+		},
+		{
+			name: "invalid selector",
+			spec: TaggingPolicySpec{Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: "Bogus"},
+			}}},
+			pvcNamespace:     "team-a",
+			storageClassName: &dummyStorageClassName,
+			want:             false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &TaggingPolicy{ObjectMeta: metav1.ObjectMeta{Name: "policy"}, Spec: tt.spec}
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetNamespace(tt.pvcNamespace)
+			pvc.SetLabels(tt.pvcLabels)
+			pvc.Spec.StorageClassName = tt.storageClassName
+			if got := policy.matches(pvc, tg.getNamespace(pvc.GetNamespace())); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_matchingTaggingPolicies(t *testing.T) {
+	tg := newTestTagger()
+	setTestTaggingPolicies(t, tg, nil,
+		&TaggingPolicy{ObjectMeta: metav1.ObjectMeta{Name: "b-default"}},
+		&TaggingPolicy{ObjectMeta: metav1.ObjectMeta{Name: "high"}, Spec: TaggingPolicySpec{Priority: 100}},
+		&TaggingPolicy{ObjectMeta: metav1.ObjectMeta{Name: "a-default"}},
+		&TaggingPolicy{ObjectMeta: metav1.ObjectMeta{Name: "low"}, Spec: TaggingPolicySpec{Priority: -10}},
+		&TaggingPolicy{ObjectMeta: metav1.ObjectMeta{Name: "other-class"}, Spec: TaggingPolicySpec{StorageClassNames: []string{"other"}}},
+	)
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.SetName("my-pvc")
+	pvc.Spec.StorageClassName = &dummyStorageClassName
+
+	var got []string
+	for _, policy := range tg.matchingTaggingPolicies(pvc) {
+		got = append(got, policy.GetName())
+	}
+	if want := []string{"low", "a-default", "b-default", "high"}; !slices.Equal(got, want) {
+		t.Errorf("matchingTaggingPolicies() = %v, want %v", got, want)
+	}
+}
+
+func Test_buildTags_taggingPolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultTags map[string]string
+		policies    []*TaggingPolicy
+		pvcLabels   map[string]string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name:        "policy tags merged over the default tags",
+			defaultTags: map[string]string{"foo": "bar", "env": "default"},
+			policies: []*TaggingPolicy{
+				{ObjectMeta: metav1.ObjectMeta{Name: "env"}, Spec: TaggingPolicySpec{Tags: map[string]string{"env": "prod"}}},
+			},
+			want: map[string]string{"foo": "bar", "env": "prod"},
+		},
+		{
+			name: "higher priority wins",
+			policies: []*TaggingPolicy{
+				{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: TaggingPolicySpec{Priority: 10, Tags: map[string]string{"owner": "a"}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "b"}, Spec: TaggingPolicySpec{Tags: map[string]string{"owner": "b", "team": "b"}}},
+			},
+			want: map[string]string{"owner": "a", "team": "b"},
+		},
+		{
+			name: "PVC annotation wins over the policies",
+			policies: []*TaggingPolicy{
+				{ObjectMeta: metav1.ObjectMeta{Name: "env"}, Spec: TaggingPolicySpec{Tags: map[string]string{"env": "prod"}}},
+			},
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"env\": \"dev\"}"},
+			want:        map[string]string{"env": "dev"},
+		},
+		{
+			name: "copied labels and templates",
+			policies: []*TaggingPolicy{
+				{ObjectMeta: metav1.ObjectMeta{Name: "copy"}, Spec: TaggingPolicySpec{
+					CopyLabels: []string{"cost-center"},
+					Tags:       map[string]string{"OwnerID": "{{ .Namespace }}/{{ .Name }}"},
+				}},
+			},
+			pvcLabels: map[string]string{"cost-center": "123", "app": "db"},
+			want:      map[string]string{"cost-center": "123", "OwnerID": "my-namespace/my-pvc"},
+		},
+		{
+			name: "restricted policy tags are skipped",
+			policies: []*TaggingPolicy{
+				{ObjectMeta: metav1.ObjectMeta{Name: "restricted"}, Spec: TaggingPolicySpec{Tags: map[string]string{"Name": "foo", "env": "prod"}}},
+			},
+			want: map[string]string{"env": "prod"},
+		},
+		{
+			name: "ignored PVC",
+			policies: []*TaggingPolicy{
+				{ObjectMeta: metav1.ObjectMeta{Name: "env"}, Spec: TaggingPolicySpec{Tags: map[string]string{"env": "prod"}}},
+			},
+			annotations: map[string]string{"k8s-pvc-tagger/ignore": ""},
+			want:        map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			tg.settings.DefaultTags = tt.defaultTags
+			setTestTaggingPolicies(t, tg, nil, tt.policies...)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			pvc.SetName("my-pvc")
+			pvc.SetNamespace("my-namespace")
+			pvc.SetLabels(tt.pvcLabels)
+			pvc.SetAnnotations(tt.annotations)
+			pvc.Spec.StorageClassName = &dummyStorageClassName
+
+			if got := tg.buildTags(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_taggingPolicyFromUnstructured(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "k8s-pvc-tagger.tougeron.com/v1alpha1",
+		"kind":       "TaggingPolicy",
+		"metadata":   map[string]interface{}{"name": "team-a"},
+		"spec": map[string]interface{}{
+			"priority":          int64(5),
+			"storageClassNames": []interface{}{"gp3"},
+			"tags":              map[string]interface{}{"team": "a"},
+		},
+	}}
+
+	obj, err := taggingPolicyFromUnstructured(u)
+	if err != nil {
+		t.Fatalf("taggingPolicyFromUnstructured() err = %v", err)
+	}
+	policy, ok := taggingPolicyFromObj(cache.DeletedFinalStateUnknown{Key: "team-a", Obj: obj})
+	if !ok {
+		t.Fatalf("taggingPolicyFromObj() not a TaggingPolicy: %T", obj)
+	}
+	want := TaggingPolicySpec{Priority: 5, StorageClassNames: []string{"gp3"}, Tags: map[string]string{"team": "a"}}
+	if policy.GetName() != "team-a" || !reflect.DeepEqual(policy.Spec, want) {
+		t.Errorf("taggingPolicyFromUnstructured() = %v %+v, want team-a %+v", policy.GetName(), policy.Spec, want)
+	}
+
+	u.Object["spec"] = map[string]interface{}{"priority": "high"}
+	if _, err := taggingPolicyFromUnstructured(u); err == nil {
+		t.Errorf("taggingPolicyFromUnstructured() expected an error for an invalid spec")
+	}
+}
@@ -0,0 +1,491 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	volumeSnapshotGVR = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshots",
+	}
+	volumeSnapshotContentGVR = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshotcontents",
+	}
+)
+
+// volumeSnapshot holds the fields of a snapshot.storage.k8s.io VolumeSnapshot used to tag its snapshot
+type volumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   volumeSnapshotSpec    `json:"spec"`
+	Status *volumeSnapshotStatus `json:"status,omitempty"`
+}
+
+type volumeSnapshotSpec struct {
+	Source volumeSnapshotSource `json:"source"`
+}
+
+type volumeSnapshotSource struct {
+	// PersistentVolumeClaimName is the PVC the snapshot is taken from, nil for a
+	// pre-provisioned snapshot
+	PersistentVolumeClaimName *string `json:"persistentVolumeClaimName,omitempty"`
+}
+
+type volumeSnapshotStatus struct {
+	BoundVolumeSnapshotContentName *string `json:"boundVolumeSnapshotContentName,omitempty"`
+}
+
+// volumeSnapshotContent holds the fields of a snapshot.storage.k8s.io VolumeSnapshotContent
+// used to tag its snapshot
+type volumeSnapshotContent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   volumeSnapshotContentSpec    `json:"spec"`
+	Status *volumeSnapshotContentStatus `json:"status,omitempty"`
+}
+
+type volumeSnapshotContentSpec struct {
+	VolumeSnapshotRef corev1.ObjectReference `json:"volumeSnapshotRef"`
+	Driver            string                 `json:"driver"`
+}
+
+type volumeSnapshotContentStatus struct {
+	// SnapshotHandle is the ID of the snapshot in the cloud, set once it's created
+	SnapshotHandle *string `json:"snapshotHandle,omitempty"`
+}
+
+// contentName returns the name of the VolumeSnapshotContent bound to the snapshot
+func (s *volumeSnapshot) contentName() string {
+	if s.Status == nil || s.Status.BoundVolumeSnapshotContentName == nil {
+		return ""
+	}
+	return *s.Status.BoundVolumeSnapshotContentName
+}
+
+// snapshotHandle returns the ID of the cloud snapshot, empty until it's created
+func (c *volumeSnapshotContent) snapshotHandle() string {
+	if c.Status == nil || c.Status.SnapshotHandle == nil {
+		return ""
+	}
+	return *c.Status.SnapshotHandle
+}
+
+// volumeSnapshotFromUnstructured is the informer transform storing volumeSnapshots
+// instead of the unstructured objects returned by the dynamic client.
+func volumeSnapshotFromUnstructured(obj interface{}) (interface{}, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return obj, nil
+	}
+	snapshot := &volumeSnapshot{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), snapshot); err != nil {
+		return nil, fmt.Errorf("invalid VolumeSnapshot %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+	}
+	return snapshot, nil
+}
+
+// volumeSnapshotContentFromUnstructured is the informer transform storing volumeSnapshotContents
+// instead of the unstructured objects returned by the dynamic client.
+func volumeSnapshotContentFromUnstructured(obj interface{}) (interface{}, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return obj, nil
+	}
+	content := &volumeSnapshotContent{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), content); err != nil {
+		return nil, fmt.Errorf("invalid VolumeSnapshotContent %s: %w", u.GetName(), err)
+	}
+	return content, nil
+}
+
+// snapshotIgnored returns whether the ignore annotation is set on the VolumeSnapshot
+func (t *Tagger) snapshotIgnored(snapshot *volumeSnapshot) bool {
+	annotations := snapshot.GetAnnotations()
+	if _, ok := annotations[t.settings.AnnotationPrefix+"/ignore"]; ok {
+		return true
+	}
+	if t.settings.AnnotationPrefix == DefaultAnnotationPrefix {
+		if _, ok := annotations[legacyAnnotationPrefix+"/ignore"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSnapshotTags returns the tags of the volume of the PVC merged with the tags
+// annotation of its VolumeSnapshot, which wins on conflicting keys. The templates of
+// the snapshot tags are rendered with the PVC.
+func (t *Tagger) buildSnapshotTags(pvc *corev1.PersistentVolumeClaim, snapshot *volumeSnapshot) map[string]string {
+	tags := t.buildTags(pvc)
+	_, tagString, ok := t.tagsAnnotation(snapshot.GetAnnotations())
+	if !ok {
+		return tags
+	}
+
+	snapshotTags := map[string]string{}
+	t.mergeAllowedTags(snapshotTags, t.parseTags(tagString), storageClassName(pvc), true)
+	maps.Copy(tags, t.renderTagTemplates(pvc, snapshotTags))
+	return tags
+}
+
+// newSnapshotTaggers registers a tagger of the snapshots of each of the CSI drivers of the
+// volume backends of the clouds. The cloud clients are created lazily.
+func (t *Tagger) newSnapshotTaggers(ctx context.Context) volumeTaggers {
+	taggers := volumeTaggers{}
+	for _, backend := range registeredVolumeBackends() {
+		if backend.NewSnapshotTagger == nil || !slices.Contains(t.clouds, backend.Cloud) {
+			continue
+		}
+		// the in-tree volume plugins have no CSI snapshots
+		drivers := slices.DeleteFunc(slices.Clone(backend.Drivers), func(driver string) bool {
+			return strings.HasPrefix(driver, "kubernetes.io/")
+		})
+		taggers.register(newLazyVolumeTagger(func() (VolumeTagger, error) {
+			return backend.NewSnapshotTagger(ctx, t)
+		}, backend.SanitizeTags), drivers...)
+	}
+
+	if t.dryRun {
+		for driver, tagger := range taggers {
+			taggers[driver] = &dryRunVolumeTagger{tagger: tagger}
+		}
+	}
+	return taggers
+}
+
+// snapshotController tags the cloud snapshots of the VolumeSnapshots of a namespace. The
+// queue holds the namespace/name keys of the VolumeSnapshots.
+type snapshotController struct {
+	queue     workqueue.TypedRateLimitingInterface[string]
+	snapshots cache.Store
+	contents  cache.Store
+	pvcLister corelisters.PersistentVolumeClaimLister
+	tagger    *Tagger
+
+	taggers volumeTaggers
+}
+
+func newSnapshotController(tagger *Tagger, snapshots cache.Store, contents cache.Store, pvcLister corelisters.PersistentVolumeClaimLister, taggers volumeTaggers) *snapshotController {
+	return &snapshotController{
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[string](retryBaseDelay, retryMaxDelay),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "volumesnapshot"},
+		),
+		snapshots: snapshots,
+		contents:  contents,
+		pvcLister: pvcLister,
+		tagger:    tagger,
+		taggers:   taggers,
+	}
+}
+
+// enqueueSnapshotOf enqueues the VolumeSnapshot a VolumeSnapshotContent is bound to, if
+// that VolumeSnapshot is in the watched namespace.
+func (c *snapshotController) enqueueSnapshotOf(content *volumeSnapshotContent, watchNamespace string) {
+	ref := content.Spec.VolumeSnapshotRef
+	if ref.Name == "" {
+		return
+	}
+	if watchNamespace != "" && ref.Namespace != watchNamespace {
+		return
+	}
+	c.queue.Add(ref.Namespace + "/" + ref.Name)
+}
+
+// enqueueAll enqueues every VolumeSnapshot, after the settings changed
+func (c *snapshotController) enqueueAll() {
+	for _, key := range c.snapshots.ListKeys() {
+		c.queue.Add(key)
+	}
+}
+
+func (c *snapshotController) run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+
+	<-ctx.Done()
+}
+
+func (c *snapshotController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *snapshotController) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncVolumeSnapshot(ctx, key)
+	c.handleErr(key, err)
+	return true
+}
+
+// handleErr requeues a failed key with exponential backoff until maxAttempts is reached.
+func (c *snapshotController) handleErr(key string, err error) {
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+
+	attempts := c.queue.NumRequeues(key) + 1
+	if attempts < c.tagger.maxAttempts {
+		log.WithFields(log.Fields{"volumesnapshot": key, "attempt": attempts}).Warnln("Failed to tag snapshot, retrying:", err)
+		c.queue.AddRateLimited(key)
+		return
+	}
+
+	c.queue.Forget(key)
+	log.WithFields(log.Fields{"volumesnapshot": key, "attempts": attempts}).Errorln("Failed to tag snapshot, giving up:", err)
+}
+
+// syncVolumeSnapshot tags the cloud snapshot of a VolumeSnapshot with the tags of its
+// source PVC and its own tags annotation. Only the missing or drifted tags are set, the
+// tags of a snapshot are never removed.
+func (c *snapshotController) syncVolumeSnapshot(ctx context.Context, key string) error {
+	obj, exists, err := c.snapshots.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.WithFields(log.Fields{"volumesnapshot": key}).Debugln("VolumeSnapshot no longer exists")
+		return nil
+	}
+	snapshot := obj.(*volumeSnapshot)
+	logFields := log.Fields{"namespace": snapshot.GetNamespace(), "volumesnapshot": snapshot.GetName()}
+	if snapshot.GetDeletionTimestamp() != nil {
+		return nil
+	}
+	// the settings are read under the settingsLock, never held during the API calls
+	c.tagger.settingsLock.RLock()
+	ignored := c.tagger.snapshotIgnored(snapshot)
+	c.tagger.settingsLock.RUnlock()
+	if ignored {
+		return nil
+	}
+	if snapshot.Spec.Source.PersistentVolumeClaimName == nil {
+		log.WithFields(logFields).Debugln("Pre-provisioned VolumeSnapshot has no PVC")
+		return nil
+	}
+
+	contentName := snapshot.contentName()
+	if contentName == "" {
+		log.WithFields(logFields).Debugln("VolumeSnapshotContent not created yet")
+		return nil
+	}
+	obj, exists, err = c.contents.GetByKey(contentName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.WithFields(logFields).Debugln("VolumeSnapshotContent not created yet")
+		return nil
+	}
+	content := obj.(*volumeSnapshotContent)
+	snapshotID := content.snapshotHandle()
+	if snapshotID == "" {
+		log.WithFields(logFields).Debugln("Snapshot not created yet")
+		return nil
+	}
+	tagger, ok := c.taggers.get(content.Spec.Driver)
+	if !ok {
+		log.WithFields(logFields).Debugln("No snapshot tagger registered for", content.Spec.Driver)
+		return nil
+	}
+
+	pvc, err := c.pvcLister.PersistentVolumeClaims(snapshot.GetNamespace()).Get(*snapshot.Spec.Source.PersistentVolumeClaimName)
+	if apierrors.IsNotFound(err) {
+		log.WithFields(logFields).Debugln("Source PersistentVolumeClaim no longer exists")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the lister returns the cached PVC, which must not be modified
+	pvc = getPVC(pvc.DeepCopy())
+	if pvc.Spec.StorageClassName == nil {
+		storageClassName := ""
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+
+	c.tagger.settingsLock.RLock()
+	var tags map[string]string
+	if !c.tagger.shouldIgnore(pvc) {
+		tags = c.tagger.buildSnapshotTags(pvc, snapshot)
+	}
+	roleARN := c.tagger.awsRoleARN(pvc)
+	c.tagger.settingsLock.RUnlock()
+	if len(tags) == 0 {
+		return nil
+	}
+	// the snapshot is in the account of the volume of its source PVC
+	ctx = withAWSRole(ctx, roleARN)
+	err = c.tagSnapshot(ctx, tagger, snapshotID, tags, *pvc.Spec.StorageClassName)
+	if errors.Is(err, errInvalidVolumeTags) {
+		log.WithFields(logFields).Errorln(err)
+		return nil
+	}
+	return err
+}
+
+// tagSnapshot sets the tags missing from the snapshot or whose value drifted
+func (c *snapshotController) tagSnapshot(ctx context.Context, tagger VolumeTagger, snapshotID string, tags map[string]string, storageclass string) error {
+	currentTags, err := tagger.GetTags(ctx, snapshotID)
+	if err != nil {
+		promActionsTotal.With(prometheus.Labels{"status": "error", "storageclass": storageclass}).Inc()
+		return fmt.Errorf("could not get the tags of snapshot %s: %w", snapshotID, err)
+	}
+
+	desiredTags := tags
+	if sanitizer, ok := tagger.(tagSanitizer); ok {
+		desiredTags, err = sanitizer.SanitizeTags(tags)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidVolumeTags, err)
+		}
+	}
+	if len(diffTags(currentTags, desiredTags)) == 0 {
+		log.WithFields(log.Fields{"snapshotID": snapshotID}).Debugln("Snapshot tags are in sync")
+		return nil
+	}
+
+	log.WithFields(log.Fields{"snapshotID": snapshotID, "tags": tags}).Infoln("Tagging snapshot")
+	return tagger.SetTags(ctx, snapshotID, tags, storageclass)
+}
+
+// watchForVolumeSnapshots tags the snapshots of the VolumeSnapshots of the watchNamespace
+// until the ch is closed or the ctx is done.
+func (t *Tagger) watchForVolumeSnapshots(ctx context.Context, ch chan struct{}, watchNamespace string, pvcFactory informers.SharedInformerFactory, sharedInformers clusterInformers, taggers volumeTaggers) {
+	log.WithFields(log.Fields{"namespace": watchNamespace}).Infoln("Starting VolumeSnapshot informer")
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(t.dynamicClient, t.resyncPeriod, watchNamespace, nil)
+	informer := factory.ForResource(volumeSnapshotGVR).Informer()
+	if err := informer.SetTransform(volumeSnapshotFromUnstructured); err != nil {
+		log.Errorln("Cannot setup VolumeSnapshot informer:", err)
+		return
+	}
+	contentInformer := sharedInformers.snapshotContents
+	pvcInformer := pvcFactory.Core().V1().PersistentVolumeClaims()
+	controller := newSnapshotController(t, informer.GetStore(), contentInformer.GetStore(), pvcInformer.Lister(), taggers)
+
+	enqueue := func(obj interface{}) {
+		if snapshot, ok := obj.(*volumeSnapshot); ok && snapshot.contentName() != "" {
+			key, err := cache.MetaNamespaceKeyFunc(snapshot)
+			if err != nil {
+				log.WithFields(log.Fields{"namespace": snapshot.GetNamespace(), "volumesnapshot": snapshot.GetName()}).Errorln("Cannot build queue key:", err)
+				return
+			}
+			controller.queue.Add(key)
+		}
+	}
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			// The informer re-delivers every VolumeSnapshot with an unchanged
+			// ResourceVersion on each resync period.
+			if old.(*volumeSnapshot).ResourceVersion == new.(*volumeSnapshot).ResourceVersion && t.resyncPeriod == 0 {
+				return
+			}
+			enqueue(new)
+		},
+	})
+	if err != nil {
+		log.Errorln("Can't setup VolumeSnapshot informer! Check RBAC permissions")
+		return
+	}
+
+	// The snapshot handle is set on the VolumeSnapshotContent once the cloud
+	// snapshot is created, without changing the VolumeSnapshot.
+	contentHandler, err := contentInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if content, ok := obj.(*volumeSnapshotContent); ok {
+				controller.enqueueSnapshotOf(content, watchNamespace)
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldContent, oldOk := old.(*volumeSnapshotContent)
+			newContent, newOk := new.(*volumeSnapshotContent)
+			if !oldOk || !newOk || oldContent.snapshotHandle() == newContent.snapshotHandle() {
+				return
+			}
+			controller.enqueueSnapshotOf(newContent, watchNamespace)
+		},
+	})
+	if err != nil {
+		log.Errorln("Can't setup VolumeSnapshotContent informer! Check RBAC permissions")
+		return
+	}
+	defer func() {
+		if err := contentInformer.RemoveEventHandler(contentHandler); err != nil {
+			log.Errorln("Can't remove VolumeSnapshotContent event handler:", err)
+		}
+	}()
+
+	go informer.Run(ch)
+	pvcFactory.Start(ch)
+	if !cache.WaitForCacheSync(ch, append(sharedInformers.hasSynced(), informer.HasSynced, pvcInformer.Informer().HasSynced)...) {
+		log.WithFields(log.Fields{"namespace": watchNamespace}).Errorln("Timed out waiting for the VolumeSnapshot informers to sync")
+		return
+	}
+
+	// the settings can change the tags of every snapshot
+	settingsChanges := t.subscribeSettingsChanges(ctx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-settingsChanges:
+				controller.enqueueAll()
+			}
+		}
+	}()
+
+	controller.run(ctx)
+}
@@ -0,0 +1,305 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func newTestVolumeSnapshot(annotations map[string]string, pvcName *string, contentName *string) *volumeSnapshot {
+	return &volumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-backup", Namespace: "my-namespace", Annotations: annotations},
+		Spec:       volumeSnapshotSpec{Source: volumeSnapshotSource{PersistentVolumeClaimName: pvcName}},
+		Status:     &volumeSnapshotStatus{BoundVolumeSnapshotContentName: contentName},
+	}
+}
+
+func newTestVolumeSnapshotContent(driver string, handle *string) *volumeSnapshotContent {
+	return &volumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "snapcontent-1"},
+		Spec: volumeSnapshotContentSpec{
+			VolumeSnapshotRef: corev1.ObjectReference{Namespace: "my-namespace", Name: "db-backup"},
+			Driver:            driver,
+		},
+		Status: &volumeSnapshotContentStatus{SnapshotHandle: handle},
+	}
+}
+
+func Test_buildSnapshotTags(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "my-namespace",
+			Annotations: map[string]string{DefaultAnnotationPrefix + "/tags": `{"team": "storage", "env": "prod"}`},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &dummyStorageClassName},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name: "no snapshot annotation",
+			want: map[string]string{"team": "storage", "env": "prod"},
+		},
+		{
+			name:        "snapshot tags win",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": `{"env": "backup", "backup": "nightly"}`},
+			want:        map[string]string{"team": "storage", "env": "backup", "backup": "nightly"},
+		},
+		{
+			name:        "snapshot tag template rendered with the pvc",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": `{"source": "{{ .Namespace }}/{{ .Name }}"}`},
+			want:        map[string]string{"team": "storage", "env": "prod", "source": "my-namespace/db"},
+		},
+		{
+			name:        "restricted snapshot tag skipped",
+			annotations: map[string]string{DefaultAnnotationPrefix + "/tags": `{"kubernetes.io/foo": "bar"}`},
+			want:        map[string]string{"team": "storage", "env": "prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			got := tg.buildSnapshotTags(pvc, newTestVolumeSnapshot(tt.annotations, nil, nil))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildSnapshotTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_snapshotController_syncVolumeSnapshot(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "my-namespace",
+			Annotations: map[string]string{DefaultAnnotationPrefix + "/tags": `{"team": "storage"}`},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &dummyStorageClassName},
+	}
+	noClassPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "scratch",
+			Namespace:   "my-namespace",
+			Annotations: map[string]string{DefaultAnnotationPrefix + "/tags": `{"team": "scratch"}`},
+		},
+	}
+	pvcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range []*corev1.PersistentVolumeClaim{pvc, noClassPVC} {
+		if err := pvcs.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		snapshot     *volumeSnapshot
+		content      *volumeSnapshotContent
+		snapshotTags map[string]string
+		wantSetCalls int
+		wantTags     map[string]string
+	}{
+		{
+			name:         "snapshot tagged",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("db"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			wantSetCalls: 1,
+			wantTags:     map[string]string{"team": "storage"},
+		},
+		{
+			name:         "EKS Auto Mode snapshot tagged",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("db"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI_AUTO, stringPtr("snap-1234")),
+			wantSetCalls: 1,
+			wantTags:     map[string]string{"team": "storage"},
+		},
+		{
+			name:         "source pvc without storage class",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("scratch"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			wantSetCalls: 1,
+			wantTags:     map[string]string{"team": "scratch"},
+		},
+		{
+			name:         "snapshot tags in sync",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("db"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			snapshotTags: map[string]string{"team": "storage", "other": "tag"},
+			wantSetCalls: 0,
+			wantTags:     map[string]string{"team": "storage", "other": "tag"},
+		},
+		{
+			name:         "snapshot handle not set",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("db"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, nil),
+			wantSetCalls: 0,
+		},
+		{
+			name:         "content not bound",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("db"), nil),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			wantSetCalls: 0,
+		},
+		{
+			name:         "pre-provisioned snapshot",
+			snapshot:     newTestVolumeSnapshot(nil, nil, stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			wantSetCalls: 0,
+		},
+		{
+			name:         "source pvc deleted",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("deleted"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			wantSetCalls: 0,
+		},
+		{
+			name:         "ignored snapshot",
+			snapshot:     newTestVolumeSnapshot(map[string]string{DefaultAnnotationPrefix + "/ignore": ""}, stringPtr("db"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")),
+			wantSetCalls: 0,
+		},
+		{
+			name:         "unsupported driver",
+			snapshot:     newTestVolumeSnapshot(nil, stringPtr("db"), stringPtr("snapcontent-1")),
+			content:      newTestVolumeSnapshotContent("other.csi.k8s.io", stringPtr("snap-1234")),
+			wantSetCalls: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			snapshots := cache.NewStore(cache.MetaNamespaceKeyFunc)
+			if err := snapshots.Add(tt.snapshot); err != nil {
+				t.Fatal(err)
+			}
+			contents := cache.NewStore(cache.MetaNamespaceKeyFunc)
+			if err := contents.Add(tt.content); err != nil {
+				t.Fatal(err)
+			}
+			tagger := &fakeVolumeTagger{tags: tt.snapshotTags}
+			c := newSnapshotController(tg, snapshots, contents, corelisters.NewPersistentVolumeClaimLister(pvcs), volumeTaggers{AWS_EBS_CSI: tagger, AWS_EBS_CSI_AUTO: tagger})
+
+			if err := c.syncVolumeSnapshot(context.Background(), "my-namespace/db-backup"); err != nil {
+				t.Fatalf("syncVolumeSnapshot() err = %v", err)
+			}
+			if tagger.setCalls != tt.wantSetCalls {
+				t.Errorf("SetTags() calls = %v, want %v", tagger.setCalls, tt.wantSetCalls)
+			}
+			if tt.wantTags != nil && !reflect.DeepEqual(tagger.tags, tt.wantTags) {
+				t.Errorf("snapshot tags = %v, want %v", tagger.tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func Test_newSnapshotTaggers(t *testing.T) {
+	tg := newTestTagger()
+	tg.clouds = []string{AWS, GCP, AZURE}
+	got := slices.Sorted(maps.Keys(tg.newSnapshotTaggers(context.Background())))
+	want := slices.Sorted(slices.Values([]string{AWS_EBS_CSI, AWS_EBS_CSI_AUTO, AZURE_DISK_CSI, GCP_PD_CSI}))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newSnapshotTaggers() drivers = %v, want %v", got, want)
+	}
+}
+
+func Test_snapshotController_enqueueSnapshotOf(t *testing.T) {
+	tests := []struct {
+		name           string
+		watchNamespace string
+		wantLen        int
+	}{
+		{name: "all namespaces", watchNamespace: "", wantLen: 1},
+		{name: "watched namespace", watchNamespace: "my-namespace", wantLen: 1},
+		{name: "other namespace", watchNamespace: "other", wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSnapshotController(newTestTagger(), cache.NewStore(cache.MetaNamespaceKeyFunc), cache.NewStore(cache.MetaNamespaceKeyFunc), nil, volumeTaggers{})
+			defer c.queue.ShutDown()
+			c.enqueueSnapshotOf(newTestVolumeSnapshotContent(AWS_EBS_CSI, stringPtr("snap-1234")), tt.watchNamespace)
+			if got := c.queue.Len(); got != tt.wantLen {
+				t.Errorf("queue length = %v, want %v", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func Test_volumeSnapshotFromUnstructured(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata":   map[string]interface{}{"name": "db-backup", "namespace": "my-namespace"},
+		"spec": map[string]interface{}{
+			"volumeSnapshotClassName": "csi-aws-vsc",
+			"source":                  map[string]interface{}{"persistentVolumeClaimName": "db"},
+		},
+		"status": map[string]interface{}{"boundVolumeSnapshotContentName": "snapcontent-1", "readyToUse": true},
+	}}
+
+	obj, err := volumeSnapshotFromUnstructured(u)
+	if err != nil {
+		t.Fatalf("volumeSnapshotFromUnstructured() err = %v", err)
+	}
+	snapshot, ok := obj.(*volumeSnapshot)
+	if !ok {
+		t.Fatalf("volumeSnapshotFromUnstructured() not a volumeSnapshot: %T", obj)
+	}
+	if snapshot.GetName() != "db-backup" || snapshot.contentName() != "snapcontent-1" || *snapshot.Spec.Source.PersistentVolumeClaimName != "db" {
+		t.Errorf("volumeSnapshotFromUnstructured() = %+v", snapshot)
+	}
+
+	u = &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshotContent",
+		"metadata":   map[string]interface{}{"name": "snapcontent-1"},
+		"spec": map[string]interface{}{
+			"driver":            AWS_EBS_CSI,
+			"volumeSnapshotRef": map[string]interface{}{"namespace": "my-namespace", "name": "db-backup"},
+		},
+		"status": map[string]interface{}{"snapshotHandle": "snap-1234"},
+	}}
+	obj, err = volumeSnapshotContentFromUnstructured(u)
+	if err != nil {
+		t.Fatalf("volumeSnapshotContentFromUnstructured() err = %v", err)
+	}
+	content, ok := obj.(*volumeSnapshotContent)
+	if !ok {
+		t.Fatalf("volumeSnapshotContentFromUnstructured() not a volumeSnapshotContent: %T", obj)
+	}
+	if content.snapshotHandle() != "snap-1234" || content.Spec.Driver != AWS_EBS_CSI || content.Spec.VolumeSnapshotRef.Name != "db-backup" {
+		t.Errorf("volumeSnapshotContentFromUnstructured() = %+v", content)
+	}
+}
@@ -0,0 +1,170 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the Events recorded on the PVCs
+const (
+	eventReasonTagsApplied = "TagsApplied"
+	eventReasonTagsSkipped = "TagsSkipped"
+	eventReasonTagsFailed  = "TagsFailed"
+)
+
+// tagStatus is the value of the status annotation written on the PVCs
+type tagStatus struct {
+	// TagsHash is the hash of the tags last applied to the volume
+	TagsHash string `json:"tagsHash,omitempty"`
+	// Time is when the status was last updated
+	Time string `json:"time"`
+	// Error is why the last attempt to tag the volume failed
+	Error string `json:"error,omitempty"`
+	// Warnings are the tags of the PVC's annotation that were skipped
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// statusAnnotation is the PVC annotation holding the tagStatus
+func (t *Tagger) statusAnnotation() string {
+	return t.settings.AnnotationPrefix + "/status"
+}
+
+// newEventRecorder returns a recorder of the Events of k8s-pvc-tagger. The events are
+// sent until the ctx is done.
+func newEventRecorder(ctx context.Context, client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartStructuredLogging(0)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8s-pvc-tagger"})
+}
+
+// tagsHash returns a hash of the tags that doesn't depend on their order
+func tagsHash(tags map[string]string) string {
+	// json.Marshal sorts the map keys
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16]
+}
+
+// getPVCStatus returns the tagStatus of the PVC's annotation
+func (t *Tagger) getPVCStatus(pvc *corev1.PersistentVolumeClaim) tagStatus {
+	var status tagStatus
+	if value, ok := pvc.GetAnnotations()[t.statusAnnotation()]; ok {
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Debugln("Invalid status annotation, ignoring it:", err)
+		}
+	}
+	return status
+}
+
+// tagsAnnotationWarnings returns why tags of the PVC's tags annotation are skipped or
+// not rendered by buildTags.
+func (t *Tagger) tagsAnnotationWarnings(pvc *corev1.PersistentVolumeClaim) []string {
+	annotation, tagString, ok := t.tagsAnnotation(pvc.GetAnnotations())
+	if !ok {
+		return nil
+	}
+	invalid, _ := t.validateTagsAnnotation(annotation, tagString, nil)
+	return invalid
+}
+
+// pvcStatusReport is what reportStatus reads from the settings about a PVC, read once
+// under the settingsLock so the lock isn't held during the API calls of reportStatus
+type pvcStatusReport struct {
+	// annotation is the name of the status annotation
+	annotation string
+	oldStatus  tagStatus
+	warnings   []string
+}
+
+// newPVCStatusReport returns the pvcStatusReport of the PVC. The caller holds the settingsLock.
+func (t *Tagger) newPVCStatusReport(pvc *corev1.PersistentVolumeClaim) pvcStatusReport {
+	return pvcStatusReport{
+		annotation: t.statusAnnotation(),
+		oldStatus:  t.getPVCStatus(pvc),
+		warnings:   t.tagsAnnotationWarnings(pvc),
+	}
+}
+
+// reportStatus records an Event on the PVC and updates its status annotation with the
+// outcome of tagging its volume with tags. Nothing is reported when the status didn't change.
+func (c *pvcController) reportStatus(ctx context.Context, pvc *corev1.PersistentVolumeClaim, report pvcStatusReport, tags map[string]string, tagErr error) {
+	if c.tagger.dryRun || c.recorder == nil {
+		return
+	}
+
+	oldStatus := report.oldStatus
+	status := tagStatus{
+		TagsHash: oldStatus.TagsHash,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Warnings: report.warnings,
+	}
+	if tagErr != nil {
+		status.Error = tagErr.Error()
+	} else {
+		status.TagsHash = tagsHash(tags)
+	}
+	if status.TagsHash == oldStatus.TagsHash && status.Error == oldStatus.Error && slices.Equal(status.Warnings, oldStatus.Warnings) {
+		return
+	}
+
+	if tagErr != nil {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, eventReasonTagsFailed, "Failed to tag volume: %s", tagErr)
+	} else {
+		c.recorder.Eventf(pvc, corev1.EventTypeNormal, eventReasonTagsApplied, "Applied %d tags to volume", len(tags))
+	}
+	if len(status.Warnings) > 0 {
+		c.recorder.Eventf(pvc, corev1.EventTypeWarning, eventReasonTagsSkipped, "Skipped tags: %s", strings.Join(status.Warnings, "; "))
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{report.annotation: string(data)},
+		},
+	})
+	if err != nil {
+		return
+	}
+	_, err = c.tagger.client.CoreV1().PersistentVolumeClaims(pvc.GetNamespace()).Patch(ctx, pvc.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Errorln("Cannot update status annotation:", err)
+	}
+}
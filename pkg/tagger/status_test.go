@@ -0,0 +1,157 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_tagsAnnotationWarnings(t *testing.T) {
+	tests := []struct {
+		name        string
+		tagFormat   string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name: "no tags annotation",
+			want: nil,
+		},
+		{
+			name:        "valid tags",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"{{ .Namespace }}\"}"},
+			want:        nil,
+		},
+		{
+			name:        "invalid json",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"bar\""},
+			want:        []string{"invalid JSON in k8s-pvc-tagger/tags annotation: unexpected end of JSON input"},
+		},
+		{
+			name:        "restricted tags and invalid template",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"Name\": \"foo\", \"kubernetes.io/foo\": \"bar\", \"owner\": \"{{ .Labels\"}"},
+			want: []string{
+				"Name is a restricted tag",
+				"kubernetes.io/foo is a restricted tag",
+				"invalid template in tag owner: template: tag:1: unclosed action",
+			},
+		},
+		{
+			name:        "legacy annotation",
+			annotations: map[string]string{"aws-ebs-tagger/tags": "{\"Name\": \"foo\"}"},
+			want:        []string{"Name is a restricted tag"},
+		},
+		{
+			name:        "invalid csv pairs",
+			tagFormat:   "csv",
+			annotations: map[string]string{"k8s-pvc-tagger/tags": "foo=bar,baz,qux="},
+			want: []string{
+				"invalid csv key/value pair \"baz\" in k8s-pvc-tagger/tags annotation",
+				"invalid csv key/value pair \"qux=\" in k8s-pvc-tagger/tags annotation",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			if tt.tagFormat != "" {
+				tg.settings.TagFormat = tt.tagFormat
+			}
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			if got := tg.tagsAnnotationWarnings(pvc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tagsAnnotationWarnings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tagsHash(t *testing.T) {
+	a := tagsHash(map[string]string{"foo": "bar", "env": "prod"})
+	b := tagsHash(map[string]string{"env": "prod", "foo": "bar"})
+	c := tagsHash(map[string]string{"env": "dev", "foo": "bar"})
+	if a != b {
+		t.Errorf("tagsHash() = %v and %v for the same tags", a, b)
+	}
+	if a == c {
+		t.Errorf("tagsHash() = %v for different tags", a)
+	}
+}
+
+func Test_pvcController_reportStatus(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pvc",
+			Namespace:   "my-namespace",
+			Annotations: map[string]string{"k8s-pvc-tagger/tags": "{\"foo\": \"bar\", \"Name\": \"baz\"}"},
+		},
+	}
+	c := newTestPVCController(t, nil, nil, pvc)
+	recorder := c.recorder.(*record.FakeRecorder)
+	getPVC := func() *corev1.PersistentVolumeClaim {
+		got, err := c.tagger.client.CoreV1().PersistentVolumeClaims(pvc.GetNamespace()).Get(context.Background(), pvc.GetName(), metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	events := func() []string {
+		var got []string
+		for len(recorder.Events) > 0 {
+			got = append(got, <-recorder.Events)
+		}
+		return got
+	}
+	tags := map[string]string{"foo": "bar"}
+
+	c.reportStatus(context.Background(), pvc, c.tagger.newPVCStatusReport(pvc), tags, nil)
+	want := []string{"Normal TagsApplied Applied 1 tags to volume", "Warning TagsSkipped Skipped tags: Name is a restricted tag"}
+	if got := events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	status := c.tagger.getPVCStatus(getPVC())
+	if status.TagsHash != tagsHash(tags) || status.Error != "" || !reflect.DeepEqual(status.Warnings, []string{"Name is a restricted tag"}) {
+		t.Errorf("status = %+v", status)
+	}
+
+	// an unchanged status isn't reported again
+	current := getPVC()
+	c.reportStatus(context.Background(), current, c.tagger.newPVCStatusReport(current), tags, nil)
+	if got := events(); len(got) != 0 {
+		t.Errorf("events = %v, want none", got)
+	}
+
+	// a failure keeps the hash of the tags last applied
+	current = getPVC()
+	c.reportStatus(context.Background(), current, c.tagger.newPVCStatusReport(current), map[string]string{"foo": "new"}, errors.New("throttled"))
+	want = []string{"Warning TagsFailed Failed to tag volume: throttled", "Warning TagsSkipped Skipped tags: Name is a restricted tag"}
+	if got := events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	status = c.tagger.getPVCStatus(getPVC())
+	if status.TagsHash != tagsHash(tags) || status.Error != "throttled" {
+		t.Errorf("status = %+v", status)
+	}
+}
@@ -0,0 +1,361 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package tagger tags the cloud volumes of PersistentVolumeClaims with the tags of their
+// annotations, labels, Namespace, StorageClass and TaggingPolicies.
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	AWS   = "aws"
+	AZURE = "azure"
+	GCP   = "gcp"
+	// AUTO supports the volumes of every cloud
+	AUTO = "auto"
+
+	// DefaultAnnotationPrefix is the default prefix of the annotations of k8s-pvc-tagger
+	DefaultAnnotationPrefix = "k8s-pvc-tagger"
+	// legacyAnnotationPrefix is also read while the default prefix is used
+	legacyAnnotationPrefix = "aws-ebs-tagger"
+)
+
+// Config is the configuration of a Tagger
+type Config struct {
+	// Settings are the tag settings, they can be changed later with UpdateSettings
+	Settings Settings
+	// Namespaces are the namespaces whose PVCs are tagged, all namespaces when empty
+	Namespaces []string
+	// Clouds are the cloud providers whose volumes are tagged, see ParseClouds
+	Clouds []string
+	// AWSRegion is the region of the AWS volumes, the region of the environment or the
+	// EC2 metadata region when empty
+	AWSRegion string
+	// EFSTagMode selects the resources of the EFS volumes that are tagged: EFSTagAccessPoint,
+	// the default when empty, EFSTagFileSystem or EFSTagBoth
+	EFSTagMode string
+	// ResyncPeriod is how often the tags of every bound PVC are reconciled against
+	// its cloud volume. 0 disables the periodic resync.
+	ResyncPeriod time.Duration
+	// MaxAttempts is the number of attempts of a failed tag operation before giving up on it
+	MaxAttempts int
+	// EnableTaggingPolicies merges the tags of the TaggingPolicy custom resources. It
+	// requires the TaggingPolicy CRD to be installed and a dynamic client.
+	EnableTaggingPolicies bool
+	// EnableSnapshots tags the cloud snapshots of the VolumeSnapshots of the watched namespaces.
+	// It requires the snapshot.storage.k8s.io CRDs to be installed and a dynamic client.
+	EnableSnapshots bool
+	// DryRun logs and counts the tags that would be added or removed without changing any volume
+	DryRun bool
+}
+
+// Tagger tags the cloud volumes of the PVCs
+type Tagger struct {
+	// settingsLock guards the settings: UpdateSettings writes them while the controller,
+	// the informer handlers and the webhooks read them.
+	settingsLock sync.RWMutex
+	settings     Settings
+
+	namespaces            []string
+	clouds                []string
+	awsRegion             string
+	efsTagMode            string
+	resyncPeriod          time.Duration
+	maxAttempts           int
+	enableTaggingPolicies bool
+	enableSnapshots       bool
+	dryRun                bool
+
+	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
+
+	// awsConfig is the AWS config loaded on first use by loadAWSConfig, and awsRoleConfigs
+	// are the AWS configs of each assumed role, "" for the pod credentials
+	awsMu          sync.Mutex
+	awsConfig      *aws.Config
+	awsRoleConfigs map[string]aws.Config
+
+	// informers are started by the first call of startClusterInformers
+	informersMu sync.Mutex
+	informers   *clusterInformers
+	// namespaceLister and storageClassLister read the namespaces and the
+	// storage classes of the PVCs from the informer caches
+	namespaceLister    corelisters.NamespaceLister
+	storageClassLister storagelisters.StorageClassLister
+	// taggingPolicyStore holds the TaggingPolicies merged by buildTags,
+	// nil unless EnableTaggingPolicies is set.
+	taggingPolicyStore cache.Store
+
+	// subscribers are notified after each change of the settings
+	subscribers struct {
+		sync.Mutex
+		chans []chan struct{}
+	}
+}
+
+// New returns a Tagger of the cfg using the client. The dynamicClient is only required
+// by the TaggingPolicies, the VolumeSnapshots and the Azure NetApp Files volumes.
+func New(cfg Config, client kubernetes.Interface, dynamicClient dynamic.Interface) (*Tagger, error) {
+	if client == nil {
+		return nil, errors.New("a kubernetes client is required")
+	}
+	if err := cfg.Settings.validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	if len(cfg.Clouds) == 0 {
+		return nil, errors.New("at least one cloud provider is required")
+	}
+	for _, c := range cfg.Clouds {
+		if c != AWS && c != GCP && c != AZURE {
+			return nil, fmt.Errorf("unsupported cloud provider %q, must be aws, gcp or azure", c)
+		}
+	}
+	switch cfg.EFSTagMode {
+	case "":
+		cfg.EFSTagMode = EFSTagAccessPoint
+	case EFSTagAccessPoint, EFSTagFileSystem, EFSTagBoth:
+	default:
+		return nil, fmt.Errorf("unsupported EFS tag mode %q, must be %s, %s or %s", cfg.EFSTagMode, EFSTagAccessPoint, EFSTagFileSystem, EFSTagBoth)
+	}
+	if cfg.MaxAttempts < 1 {
+		return nil, errors.New("max attempts must be at least 1")
+	}
+	if cfg.ResyncPeriod < 0 {
+		return nil, errors.New("resync period cannot be negative")
+	}
+	if cfg.EnableTaggingPolicies && dynamicClient == nil {
+		return nil, errors.New("the TaggingPolicies require a dynamic client")
+	}
+	if cfg.EnableSnapshots && dynamicClient == nil {
+		return nil, errors.New("the VolumeSnapshots require a dynamic client")
+	}
+
+	t := &Tagger{
+		namespaces:            cfg.Namespaces,
+		clouds:                cfg.Clouds,
+		awsRegion:             cfg.AWSRegion,
+		efsTagMode:            cfg.EFSTagMode,
+		resyncPeriod:          cfg.ResyncPeriod,
+		maxAttempts:           cfg.MaxAttempts,
+		enableTaggingPolicies: cfg.EnableTaggingPolicies,
+		enableSnapshots:       cfg.EnableSnapshots,
+		dryRun:                cfg.DryRun,
+		client:                client,
+		dynamicClient:         dynamicClient,
+	}
+	t.setSettings(cfg.Settings)
+	return t, nil
+}
+
+// Settings returns the current tag settings
+func (t *Tagger) Settings() Settings {
+	t.settingsLock.RLock()
+	defer t.settingsLock.RUnlock()
+	return t.settings
+}
+
+// UpdateSettings validates and applies the tag settings. When they changed the volumes
+// of every PVC are tagged again. The AnnotationPrefix can't be changed: the managed tags
+// and status annotations recorded with the current prefix would be orphaned, and the
+// managed tags no longer removed from the volumes.
+func (t *Tagger) UpdateSettings(s Settings) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	current := t.Settings()
+	if s.AnnotationPrefix != current.AnnotationPrefix {
+		return fmt.Errorf("annotationPrefix cannot be changed from %q to %q without a restart", current.AnnotationPrefix, s.AnnotationPrefix)
+	}
+	if reflect.DeepEqual(s, current) {
+		return nil
+	}
+	t.setSettings(s)
+	t.notifySettingsChange()
+	return nil
+}
+
+// setSettings replaces the tag settings
+func (t *Tagger) setSettings(s Settings) {
+	t.settingsLock.Lock()
+	t.settings = s
+	t.settingsLock.Unlock()
+
+	log.WithFields(log.Fields{"tags": s.DefaultTags}).Infoln("Default Tags")
+	log.WithFields(log.Fields{
+		"tagFormat":           s.TagFormat,
+		"allowAllTags":        s.AllowAllTags,
+		"annotationPrefix":    s.AnnotationPrefix,
+		"copyLabels":          s.CopyLabels,
+		"copyAnnotations":     s.CopyAnnotations,
+		"copyNamespaceLabels": s.CopyNamespaceLabels,
+	}).Infoln("Settings applied")
+}
+
+// Run tags the volumes of the PVCs of the watched namespaces until the ctx is done
+func (t *Tagger) Run(ctx context.Context) error {
+	// PersistentVolumes, Namespaces, StorageClasses, TaggingPolicies and
+	// VolumeSnapshotContents are cluster scoped
+	// so a single informer is shared by every watched namespace.
+	sharedInformers, err := t.startClusterInformers(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Cloud clients are created on first use by any of the namespaces
+	taggers := t.newVolumeTaggers(ctx)
+	var snapshotTaggers volumeTaggers
+	if t.enableSnapshots {
+		snapshotTaggers = t.newSnapshotTaggers(ctx)
+	}
+	recorder := newEventRecorder(ctx, t.client)
+
+	namespaces := t.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	var wg sync.WaitGroup
+	for _, ns := range namespaces {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.runWatchNamespaceTask(ctx, ns, *sharedInformers, taggers, snapshotTaggers, recorder)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// startClusterInformers starts the informers of the cluster scoped resources used by buildTags
+// and processPersistentVolumeClaim, and sets their listers. The informers are only started by
+// the first call, until its ctx is done, and shared with the later ones.
+func (t *Tagger) startClusterInformers(ctx context.Context) (*clusterInformers, error) {
+	t.informersMu.Lock()
+	defer t.informersMu.Unlock()
+	if t.informers != nil {
+		return t.informers, nil
+	}
+
+	clusterFactory := informers.NewSharedInformerFactory(t.client, 0)
+	sharedInformers := &clusterInformers{
+		pv:             clusterFactory.Core().V1().PersistentVolumes(),
+		namespaces:     clusterFactory.Core().V1().Namespaces(),
+		storageClasses: clusterFactory.Storage().V1().StorageClasses(),
+	}
+	sharedInformers.pv.Informer()
+	sharedInformers.namespaces.Informer()
+	sharedInformers.storageClasses.Informer()
+	t.namespaceLister = sharedInformers.namespaces.Lister()
+	t.storageClassLister = sharedInformers.storageClasses.Lister()
+	if t.enableTaggingPolicies {
+		policyFactory := dynamicinformer.NewDynamicSharedInformerFactory(t.dynamicClient, 0)
+		sharedInformers.taggingPolicies = policyFactory.ForResource(taggingPolicyGVR).Informer()
+		if err := sharedInformers.taggingPolicies.SetTransform(taggingPolicyFromUnstructured); err != nil {
+			return nil, fmt.Errorf("cannot setup TaggingPolicy informer: %w", err)
+		}
+		t.taggingPolicyStore = sharedInformers.taggingPolicies.GetStore()
+		policyFactory.Start(ctx.Done())
+	}
+	if t.enableSnapshots {
+		contentFactory := dynamicinformer.NewDynamicSharedInformerFactory(t.dynamicClient, 0)
+		sharedInformers.snapshotContents = contentFactory.ForResource(volumeSnapshotContentGVR).Informer()
+		if err := sharedInformers.snapshotContents.SetTransform(volumeSnapshotContentFromUnstructured); err != nil {
+			return nil, fmt.Errorf("cannot setup VolumeSnapshotContent informer: %w", err)
+		}
+		contentFactory.Start(ctx.Done())
+	}
+	clusterFactory.Start(ctx.Done())
+	t.informers = sharedInformers
+	return sharedInformers, nil
+}
+
+// hasSynced returns the HasSynced funcs of the informers
+func (i clusterInformers) hasSynced() []cache.InformerSynced {
+	cacheSyncs := []cache.InformerSynced{
+		i.pv.Informer().HasSynced,
+		i.namespaces.Informer().HasSynced,
+		i.storageClasses.Informer().HasSynced,
+	}
+	if i.taggingPolicies != nil {
+		cacheSyncs = append(cacheSyncs, i.taggingPolicies.HasSynced)
+	}
+	if i.snapshotContents != nil {
+		cacheSyncs = append(cacheSyncs, i.snapshotContents.HasSynced)
+	}
+	return cacheSyncs
+}
+
+func (t *Tagger) runWatchNamespaceTask(ctx context.Context, namespace string, sharedInformers clusterInformers, taggers volumeTaggers, snapshotTaggers volumeTaggers, recorder record.EventRecorder) {
+	// Make the informer's channel here so we can close it when the
+	// context is Done()
+	ch := make(chan struct{})
+	factory := t.newNamespaceInformerFactory(namespace)
+	go t.watchForPersistentVolumeClaims(ctx, ch, namespace, factory, sharedInformers, taggers, recorder)
+	if t.enableSnapshots {
+		go t.watchForVolumeSnapshots(ctx, ch, namespace, factory, sharedInformers, snapshotTaggers)
+	}
+
+	<-ctx.Done()
+	close(ch)
+}
+
+// ParseClouds returns the clouds of a comma-separated list, or every cloud for auto.
+func ParseClouds(value string) ([]string, error) {
+	if strings.TrimSpace(strings.ToLower(value)) == AUTO {
+		return []string{AWS, GCP, AZURE}, nil
+	}
+
+	var result []string
+	for _, c := range strings.Split(value, ",") {
+		c = strings.TrimSpace(strings.ToLower(c))
+		switch c {
+		case "":
+			continue
+		case AWS, GCP, AZURE:
+			if !slices.Contains(result, c) {
+				result = append(result, c)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported cloud provider %q, must be aws, gcp, azure or auto", c)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("at least one cloud provider is required")
+	}
+	return result, nil
+}
@@ -0,0 +1,155 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestTagger returns a Tagger of the default settings using a fake client
+func newTestTagger() *Tagger {
+	return &Tagger{
+		settings: Settings{
+			DefaultTags:      map[string]string{},
+			TagFormat:        "json",
+			AnnotationPrefix: DefaultAnnotationPrefix,
+		},
+		clouds:      []string{AWS},
+		maxAttempts: 5,
+		client:      fake.NewClientset(),
+	}
+}
+
+func Test_New(t *testing.T) {
+	validSettings := Settings{TagFormat: "json", AnnotationPrefix: DefaultAnnotationPrefix}
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{
+			name: "valid config",
+			cfg:  Config{Settings: validSettings, Clouds: []string{AWS, GCP}, MaxAttempts: 5},
+		},
+		{
+			name:    "invalid settings",
+			cfg:     Config{Settings: Settings{TagFormat: "xml", AnnotationPrefix: DefaultAnnotationPrefix}, Clouds: []string{AWS}, MaxAttempts: 5},
+			wantErr: true,
+		},
+		{
+			name:    "no clouds",
+			cfg:     Config{Settings: validSettings, MaxAttempts: 5},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported cloud",
+			cfg:     Config{Settings: validSettings, Clouds: []string{"oci"}, MaxAttempts: 5},
+			wantErr: true,
+		},
+		{
+			name:    "no attempts",
+			cfg:     Config{Settings: validSettings, Clouds: []string{AWS}},
+			wantErr: true,
+		},
+		{
+			name:    "negative resync period",
+			cfg:     Config{Settings: validSettings, Clouds: []string{AWS}, MaxAttempts: 5, ResyncPeriod: -1},
+			wantErr: true,
+		},
+		{
+			name:    "tagging policies without a dynamic client",
+			cfg:     Config{Settings: validSettings, Clouds: []string{AWS}, MaxAttempts: 5, EnableTaggingPolicies: true},
+			wantErr: true,
+		},
+		{
+			name:    "invalid EFS tag mode",
+			cfg:     Config{Settings: validSettings, Clouds: []string{AWS}, MaxAttempts: 5, EFSTagMode: "mount-target"},
+			wantErr: true,
+		},
+		{
+			name:    "snapshots without a dynamic client",
+			cfg:     Config{Settings: validSettings, Clouds: []string{AWS}, MaxAttempts: 5, EnableSnapshots: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.cfg, fake.NewClientset(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got.Settings(), tt.cfg.Settings) {
+				t.Errorf("New() settings = %v, want %v", got.Settings(), tt.cfg.Settings)
+			}
+		})
+	}
+
+	if _, err := New(Config{Settings: validSettings, Clouds: []string{AWS}, MaxAttempts: 5}, nil, nil); err == nil {
+		t.Errorf("New() without a client should fail")
+	}
+}
+
+func Test_ParseClouds(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "single cloud",
+			value: "aws",
+			want:  []string{AWS},
+		},
+		{
+			name:  "list of clouds",
+			value: "gcp, Azure,gcp",
+			want:  []string{GCP, AZURE},
+		},
+		{
+			name:  "auto",
+			value: "auto",
+			want:  []string{AWS, GCP, AZURE},
+		},
+		{
+			name:    "unsupported cloud",
+			value:   "aws,oci",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			value:   " , ",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClouds(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseClouds() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseClouds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+// VolumeTagger reads and changes the tags of the cloud volumes of one storage backend.
+type VolumeTagger interface {
+	// GetTags returns the tags currently set on the volume.
+	GetTags(ctx context.Context, volumeID string) (map[string]string, error)
+	// SetTags adds the tags to the volume, overwriting the value of existing keys.
+	SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error
+	// RemoveTags removes the tag keys from the volume.
+	RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error
+}
+
+// tagSanitizer is implemented by taggers whose cloud doesn't accept every tag as is.
+// It returns the tags the way SetTags writes them, so they can be compared with GetTags.
+type tagSanitizer interface {
+	SanitizeTags(tags map[string]string) (map[string]string, error)
+}
+
+// removableTagsGetter is implemented by taggers whose RemoveTags doesn't remove the keys
+// from every resource of the volume, e.g. never from a resource shared with other volumes.
+type removableTagsGetter interface {
+	// RemovableTags returns the keys RemoveTags would remove from the volume, the way
+	// they are written in the cloud.
+	RemovableTags(ctx context.Context, volumeID string, keys []string) ([]string, error)
+}
+
+// removableTags returns the keys the tagger would remove from the volume: the keys set on
+// it, unless the tagger is a removableTagsGetter.
+func removableTags(ctx context.Context, tagger VolumeTagger, volumeID string, keys []string) ([]string, error) {
+	if getter, ok := tagger.(removableTagsGetter); ok {
+		return getter.RemovableTags(ctx, volumeID, keys)
+	}
+	return setTagKeys(ctx, tagger, volumeID, keys)
+}
+
+// setTagKeys returns the keys set on the volume, sanitized the way the tagger writes them
+func setTagKeys(ctx context.Context, tagger VolumeTagger, volumeID string, keys []string) ([]string, error) {
+	keyTags := make(map[string]string, len(keys))
+	for _, k := range keys {
+		keyTags[k] = ""
+	}
+	if sanitizer, ok := tagger.(tagSanitizer); ok {
+		var err error
+		if keyTags, err = sanitizer.SanitizeTags(keyTags); err != nil {
+			return nil, err
+		}
+	}
+	currentTags, err := tagger.GetTags(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var setKeys []string
+	for k := range keyTags {
+		if _, ok := currentTags[k]; ok {
+			setKeys = append(setKeys, k)
+		}
+	}
+	slices.Sort(setKeys)
+	return setKeys, nil
+}
+
+// volumeTaggers maps CSI driver (provisioner) names to the tagger of their volumes.
+type volumeTaggers map[string]VolumeTagger
+
+func (t volumeTaggers) register(tagger VolumeTagger, drivers ...string) {
+	for _, driver := range drivers {
+		t[driver] = tagger
+	}
+}
+
+func (t volumeTaggers) get(driver string) (VolumeTagger, bool) {
+	tagger, ok := t[driver]
+	return tagger, ok
+}
+
+// VolumeBackend is a storage backend whose cloud volumes are tagged, registered with
+// RegisterVolumeBackend.
+type VolumeBackend struct {
+	// Cloud is the cloud, AWS, GCP or AZURE, whose Taggers tag the volumes of the backend.
+	Cloud string
+	// Drivers are the CSI drivers (provisioners) of the volumes of the backend.
+	Drivers []string
+	// Name is the name the volumes are registered under when the backend shares its drivers
+	// with another backend, empty to register them under their driver.
+	Name string
+	// VolumeID returns the ID of the cloud volume of the PV, or "" without error when the PV
+	// isn't a volume of the backend but maybe of another backend of its driver. storageClass
+	// is nil when the PVC has none or it's unknown.
+	VolumeID func(pv *corev1.PersistentVolume, storageClass *storagev1.StorageClass) (string, error)
+	// NewTagger creates the tagger of the volumes the first time one of them is tagged.
+	// A failed creation is attempted again on the next call.
+	NewTagger func(ctx context.Context, t *Tagger) (VolumeTagger, error)
+	// NewSnapshotTagger creates the tagger of the CSI snapshots of the volumes, nil when
+	// they aren't tagged.
+	NewSnapshotTagger func(ctx context.Context, t *Tagger) (VolumeTagger, error)
+	// SanitizeTags returns the tags the way the taggers write them, nil when the cloud
+	// accepts every tag as is. It can't need the cloud client, see tagSanitizer.
+	SanitizeTags func(tags map[string]string) (map[string]string, error)
+}
+
+// names returns the names the volumes of the backend are registered under
+func (b VolumeBackend) names() []string {
+	if b.Name != "" {
+		return []string{b.Name}
+	}
+	return b.Drivers
+}
+
+var (
+	volumeBackendsMu sync.RWMutex
+	volumeBackends   []VolumeBackend
+)
+
+// RegisterVolumeBackend registers a storage backend for the Taggers created afterwards,
+// usually from an init function. It panics when the backend is incomplete or one of its
+// names is already registered.
+func RegisterVolumeBackend(backend VolumeBackend) {
+	if backend.Cloud != AWS && backend.Cloud != GCP && backend.Cloud != AZURE {
+		panic(fmt.Sprintf("tagger: unsupported cloud provider %q of volume backend %v", backend.Cloud, backend.names()))
+	}
+	if len(backend.Drivers) == 0 || backend.VolumeID == nil || backend.NewTagger == nil {
+		panic(fmt.Sprintf("tagger: volume backend %v needs Drivers, VolumeID and NewTagger", backend.names()))
+	}
+	volumeBackendsMu.Lock()
+	defer volumeBackendsMu.Unlock()
+	for _, registered := range volumeBackends {
+		for _, name := range backend.names() {
+			if slices.Contains(registered.names(), name) {
+				panic("tagger: volume backend registered twice for " + name)
+			}
+		}
+	}
+	volumeBackends = append(volumeBackends, backend)
+}
+
+// registeredVolumeBackends returns the registered backends, in registration order
+func registeredVolumeBackends() []VolumeBackend {
+	volumeBackendsMu.RLock()
+	defer volumeBackendsMu.RUnlock()
+	return slices.Clone(volumeBackends)
+}
+
+// backendVolumeID returns the ID of the cloud volume of the PV provisioned by driver and the
+// name its tagger is registered under, given by the first backend of the driver the PV is a
+// volume of. The ID is empty when the PV isn't a volume of any of them.
+func backendVolumeID(driver string, pv *corev1.PersistentVolume, storageClass *storagev1.StorageClass) (string, string, error) {
+	found := false
+	for _, backend := range registeredVolumeBackends() {
+		if !slices.Contains(backend.Drivers, driver) {
+			continue
+		}
+		found = true
+		volumeID, err := backend.VolumeID(pv, storageClass)
+		if err != nil {
+			return "", "", err
+		}
+		if volumeID == "" {
+			continue
+		}
+		if backend.Name != "" {
+			return volumeID, backend.Name, nil
+		}
+		return volumeID, driver, nil
+	}
+	if !found {
+		return "", "", fmt.Errorf("no volume backend registered for %s", driver)
+	}
+	return "", "", nil
+}
+
+// csiVolumeHandle returns the volume handle of a CSI PV
+func csiVolumeHandle(pv *corev1.PersistentVolume) (string, error) {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle == "" {
+		return "", errors.New("the PV has no CSI volume handle")
+	}
+	return pv.Spec.CSI.VolumeHandle, nil
+}
+
+// lazyVolumeTagger creates its tagger, and the cloud client behind it, the first time
+// one of its volumes is tagged. A failed creation is attempted again on the next call.
+// The tags are sanitized by sanitize, nil when the cloud accepts every tag as is, so an
+// invalid tag set is told apart from a client that can't be created yet.
+type lazyVolumeTagger struct {
+	mu        sync.Mutex
+	newTagger func() (VolumeTagger, error)
+	sanitize  func(tags map[string]string) (map[string]string, error)
+	tagger    VolumeTagger
+}
+
+func newLazyVolumeTagger(newTagger func() (VolumeTagger, error), sanitize func(tags map[string]string) (map[string]string, error)) *lazyVolumeTagger {
+	return &lazyVolumeTagger{newTagger: newTagger, sanitize: sanitize}
+}
+
+func (l *lazyVolumeTagger) get() (VolumeTagger, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tagger != nil {
+		return l.tagger, nil
+	}
+	tagger, err := l.newTagger()
+	if err != nil {
+		return nil, err
+	}
+	l.tagger = tagger
+	return tagger, nil
+}
+
+func (l *lazyVolumeTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	tagger, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return tagger.GetTags(ctx, volumeID)
+}
+
+func (l *lazyVolumeTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	tagger, err := l.get()
+	if err != nil {
+		return err
+	}
+	return tagger.SetTags(ctx, volumeID, tags, storageclass)
+}
+
+func (l *lazyVolumeTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	tagger, err := l.get()
+	if err != nil {
+		return err
+	}
+	return tagger.RemoveTags(ctx, volumeID, keys, storageclass)
+}
+
+func (l *lazyVolumeTagger) RemovableTags(ctx context.Context, volumeID string, keys []string) ([]string, error) {
+	tagger, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return removableTags(ctx, tagger, volumeID, keys)
+}
+
+func (l *lazyVolumeTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	if l.sanitize == nil {
+		return tags, nil
+	}
+	return l.sanitize(tags)
+}
+
+// dryRunVolumeTagger records the tag changes of its tagger instead of making them.
+// Tags are still read from the cloud so only the actual changes are recorded.
+type dryRunVolumeTagger struct {
+	tagger VolumeTagger
+}
+
+func (d *dryRunVolumeTagger) GetTags(ctx context.Context, volumeID string) (map[string]string, error) {
+	return d.tagger.GetTags(ctx, volumeID)
+}
+
+func (d *dryRunVolumeTagger) SetTags(ctx context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	tags, err := d.sanitizeTags(tags)
+	if err != nil {
+		return err
+	}
+	currentTags, err := d.tagger.GetTags(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+
+	addedTags := diffTags(currentTags, tags)
+	if len(addedTags) == 0 {
+		log.WithFields(log.Fields{"volumeID": volumeID}).Debugln("Dry run: tags already set")
+		return nil
+	}
+	log.WithFields(log.Fields{"volumeID": volumeID, "storageclass": storageclass, "tags": addedTags}).Infoln("Dry run: would add tags")
+	promDryRunTagsTotal.With(prometheus.Labels{"action": "add", "storageclass": storageclass}).Add(float64(len(addedTags)))
+	return nil
+}
+
+// RemoveTags records the keys the tagger would remove, which are not every key set on the
+// volume when its tagger never removes tags from a shared resource.
+func (d *dryRunVolumeTagger) RemoveTags(ctx context.Context, volumeID string, keys []string, storageclass string) error {
+	removedKeys, err := removableTags(ctx, d.tagger, volumeID, keys)
+	if err != nil {
+		return err
+	}
+	if len(removedKeys) == 0 {
+		log.WithFields(log.Fields{"volumeID": volumeID}).Debugln("Dry run: tags already removed")
+		return nil
+	}
+	log.WithFields(log.Fields{"volumeID": volumeID, "storageclass": storageclass, "tags": removedKeys}).Infoln("Dry run: would remove tags")
+	promDryRunTagsTotal.With(prometheus.Labels{"action": "remove", "storageclass": storageclass}).Add(float64(len(removedKeys)))
+	return nil
+}
+
+func (d *dryRunVolumeTagger) SanitizeTags(tags map[string]string) (map[string]string, error) {
+	return d.sanitizeTags(tags)
+}
+
+// sanitizeTags returns the tags the way the tagger would write them
+func (d *dryRunVolumeTagger) sanitizeTags(tags map[string]string) (map[string]string, error) {
+	if sanitizer, ok := d.tagger.(tagSanitizer); ok {
+		return sanitizer.SanitizeTags(tags)
+	}
+	return tags, nil
+}
+
+// newVolumeTaggers registers a tagger for each of the volume backends of the clouds.
+// The cloud clients are created lazily.
+func (t *Tagger) newVolumeTaggers(ctx context.Context) volumeTaggers {
+	taggers := volumeTaggers{}
+	for _, backend := range registeredVolumeBackends() {
+		if !slices.Contains(t.clouds, backend.Cloud) {
+			continue
+		}
+		taggers.register(newLazyVolumeTagger(func() (VolumeTagger, error) {
+			return backend.NewTagger(ctx, t)
+		}, backend.SanitizeTags), backend.names()...)
+	}
+
+	if t.dryRun {
+		for driver, tagger := range taggers {
+			taggers[driver] = &dryRunVolumeTagger{tagger: tagger}
+		}
+	}
+	return taggers
+}
@@ -0,0 +1,368 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeVolumeTagger struct {
+	tags       map[string]string
+	setErr     error
+	setCalls   int
+	removeKeys []string
+}
+
+func (f *fakeVolumeTagger) GetTags(_ context.Context, volumeID string) (map[string]string, error) {
+	return maps.Clone(f.tags), nil
+}
+
+func (f *fakeVolumeTagger) SetTags(_ context.Context, volumeID string, tags map[string]string, storageclass string) error {
+	f.setCalls++
+	if f.setErr != nil {
+		return f.setErr
+	}
+	if f.tags == nil {
+		f.tags = map[string]string{}
+	}
+	maps.Copy(f.tags, tags)
+	return nil
+}
+
+func (f *fakeVolumeTagger) RemoveTags(_ context.Context, volumeID string, keys []string, storageclass string) error {
+	f.removeKeys = append(f.removeKeys, keys...)
+	for _, k := range keys {
+		delete(f.tags, k)
+	}
+	return nil
+}
+
+func Test_volumeTaggers_register(t *testing.T) {
+	ebs := &fakeVolumeTagger{}
+	efs := &fakeVolumeTagger{}
+	taggers := volumeTaggers{}
+	taggers.register(ebs, AWS_EBS_CSI, AWS_EBS_LEGACY)
+	taggers.register(efs, AWS_EFS_CSI)
+
+	tests := []struct {
+		driver string
+		want   VolumeTagger
+		wantOk bool
+	}{
+		{driver: AWS_EBS_CSI, want: ebs, wantOk: true},
+		{driver: AWS_EBS_LEGACY, want: ebs, wantOk: true},
+		{driver: AWS_EFS_CSI, want: efs, wantOk: true},
+		{driver: GCP_PD_CSI, want: nil, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			got, ok := taggers.get(tt.driver)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("get() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_RegisterVolumeBackend(t *testing.T) {
+	registered := registeredVolumeBackends()
+	t.Cleanup(func() {
+		volumeBackendsMu.Lock()
+		volumeBackends = registered
+		volumeBackendsMu.Unlock()
+	})
+
+	const driver = "example.csi.vendor.io"
+	tagger := &fakeVolumeTagger{}
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:   AWS,
+		Drivers: []string{driver},
+		VolumeID: func(pv *corev1.PersistentVolume, _ *storagev1.StorageClass) (string, error) {
+			return "example-" + pv.Spec.CSI.VolumeHandle, nil
+		},
+		NewTagger: func(context.Context, *Tagger) (VolumeTagger, error) {
+			return tagger, nil
+		},
+	})
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pvc",
+			Namespace:   "my-namespace",
+			Annotations: map[string]string{"volume.kubernetes.io/storage-provisioner": driver},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pvc-1234", StorageClassName: &dummyStorageClassName},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: "1234"},
+			},
+		},
+	}
+	tg := newTestTagger()
+	volumeID, _, provisionedBy, err := tg.processPersistentVolumeClaim(pvc, newTestPVLister(t, pv))
+	if err != nil {
+		t.Fatalf("processPersistentVolumeClaim() err = %v", err)
+	}
+	if volumeID != "example-1234" || provisionedBy != driver {
+		t.Errorf("processPersistentVolumeClaim() = %v, %v, want %v, %v", volumeID, provisionedBy, "example-1234", driver)
+	}
+
+	tg.clouds = []string{AWS}
+	backendTagger, ok := tg.newVolumeTaggers(context.Background()).get(driver)
+	if !ok {
+		t.Fatalf("newVolumeTaggers() has no tagger for %s", driver)
+	}
+	if err := backendTagger.SetTags(context.Background(), volumeID, map[string]string{"team": "storage"}, dummyStorageClassName); err != nil {
+		t.Fatalf("SetTags() err = %v", err)
+	}
+	if tagger.setCalls != 1 {
+		t.Errorf("SetTags() calls = %v, want %v", tagger.setCalls, 1)
+	}
+	tg.clouds = []string{GCP}
+	if _, ok := tg.newVolumeTaggers(context.Background()).get(driver); ok {
+		t.Errorf("newVolumeTaggers() has a tagger for %s of a disabled cloud", driver)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("RegisterVolumeBackend() didn't panic on a driver registered twice")
+		}
+	}()
+	RegisterVolumeBackend(VolumeBackend{
+		Cloud:     AWS,
+		Drivers:   []string{AWS_EBS_CSI},
+		VolumeID:  ebsVolumeID,
+		NewTagger: func(context.Context, *Tagger) (VolumeTagger, error) { return tagger, nil },
+	})
+}
+
+func Test_lazyVolumeTagger(t *testing.T) {
+	calls := 0
+	var createErr error
+	tagger := &fakeVolumeTagger{tags: map[string]string{"foo": "bar"}}
+	lazy := newLazyVolumeTagger(func() (VolumeTagger, error) {
+		calls++
+		if createErr != nil {
+			return nil, createErr
+		}
+		return tagger, nil
+	}, nil)
+
+	createErr = errors.New("no credentials")
+	if _, err := lazy.GetTags(context.Background(), "vol-1234"); err == nil {
+		t.Errorf("GetTags() expected the creation error")
+	}
+
+	createErr = nil
+	if err := lazy.SetTags(context.Background(), "vol-1234", map[string]string{"me": "touge"}, dummyStorageClassName); err != nil {
+		t.Errorf("SetTags() err = %v", err)
+	}
+	got, err := lazy.GetTags(context.Background(), "vol-1234")
+	if err != nil {
+		t.Errorf("GetTags() err = %v", err)
+	}
+	if want := map[string]string{"foo": "bar", "me": "touge"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTags() = %v, want %v", got, want)
+	}
+	if calls != 2 {
+		t.Errorf("tagger created %v times, want %v", calls, 2)
+	}
+}
+
+func Test_newVolumeTaggers(t *testing.T) {
+	tests := []struct {
+		name        string
+		clouds      []string
+		wantDrivers []string
+	}{
+		{
+			name:        "aws",
+			clouds:      []string{AWS},
+			wantDrivers: []string{AWS_EBS_CSI, AWS_EBS_CSI_AUTO, AWS_EBS_LEGACY, AWS_EFS_CSI, AWS_FSX_CSI, AWS_FSX_ONTAP_TRIDENT, AWS_FSX_OPENZFS_CSI},
+		},
+		{
+			name:        "gcp and azure",
+			clouds:      []string{GCP, AZURE},
+			wantDrivers: []string{AZURE_DISK_CSI, AZURE_FILE_CSI, AZURE_NETAPP_TRIDENT, GCP_PD_LEGACY, GCP_PD_CSI, GCP_FILESTORE_CSI},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTestTagger()
+			tg.clouds = tt.clouds
+			taggers := tg.newVolumeTaggers(context.Background())
+			got := slices.Sorted(maps.Keys(taggers))
+			want := slices.Sorted(slices.Values(tt.wantDrivers))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("newVolumeTaggers() drivers = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_dryRunVolumeTagger(t *testing.T) {
+	tests := []struct {
+		name       string
+		tags       map[string]string
+		setTags    map[string]string
+		removeKeys []string
+		wantAdded  float64
+		wantRemove float64
+	}{
+		{
+			name:      "new and changed tags",
+			tags:      map[string]string{"foo": "bar", "env": "dev"},
+			setTags:   map[string]string{"foo": "bar", "env": "prod", "team": "a"},
+			wantAdded: 2,
+		},
+		{
+			name:    "tags already set",
+			tags:    map[string]string{"foo": "bar"},
+			setTags: map[string]string{"foo": "bar"},
+		},
+		{
+			name:       "removed tags",
+			tags:       map[string]string{"foo": "bar", "env": "dev"},
+			removeKeys: []string{"env", "missing"},
+			wantRemove: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageclass := "dry-run-" + tt.name
+			fake := &fakeVolumeTagger{tags: maps.Clone(tt.tags)}
+			tagger := &dryRunVolumeTagger{tagger: fake}
+			// the metric is global, only its change is checked
+			addedBefore := testutil.ToFloat64(promDryRunTagsTotal.WithLabelValues("add", storageclass))
+			removedBefore := testutil.ToFloat64(promDryRunTagsTotal.WithLabelValues("remove", storageclass))
+
+			if err := tagger.SetTags(context.Background(), "vol-1", tt.setTags, storageclass); err != nil {
+				t.Fatalf("SetTags() error = %v", err)
+			}
+			if err := tagger.RemoveTags(context.Background(), "vol-1", tt.removeKeys, storageclass); err != nil {
+				t.Fatalf("RemoveTags() error = %v", err)
+			}
+
+			if fake.setCalls != 0 || len(fake.removeKeys) != 0 {
+				t.Errorf("dryRunVolumeTagger changed the volume: setCalls = %d, removeKeys = %v", fake.setCalls, fake.removeKeys)
+			}
+			if !reflect.DeepEqual(fake.tags, tt.tags) {
+				t.Errorf("volume tags = %v, want %v", fake.tags, tt.tags)
+			}
+			if got := testutil.ToFloat64(promDryRunTagsTotal.WithLabelValues("add", storageclass)) - addedBefore; got != tt.wantAdded {
+				t.Errorf("added tags metric = %v, want %v", got, tt.wantAdded)
+			}
+			if got := testutil.ToFloat64(promDryRunTagsTotal.WithLabelValues("remove", storageclass)) - removedBefore; got != tt.wantRemove {
+				t.Errorf("removed tags metric = %v, want %v", got, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func Test_dryRunVolumeTagger_sharedResources(t *testing.T) {
+	const scope = "subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account"
+	tests := []struct {
+		name       string
+		tagger     func() VolumeTagger
+		volumeID   string
+		wantRemove float64
+	}{
+		{
+			name: "efs access point",
+			tagger: func() VolumeTagger {
+				fake := &fakeEFS{tags: map[string]map[string]string{
+					"fs-1234":   {"team": "storage", "env": "dev"},
+					"fsap-5678": {"team": "storage"},
+				}}
+				return &EFSClient{EFSAPI: fake, tagMode: EFSTagBoth}
+			},
+			volumeID:   "fs-1234::fsap-5678",
+			wantRemove: 1,
+		},
+		{
+			name: "efs file system",
+			tagger: func() VolumeTagger {
+				fake := &fakeEFS{tags: map[string]map[string]string{"fs-1234": {"team": "storage", "env": "dev"}}}
+				return &EFSClient{EFSAPI: fake, tagMode: EFSTagBoth}
+			},
+			volumeID: "fs-1234:/data",
+		},
+		{
+			name: "azure files storage account",
+			tagger: func() VolumeTagger {
+				client := &fakeAzureClient{tags: map[string]DiskTags{scope: {"team": to.Ptr("storage"), "env": to.Ptr("dev")}}}
+				files := &azureFileVolumes{subscription: "sub"}
+				return &azureScopeTagger{client: client, resourceID: files.resourceID, shared: true}
+			},
+			volumeID: "rg#account#share",
+		},
+		{
+			name: "azure resource of one volume",
+			tagger: func() VolumeTagger {
+				client := &fakeAzureClient{tags: map[string]DiskTags{scope: {"team": to.Ptr("storage"), "env": to.Ptr("dev")}}}
+				return &azureScopeTagger{client: client, resourceID: func(context.Context, string) (string, error) { return scope, nil }}
+			},
+			volumeID:   "rg#account#share",
+			wantRemove: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageclass := "dry-run-" + tt.name
+			// the cloud taggers are created lazily, behind the dry run
+			tagger := &dryRunVolumeTagger{tagger: newLazyVolumeTagger(func() (VolumeTagger, error) {
+				return tt.tagger(), nil
+			}, nil)}
+			removedBefore := testutil.ToFloat64(promDryRunTagsTotal.WithLabelValues("remove", storageclass))
+
+			if err := tagger.RemoveTags(context.Background(), tt.volumeID, []string{"team", "env"}, storageclass); err != nil {
+				t.Fatalf("RemoveTags() error = %v", err)
+			}
+			if got := testutil.ToFloat64(promDryRunTagsTotal.WithLabelValues("remove", storageclass)) - removedBefore; got != tt.wantRemove {
+				t.Errorf("removed tags metric = %v, want %v", got, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func Test_newVolumeTaggers_dryRun(t *testing.T) {
+	tg := newTestTagger()
+	tg.clouds = []string{AWS, GCP, AZURE}
+	tg.dryRun = true
+
+	for driver, tagger := range tg.newVolumeTaggers(context.Background()) {
+		if _, ok := tagger.(*dryRunVolumeTagger); !ok {
+			t.Errorf("tagger of %s is %T, want *dryRunVolumeTagger", driver, tagger)
+		}
+	}
+}
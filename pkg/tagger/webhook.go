@@ -0,0 +1,286 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// maxAdmissionReviewSize is the largest AdmissionReview request body read by the webhook
+const maxAdmissionReviewSize = 3 * 1024 * 1024
+
+// RunWebhookServer serves the validating admission webhook over TLS, and the mutating one
+// when mutate is set. The mutating webhook starts the cluster informers, shared with Run,
+// and is only served once they are synced since buildTags reads them.
+func (t *Tagger) RunWebhookServer(ctx context.Context, port string, certFile string, keyFile string, mutate bool) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", t.admissionHandler(t.validateAdmissionRequest))
+	if mutate {
+		sharedInformers, err := t.startClusterInformers(ctx)
+		if err != nil {
+			return err
+		}
+		if !cache.WaitForCacheSync(ctx.Done(), sharedInformers.hasSynced()...) {
+			return errors.New("timed out waiting for the informers of the admission webhook to sync")
+		}
+		mux.HandleFunc("/mutate", t.admissionHandler(t.mutateAdmissionRequest))
+	}
+	server := &http.Server{
+		Addr:              "0.0.0.0:" + port,
+		ReadHeaderTimeout: 3 * time.Second,
+		Handler:           mux,
+	}
+	log.WithFields(log.Fields{"port": port, "mutate": mutate}).Infoln("Starting admission webhook")
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// admissionHandler answers AdmissionReviews with the response of review, called with
+// the settingsLock held
+func (t *Tagger) admissionHandler(review func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAdmissionReviewSize))
+		if err != nil {
+			http.Error(w, "cannot read request", http.StatusBadRequest)
+			return
+		}
+
+		admissionReview := admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, &admissionReview); err != nil || admissionReview.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		t.settingsLock.RLock()
+		admissionReview.Response = review(admissionReview.Request)
+		t.settingsLock.RUnlock()
+		admissionReview.Response.UID = admissionReview.Request.UID
+		admissionReview.Request = nil
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(admissionReview); err != nil {
+			log.Errorln("Cannot write AdmissionReview:", err)
+		}
+	}
+}
+
+// deniedResponse returns an AdmissionResponse rejecting the request
+func deniedResponse(code int32, reason metav1.StatusReason, message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: message,
+		},
+	}
+}
+
+// validateAdmissionRequest rejects the objects with an invalid tags annotation and warns
+// about the tags the configured clouds will change. Updates that don't change the
+// annotation are always allowed so existing objects can still be modified.
+// The caller holds the settingsLock.
+func (t *Tagger) validateAdmissionRequest(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return response
+	}
+
+	obj := metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return deniedResponse(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("cannot decode object: %s", err))
+	}
+	annotation, tagString, ok := t.tagsAnnotation(obj.GetAnnotations())
+	if !ok {
+		return response
+	}
+	if req.Operation == admissionv1.Update {
+		oldObj := metav1.PartialObjectMetadata{}
+		if err := json.Unmarshal(req.OldObject.Raw, &oldObj); err == nil {
+			if _, oldTagString, ok := t.tagsAnnotation(oldObj.GetAnnotations()); ok && oldTagString == tagString {
+				return response
+			}
+		}
+	}
+
+	invalid, warnings := t.validateTagsAnnotation(annotation, tagString, t.clouds)
+	if len(invalid) > 0 {
+		log.WithFields(log.Fields{"kind": req.Kind.Kind, "namespace": req.Namespace, "name": req.Name}).Infoln("Rejected invalid tags:", invalid)
+		response = deniedResponse(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, fmt.Sprintf("invalid %s annotation: %s", annotation, strings.Join(invalid, "; ")))
+	}
+	response.Warnings = warnings
+	return response
+}
+
+// jsonPatchOperation is an operation of the JSON patch of a mutating AdmissionResponse
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// mutateAdmissionRequest writes the tags buildTags computes for a new PVC into its tags
+// annotation, so the PVC shows every tag that will be set on its volume. The rendered
+// tags replace the annotation and are merged last by buildTags, so later changes of the
+// default tags, StorageClass, Namespace or TaggingPolicies no longer override them.
+// The metrics aren't counted since the PVC may still be rejected by another webhook.
+// A PVC whose tags annotation the validating webhook rejects is rejected as well.
+// The caller holds the settingsLock.
+func (t *Tagger) mutateAdmissionRequest(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Operation != admissionv1.Create || req.Kind.Kind != "PersistentVolumeClaim" {
+		return response
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := json.Unmarshal(req.Object.Raw, pvc); err != nil {
+		return deniedResponse(http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("cannot decode object: %s", err))
+	}
+	// the namespace isn't always set on the object of the request
+	if pvc.GetNamespace() == "" {
+		pvc.SetNamespace(req.Namespace)
+	}
+	// buildTags drops the invalid tags, the PVC is rejected instead of having them
+	// silently removed from its annotation
+	if annotation, tagString, ok := t.tagsAnnotation(pvc.GetAnnotations()); ok {
+		if invalid, _ := t.validateTagsAnnotation(annotation, tagString, t.clouds); len(invalid) > 0 {
+			log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName()}).Infoln("Rejected invalid tags:", invalid)
+			return deniedResponse(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, fmt.Sprintf("invalid %s annotation: %s", annotation, strings.Join(invalid, "; ")))
+		}
+	}
+	pvc = getPVC(pvc)
+	if pvc.Spec.StorageClassName == nil {
+		storageClassName := ""
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+
+	tags := t.mergedTags(pvc, false)
+	// A PVC created with generateName has no name yet. The templates reading it are
+	// written unrendered so they're rendered with the generated name when tagging.
+	unrenderedTags := map[string]string{}
+	if pvc.GetName() == "" {
+		for k, v := range tags {
+			if templateUsesName(v) {
+				unrenderedTags[k] = v
+				delete(tags, k)
+			}
+		}
+	}
+	tags = t.renderTagTemplates(pvc, tags)
+	maps.Copy(tags, unrenderedTags)
+	if len(tags) == 0 {
+		return response
+	}
+	tagString, skipped := t.formatTags(tags)
+	for _, k := range skipped {
+		response.Warnings = append(response.Warnings, fmt.Sprintf("tag %s cannot be written in the %s format of the %s/tags annotation", k, t.settings.TagFormat, t.settings.AnnotationPrefix))
+	}
+	annotation := t.settings.AnnotationPrefix + "/tags"
+	annotations := pvc.GetAnnotations()
+	if current, ok := annotations[annotation]; ok && current == tagString {
+		return response
+	}
+
+	var operation jsonPatchOperation
+	if annotations == nil {
+		operation = jsonPatchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{annotation: tagString}}
+	} else {
+		// "add" replaces the value of an existing annotation
+		operation = jsonPatchOperation{Op: "add", Path: "/metadata/annotations/" + jsonPointerEscaper.Replace(annotation), Value: tagString}
+	}
+	patch, err := json.Marshal([]jsonPatchOperation{operation})
+	if err != nil {
+		return deniedResponse(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("cannot encode patch: %s", err))
+	}
+	log.WithFields(log.Fields{"namespace": pvc.GetNamespace(), "pvc": pvc.GetName(), "tags": tags}).Debugln("Setting the tags annotation")
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = patch
+	response.PatchType = &patchType
+	return response
+}
+
+// jsonPointerEscaper escapes a key of a JSON pointer, see RFC 6901
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// templateUsesName reports whether the tag template reads the name of the PVC
+func templateUsesName(value string) bool {
+	tmpl, err := template.New("tag").Parse(value)
+	if err != nil {
+		return false
+	}
+	return nodeUsesName(tmpl.Tree.Root)
+}
+
+// nodeUsesName reports whether the node of a parsed template reads the .Name field,
+// either through the dot or the $ variable.
+func nodeUsesName(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		return n != nil && slices.ContainsFunc(n.Nodes, nodeUsesName)
+	case *parse.ActionNode:
+		return nodeUsesName(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if slices.ContainsFunc(cmd.Args, nodeUsesName) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return nodeUsesName(n.Pipe) || nodeUsesName(n.List) || nodeUsesName(n.ElseList)
+	case *parse.RangeNode:
+		return nodeUsesName(n.Pipe) || nodeUsesName(n.List) || nodeUsesName(n.ElseList)
+	case *parse.WithNode:
+		return nodeUsesName(n.Pipe) || nodeUsesName(n.List) || nodeUsesName(n.ElseList)
+	case *parse.TemplateNode:
+		return nodeUsesName(n.Pipe)
+	case *parse.FieldNode:
+		return n.Ident[0] == "Name"
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == "Name"
+	case *parse.ChainNode:
+		if _, ok := n.Node.(*parse.DotNode); ok && n.Field[0] == "Name" {
+			return true
+		}
+		return nodeUsesName(n.Node)
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+// Licensed to Michael Tougeron <github@e.tougeron.com> under
+// one or more contributor license agreements. See the LICENSE
+// file distributed with this work for additional information
+// regarding copyright ownership.
+// Michael Tougeron <github@e.tougeron.com> licenses this file
+// to you under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package tagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func Test_validateTagsAnnotation(t *testing.T) {
+	tests := []struct {
+		name         string
+		tagString    string
+		clouds       []string
+		wantInvalid  []string
+		wantWarnings []string
+	}{
+		{
+			name:      "valid tags",
+			tagString: "{\"team\": \"storage\", \"owner\": \"{{ .Namespace }}\"}",
+			clouds:    []string{AWS, GCP, AZURE},
+		},
+		{
+			name:        "invalid json",
+			tagString:   "team=storage",
+			clouds:      []string{AWS},
+			wantInvalid: []string{"invalid JSON in k8s-pvc-tagger/tags annotation: invalid character 'e' in literal true (expecting 'r')"},
+		},
+		{
+			name:        "restricted tag",
+			tagString:   "{\"kubernetes.io/created-for/pvc/name\": \"foo\", \"team\": \"storage\"}",
+			clouds:      []string{AWS},
+			wantInvalid: []string{"kubernetes.io/created-for/pvc/name is a restricted tag"},
+		},
+		{
+			name:      "gcp constraints",
+			tagString: "{\"dom.tld/Team\": \"Storage\", \"owner\": \"{{ .Namespace }}\"}",
+			clouds:    []string{GCP},
+			wantWarnings: []string{
+				"tag dom.tld/Team is set as dom-tld_team on GCP",
+				"value of tag dom.tld/Team is set as storage on GCP",
+			},
+		},
+		{
+			name:         "azure constraints",
+			tagString:    "{\"dom.tld/team\": \"storage\"}",
+			clouds:       []string{AZURE},
+			wantWarnings: []string{"tag dom.tld/team is set as dom.tld_team on Azure"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invalid, warnings := newTestTagger().validateTagsAnnotation("k8s-pvc-tagger/tags", tt.tagString, tt.clouds)
+			if !reflect.DeepEqual(invalid, tt.wantInvalid) {
+				t.Errorf("validateTagsAnnotation() invalid = %v, want %v", invalid, tt.wantInvalid)
+			}
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("validateTagsAnnotation() warnings = %v, want %v", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func newTestAdmissionRequest(t *testing.T, operation admissionv1.Operation, tags string, oldTags string) *admissionv1.AdmissionRequest {
+	raw := func(tags string) runtime.RawExtension {
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Namespace: "my-namespace"}}
+		if tags != "" {
+			pvc.SetAnnotations(map[string]string{"k8s-pvc-tagger/tags": tags})
+		}
+		data, err := json.Marshal(pvc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: data}
+	}
+	req := &admissionv1.AdmissionRequest{
+		UID:       types.UID("1234"),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"},
+		Operation: operation,
+		Object:    raw(tags),
+	}
+	if operation == admissionv1.Update {
+		req.OldObject = raw(oldTags)
+	}
+	return req
+}
+
+func Test_validateAdmissionRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         *admissionv1.AdmissionRequest
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:        "valid tags",
+			req:         newTestAdmissionRequest(t, admissionv1.Create, "{\"team\": \"storage\"}", ""),
+			wantAllowed: true,
+		},
+		{
+			name:        "no tags annotation",
+			req:         newTestAdmissionRequest(t, admissionv1.Create, "", ""),
+			wantAllowed: true,
+		},
+		{
+			name:        "broken template",
+			req:         newTestAdmissionRequest(t, admissionv1.Create, "{\"team\": \"{{ .Labels.team \"}", ""),
+			wantAllowed: false,
+			wantMessage: "invalid k8s-pvc-tagger/tags annotation: invalid template in tag team: template: tag:1: unclosed action",
+		},
+		{
+			name:        "invalid tags added by an update",
+			req:         newTestAdmissionRequest(t, admissionv1.Update, "{\"Name\": \"foo\"}", "{\"team\": \"storage\"}"),
+			wantAllowed: false,
+			wantMessage: "invalid k8s-pvc-tagger/tags annotation: Name is a restricted tag",
+		},
+		{
+			name:        "unchanged invalid tags",
+			req:         newTestAdmissionRequest(t, admissionv1.Update, "{\"Name\": \"foo\"}", "{\"Name\": \"foo\"}"),
+			wantAllowed: true,
+		},
+		{
+			name:        "delete",
+			req:         &admissionv1.AdmissionRequest{Operation: admissionv1.Delete},
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newTestTagger().validateAdmissionRequest(tt.req)
+			if got.Allowed != tt.wantAllowed {
+				t.Errorf("validateAdmissionRequest() allowed = %v, want %v", got.Allowed, tt.wantAllowed)
+			}
+			var message string
+			if got.Result != nil {
+				message = got.Result.Message
+			}
+			if message != tt.wantMessage {
+				t.Errorf("validateAdmissionRequest() message = %q, want %q", message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func Test_admissionHandler(t *testing.T) {
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  newTestAdmissionRequest(t, admissionv1.Create, "{\"Name\": \"foo\"}", ""),
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tg := newTestTagger()
+	rec := httptest.NewRecorder()
+	tg.admissionHandler(tg.validateAdmissionRequest)(rec, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %v, want %v", rec.Code, http.StatusOK)
+	}
+	got := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Response == nil || got.Response.UID != "1234" || got.Response.Allowed {
+		t.Errorf("AdmissionReview response = %+v, want a denial of request 1234", got.Response)
+	}
+
+	rec = httptest.NewRecorder()
+	tg.admissionHandler(tg.validateAdmissionRequest)(rec, httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status code of an invalid review = %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_mutateAdmissionRequest(t *testing.T) {
+	tg := newTestTagger()
+	tg.settings.DefaultTags = map[string]string{"team": "storage"}
+
+	newPVCRequest := func(operation admissionv1.Operation, meta metav1.ObjectMeta) *admissionv1.AdmissionRequest {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: meta,
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &dummyStorageClassName},
+		}
+		data, err := json.Marshal(pvc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"},
+			Namespace: "my-namespace",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: data},
+		}
+	}
+	newRequest := func(operation admissionv1.Operation, annotations map[string]string) *admissionv1.AdmissionRequest {
+		return newPVCRequest(operation, metav1.ObjectMeta{Name: "my-pvc", Annotations: annotations})
+	}
+
+	tests := []struct {
+		name        string
+		req         *admissionv1.AdmissionRequest
+		wantPatch   string
+		wantAllowed bool
+	}{
+		{
+			name:        "no annotations",
+			req:         newRequest(admissionv1.Create, nil),
+			wantAllowed: true,
+			wantPatch:   `[{"op":"add","path":"/metadata/annotations","value":{"k8s-pvc-tagger/tags":"{\"team\":\"storage\"}"}}]`,
+		},
+		{
+			name:        "merged and rendered tags annotation",
+			req:         newRequest(admissionv1.Create, map[string]string{"k8s-pvc-tagger/tags": "{\"owner\": \"{{ .Namespace }}\", \"team\": \"db\"}"}),
+			wantAllowed: true,
+			wantPatch:   `[{"op":"add","path":"/metadata/annotations/k8s-pvc-tagger~1tags","value":"{\"owner\":\"my-namespace\",\"team\":\"db\"}"}]`,
+		},
+		{
+			name:        "name template of a named PVC",
+			req:         newRequest(admissionv1.Create, map[string]string{"k8s-pvc-tagger/tags": "{\"owner\": \"{{ .Name }}\"}"}),
+			wantAllowed: true,
+			wantPatch:   `[{"op":"add","path":"/metadata/annotations/k8s-pvc-tagger~1tags","value":"{\"owner\":\"my-pvc\",\"team\":\"storage\"}"}]`,
+		},
+		{
+			name: "name template of a PVC with generateName",
+			req: newPVCRequest(admissionv1.Create, metav1.ObjectMeta{
+				GenerateName: "my-pvc-",
+				Annotations:  map[string]string{"k8s-pvc-tagger/tags": "{\"owner\": \"{{ .Name }}\", \"env\": \"{{ .Namespace }}\"}"},
+			}),
+			wantAllowed: true,
+			wantPatch:   `[{"op":"add","path":"/metadata/annotations/k8s-pvc-tagger~1tags","value":"{\"env\":\"my-namespace\",\"owner\":\"{{ .Name }}\",\"team\":\"storage\"}"}]`,
+		},
+		{
+			name:        "tags annotation already set",
+			req:         newRequest(admissionv1.Create, map[string]string{"k8s-pvc-tagger/tags": "{\"team\":\"storage\"}"}),
+			wantAllowed: true,
+		},
+		{
+			name:        "ignored PVC",
+			req:         newRequest(admissionv1.Create, map[string]string{"k8s-pvc-tagger/ignore": ""}),
+			wantAllowed: true,
+		},
+		{
+			name: "restricted tag",
+			req:  newRequest(admissionv1.Create, map[string]string{"k8s-pvc-tagger/tags": "{\"Name\": \"my-volume\", \"team\": \"db\"}"}),
+		},
+		{
+			name: "malformed JSON",
+			req:  newRequest(admissionv1.Create, map[string]string{"k8s-pvc-tagger/tags": "{\"team\": "}),
+		},
+		{
+			name:        "update",
+			req:         newRequest(admissionv1.Update, nil),
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tg.mutateAdmissionRequest(tt.req)
+			if got.Allowed != tt.wantAllowed {
+				t.Errorf("mutateAdmissionRequest() allowed = %v, want %v", got.Allowed, tt.wantAllowed)
+			}
+			if string(got.Patch) != tt.wantPatch {
+				t.Errorf("mutateAdmissionRequest() patch = %s, want %s", got.Patch, tt.wantPatch)
+			}
+			if tt.wantPatch != "" && (got.PatchType == nil || *got.PatchType != admissionv1.PatchTypeJSONPatch) {
+				t.Errorf("mutateAdmissionRequest() patchType = %v, want %v", got.PatchType, admissionv1.PatchTypeJSONPatch)
+			}
+		})
+	}
+}
+
+func Test_mutateAdmissionRequest_metrics(t *testing.T) {
+	tg := newTestTagger()
+	tg.settings.DefaultTags = map[string]string{"kubernetes.io/cluster": "prod", "team": "storage"}
+	storageclass := "webhook-metrics"
+
+	for _, annotations := range []map[string]string{nil, {"k8s-pvc-tagger/ignore": ""}} {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-pvc", Annotations: annotations},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &storageclass},
+		}
+		data, err := json.Marshal(pvc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ignoredBefore := testutil.ToFloat64(promIgnoredTotal.WithLabelValues(storageclass))
+		invalidBefore := testutil.ToFloat64(promInvalidTagsTotal.WithLabelValues(storageclass))
+		tg.mutateAdmissionRequest(&admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"},
+			Namespace: "my-namespace",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: data},
+		})
+		if got := testutil.ToFloat64(promIgnoredTotal.WithLabelValues(storageclass)) - ignoredBefore; got != 0 {
+			t.Errorf("ignored PVCs counted = %v, want 0", got)
+		}
+		if got := testutil.ToFloat64(promInvalidTagsTotal.WithLabelValues(storageclass)) - invalidBefore; got != 0 {
+			t.Errorf("invalid tags counted = %v, want 0", got)
+		}
+	}
+}
+
+func Test_templateUsesName(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{value: "storage", want: false},
+		{value: "{{ .Namespace }}", want: false},
+		{value: "{{ .Name }}", want: true},
+		{value: "{{ $.Name }}-data", want: true},
+		{value: "{{ if .Labels.app }}{{ .Name }}{{ end }}", want: true},
+		{value: "{{ with .Labels }}{{ .app }}{{ end }}", want: false},
+		{value: "{{ printf \"%s-%s\" .Namespace .Name }}", want: true},
+		{value: "{{ .Labels.Name }}", want: false},
+		{value: "{{ .Name", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := templateUsesName(tt.value); got != tt.want {
+				t.Errorf("templateUsesName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}